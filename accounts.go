@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// accountsPageSize is the number of users the accounts
+// chat command lists per page.
+const accountsPageSize = 20
+
+var (
+	ErrUserExists         = errors.New("user already exists")
+	ErrNoSuchUser         = errors.New("user does not exist")
+	ErrInvalidName        = errors.New("invalid player name")
+	ErrDeleteNotSupported = errors.New("auth backend does not support deleting users")
+	ErrRenameNotSupported = errors.New("auth backend does not support renaming users")
+	ErrListNotSupported   = errors.New("auth backend does not support listing users")
+)
+
+// A UserDeleter is an AuthBackend that can delete users.
+type UserDeleter interface {
+	// Delete deletes the user with the specified name
+	// including all associated information except for bans.
+	// Authentication failures may be kept.
+	// Permissions are deleted by DeleteUser.
+	// It returns ErrNoSuchUser if the user doesn't exist.
+	Delete(name string) error
+}
+
+// A UserRenamer is an AuthBackend that can rename users.
+type UserRenamer interface {
+	// Rename changes the name of a user, keeping the password,
+	// the timestamp and the last server.
+	// Permissions are moved by RenameUser.
+	// It returns ErrNoSuchUser if the user doesn't exist
+	// and ErrUserExists if the new name is taken.
+	Rename(name, newName string) error
+}
+
+// A UserLister is an AuthBackend that can list users.
+type UserLister interface {
+	// List returns the names of the users that start with prefix
+	// in ascending order, skipping the first offset names.
+	// At most limit names are returned unless it is zero or less.
+	List(prefix string, offset, limit int) ([]string, error)
+	// Count returns the number of users that start with prefix.
+	Count(prefix string) (int, error)
+}
+
+// A FoldedNameFinder is an AuthBackend that can look up users
+// case-insensitively. It is used to enforce the `FoldNameCase`
+// config option efficiently. All bundled backends implement this interface.
+type FoldedNameFinder interface {
+	// FoldedNames returns the names of all users whose names
+	// are equal to name when compared case-insensitively,
+	// including name itself if it exists.
+	FoldedNames(name string) ([]string, error)
+}
+
+// DeleteUser kicks the user with the specified name if they are connected
+// and deletes them using the active AuthBackend.
+// Their permissions, group memberships and temporary grants
+// are deleted from the active PermissionBackend.
+func DeleteUser(name string) error {
+	ud, ok := DefaultAuth().(UserDeleter)
+	if !ok {
+		return ErrDeleteNotSupported
+	}
+
+	if !validName(name) {
+		return ErrInvalidName
+	}
+
+	if cc := Find(name); cc != nil {
+		cc.Kick("Your account has been deleted.")
+	}
+
+	defer invalidateNameIndex()
+	if err := ud.Delete(name); err != nil {
+		return err
+	}
+
+	return moveUserPerms(name, "")
+}
+
+// RenameUser kicks the user with the specified name if they are connected
+// and renames them using the active AuthBackend.
+// Their permissions, group memberships and temporary grants
+// are moved to the new name in the active PermissionBackend.
+func RenameUser(name, newName string) error {
+	ur, ok := DefaultAuth().(UserRenamer)
+	if !ok {
+		return ErrRenameNotSupported
+	}
+
+	if !validName(name) || !validName(newName) {
+		return ErrInvalidName
+	}
+
+	if cc := Find(name); cc != nil {
+		cc.Kick("Your account has been renamed to " + newName + ".")
+	}
+
+	defer invalidateNameIndex()
+	if err := ur.Rename(name, newName); err != nil {
+		return err
+	}
+
+	return moveUserPerms(name, newName)
+}
+
+// ListUsers returns a page of user names using the active AuthBackend.
+// See UserLister for details.
+func ListUsers(prefix string, offset, limit int) ([]string, error) {
+	ul, ok := DefaultAuth().(UserLister)
+	if !ok {
+		return nil, ErrListNotSupported
+	}
+
+	return ul.List(prefix, offset, limit)
+}
+
+// CountUsers returns the number of users that start with prefix
+// using the active AuthBackend.
+func CountUsers(prefix string) (int, error) {
+	ul, ok := DefaultAuth().(UserLister)
+	if !ok {
+		return 0, ErrListNotSupported
+	}
+
+	return ul.Count(prefix)
+}
+
+// validName reports whether a player name is allowed
+// by the length and character restrictions.
+func validName(name string) bool {
+	return len(name) > 0 && len(name) <= maxPlayerNameLen && playerNameChars.MatchString(name)
+}
+
+func init() {
+	registerCoreChatCmd(ChatCmd{
+		Name:  "accounts",
+		Perm:  "cmd.accounts",
+		Help:  "List the accounts starting with an optional prefix.",
+		Usage: "accounts [prefix] [page]",
+		Handler: func(cc *ClientConn, args ...string) string {
+			var prefix string
+			page := 1
+
+			switch len(args) {
+			case 0:
+			case 1:
+				prefix = args[0]
+			case 2:
+				prefix = args[0]
+
+				var err error
+				if page, err = strconv.Atoi(args[1]); err != nil || page < 1 {
+					return "Invalid page " + args[1] + "."
+				}
+			default:
+				return "Usage: accounts [prefix] [page]"
+			}
+
+			n, err := CountUsers(prefix)
+			if err != nil {
+				return "Could not count accounts: " + err.Error()
+			}
+
+			names, err := ListUsers(prefix, (page-1)*accountsPageSize, accountsPageSize)
+			if err != nil {
+				return "Could not list accounts: " + err.Error()
+			}
+
+			pages := (n + accountsPageSize - 1) / accountsPageSize
+			return fmt.Sprintf("%d accounts, page %d of %d: %s", n, page, pages, strings.Join(names, ", "))
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "delaccount",
+		Perm:  "cmd.delaccount",
+		Help:  "Delete an account, kicking the player if they are connected.",
+		Usage: "delaccount <name>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 1 {
+				return "Usage: delaccount <name>"
+			}
+
+			if err := DeleteUser(args[0]); err != nil {
+				return "Could not delete account: " + err.Error()
+			}
+
+			cc.Log("<-", "delete account", args[0])
+			return "Account deleted."
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "renameaccount",
+		Perm:  "cmd.renameaccount",
+		Help:  "Rename an account, kicking the player if they are connected.",
+		Usage: "renameaccount <name> <new name>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 2 {
+				return "Usage: renameaccount <name> <new name>"
+			}
+
+			if err := RenameUser(args[0], args[1]); err != nil {
+				return "Could not rename account: " + err.Error()
+			}
+
+			cc.Log("<-", "rename account", args[0], "to", args[1])
+			return "Account renamed."
+		},
+	})
+}
+
+// paginate returns the part of a list
+// that is selected by offset and limit.
+func paginate(names []string, offset, limit int) []string {
+	if offset < 0 {
+		offset = 0
+	}
+
+	if offset >= len(names) {
+		return []string{}
+	}
+
+	names = names[offset:]
+	if limit > 0 && limit < len(names) {
+		names = names[:limit]
+	}
+
+	return names
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testAccounts is an AuthBackend that can only delete and rename users.
+type testAccounts struct {
+	AuthBackend
+	users map[string]bool
+}
+
+func (a *testAccounts) Delete(name string) error {
+	if !a.users[name] {
+		return ErrNoSuchUser
+	}
+
+	delete(a.users, name)
+	return nil
+}
+
+func (a *testAccounts) Rename(name, newName string) error {
+	if !a.users[name] {
+		return ErrNoSuchUser
+	}
+
+	if a.users[newName] {
+		return ErrUserExists
+	}
+
+	delete(a.users, name)
+	a.users[newName] = true
+	return nil
+}
+
+// testPerms is a TempGrantBackend that keeps everything in memory.
+type testPerms struct {
+	perms  map[[2]string][]string
+	groups map[string][]string
+	temp   map[TempGrant]TempGrant
+}
+
+func newTestPerms() *testPerms {
+	return &testPerms{
+		perms:  make(map[[2]string][]string),
+		groups: make(map[string][]string),
+		temp:   make(map[TempGrant]TempGrant),
+	}
+}
+
+func (p *testPerms) UserGroups(name string) ([]string, error) {
+	return append([]string{}, p.groups[name]...), nil
+}
+
+func (p *testPerms) AddUserGroup(name, group string) error {
+	if !containsStr(p.groups[name], group) {
+		p.groups[name] = append(p.groups[name], group)
+	}
+
+	return nil
+}
+
+func (p *testPerms) RemoveUserGroup(name, group string) error {
+	p.groups[name] = without(p.groups[name], group)
+	return nil
+}
+
+func (p *testPerms) Perms(kind, id string) ([]string, error) {
+	return append([]string{}, p.perms[[2]string{kind, id}]...), nil
+}
+
+func (p *testPerms) Grant(kind, id, perm string) error {
+	key := [2]string{kind, id}
+	if !containsStr(p.perms[key], perm) {
+		p.perms[key] = append(p.perms[key], perm)
+	}
+
+	return nil
+}
+
+func (p *testPerms) Revoke(kind, id, perm string) error {
+	key := [2]string{kind, id}
+	p.perms[key] = without(p.perms[key], perm)
+	return nil
+}
+
+func (p *testPerms) TempGrants() ([]TempGrant, error) {
+	var tgs []TempGrant
+	for _, tg := range p.temp {
+		tgs = append(tgs, tg)
+	}
+
+	return tgs, nil
+}
+
+func (p *testPerms) SetTempGrant(tg TempGrant) error {
+	p.temp[tg.key()] = tg
+	return nil
+}
+
+func (p *testPerms) DeleteTempGrant(kind, id, perm string) error {
+	delete(p.temp, TempGrant{Kind: kind, ID: id, Perm: perm})
+	return nil
+}
+
+func without(list []string, s string) []string {
+	var out []string
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+// useTestBackends replaces the active backends for the duration of a test.
+func useTestBackends(t *testing.T, ab AuthBackend, pb PermissionBackend) {
+	oldAuth, oldPerm := authIface, permIface
+	authIface, permIface = ab, pb
+
+	t.Cleanup(func() {
+		authIface, permIface = oldAuth, oldPerm
+		invalidatePermCache()
+
+		tempGrantsMu.Lock()
+		clear(tempGrants)
+		tempGrantsMu.Unlock()
+	})
+}
+
+func testUserPerms(t *testing.T, pb *testPerms) {
+	t.Helper()
+
+	expiry := time.Now().Add(time.Hour)
+
+	pb.Grant(PermUser, "alice", "fly")
+	pb.Grant(PermUser, "alice", "fast")
+	pb.Grant(PermUser, "bob", "fly")
+	pb.AddUserGroup("alice", "mod")
+	pb.Grant(PermGroup, "alice", "group.perm")
+
+	for _, tg := range []TempGrant{
+		{Kind: PermUser, ID: "alice", Perm: "fast", Expiry: expiry},
+		{Kind: PermMember, ID: "alice", Perm: "mod", Expiry: expiry},
+		{Kind: PermGroup, ID: "alice", Perm: "group.perm", Expiry: expiry},
+	} {
+		pb.SetTempGrant(tg)
+	}
+
+	if err := refreshTempGrants(pb); err != nil {
+		t.Fatal(err)
+	}
+
+	// Populate the cache to make sure it is invalidated.
+	if _, err := cachedPerms(pb, PermUser, "alice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempGrantKeys(tgs []TempGrant) []string {
+	var keys []string
+	for _, tg := range tgs {
+		keys = append(keys, tg.Kind+" "+tg.ID+" "+tg.Perm)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDeleteUserPerms(t *testing.T) {
+	pb := newTestPerms()
+	useTestBackends(t, &testAccounts{users: map[string]bool{"alice": true, "bob": true}}, pb)
+	testUserPerms(t, pb)
+
+	if err := DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if perms, _ := cachedPerms(pb, PermUser, "alice"); len(perms) != 0 {
+		t.Errorf("perms = %q, want none", perms)
+	}
+
+	if groups, _ := cachedPerms(pb, PermMember, "alice"); len(groups) != 0 {
+		t.Errorf("groups = %q, want none", groups)
+	}
+
+	if perms, _ := pb.Perms(PermUser, "bob"); !reflect.DeepEqual(perms, []string{"fly"}) {
+		t.Errorf("perms of other user = %q, want [fly]", perms)
+	}
+
+	if perms, _ := pb.Perms(PermGroup, "alice"); !reflect.DeepEqual(perms, []string{"group.perm"}) {
+		t.Errorf("perms of group with the same name = %q, want [group.perm]", perms)
+	}
+
+	want := []string{PermGroup + " alice group.perm"}
+
+	stored, _ := pb.TempGrants()
+	if got := tempGrantKeys(stored); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored temporary grants = %q, want %q", got, want)
+	}
+
+	if got := tempGrantKeys(TempGrants()); !reflect.DeepEqual(got, want) {
+		t.Errorf("temporary grants = %q, want %q", got, want)
+	}
+}
+
+func TestRenameUserPerms(t *testing.T) {
+	pb := newTestPerms()
+	useTestBackends(t, &testAccounts{users: map[string]bool{"alice": true, "bob": true}}, pb)
+	testUserPerms(t, pb)
+
+	if err := RenameUser("alice", "carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	if perms, _ := cachedPerms(pb, PermUser, "alice"); len(perms) != 0 {
+		t.Errorf("perms of old name = %q, want none", perms)
+	}
+
+	perms, _ := cachedPerms(pb, PermUser, "carol")
+	sort.Strings(perms)
+	if want := []string{"fast", "fly"}; !reflect.DeepEqual(perms, want) {
+		t.Errorf("perms of new name = %q, want %q", perms, want)
+	}
+
+	if groups, _ := cachedPerms(pb, PermMember, "carol"); !reflect.DeepEqual(groups, []string{"mod"}) {
+		t.Errorf("groups of new name = %q, want [mod]", groups)
+	}
+
+	want := []string{
+		PermGroup + " alice group.perm",
+		PermMember + " carol mod",
+		PermUser + " carol fast",
+	}
+
+	stored, _ := pb.TempGrants()
+	if got := tempGrantKeys(stored); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored temporary grants = %q, want %q", got, want)
+	}
+
+	if got := tempGrantKeys(TempGrants()); !reflect.DeepEqual(got, want) {
+		t.Errorf("temporary grants = %q, want %q", got, want)
+	}
+
+	if err := RenameUser("alice", "bob"); err != ErrNoSuchUser {
+		t.Errorf("RenameUser of deleted user = %v, want %v", err, ErrNoSuchUser)
+	}
+}
@@ -19,11 +19,40 @@ type User struct {
 	Salt      []byte
 	Verifier  []byte
 	Timestamp time.Time
+	LastSrv   string
+	// TOTPSecret is nil if the user hasn't enrolled
+	// in two-factor authentication.
+	TOTPSecret []byte
 }
 
+// A Ban is a ban entry. Bans without an Expiry are permanent.
 type Ban struct {
 	Addr string
 	Name string
+
+	Reason  string
+	Issuer  string
+	Created time.Time
+	Expiry  time.Time
+}
+
+// Expired reports whether the Ban has expired.
+func (b Ban) Expired() bool {
+	return !b.Expiry.IsZero() && time.Now().After(b.Expiry)
+}
+
+// Message returns the kick message shown to banned players.
+func (b Ban) Message() string {
+	msg := "Banned by proxy."
+	if b.Reason != "" {
+		msg += " Reason: " + b.Reason
+	}
+
+	if !b.Expiry.IsZero() {
+		msg += " Expires: " + b.Expiry.Format(time.RFC1123)
+	}
+
+	return msg
 }
 
 // An AuthBackend provides authentication and moderation functionality.
@@ -59,7 +88,8 @@ type AuthBackend interface {
 	// Export returns all authentication entries or an error.
 	Export() ([]User, error)
 
-	// Ban adds a ban entry for a network address and an associated name.
+	// Ban adds a permanent ban entry for a network address
+	// and an associated name.
 	// Only the specified network address is banned from connecting.
 	// Existing connections are not kicked.
 	Ban(addr, name string) error
@@ -73,6 +103,8 @@ type AuthBackend interface {
 	// network address and username. The implementation is not required
 	// to process this event in any way, but the intent is to allow
 	// rate limiting / brute-force protection to be implemented by plugins.
+	// Backends that also implement FailRecorder can use the builtin
+	// lockout policy by storing the failures accordingly.
 	RecordFail(addr, name string, sudo bool) error
 	// ImportBans adds or modifies ban entries in bulk.
 	ImportBans(in []Ban) error
@@ -80,6 +112,30 @@ type AuthBackend interface {
 	ExportBans() ([]Ban, error)
 }
 
+// A BanInfoBackend is an AuthBackend that stores the reason, issuer,
+// creation time and expiry of ban entries. Expired bans must not
+// be reported by Banned and are deleted automatically.
+// All bundled backends implement this interface.
+type BanInfoBackend interface {
+	// AddBan adds or replaces a ban entry including its details.
+	AddBan(b Ban) error
+	// BanEntry returns the ban entry that bans a network address
+	// or username. The boolean is false if neither is banned.
+	BanEntry(addr, name string) (Ban, bool, error)
+}
+
+// A BanLister is an AuthBackend that can list its ban entries
+// without modifying them. Unlike ExportBans, Bans includes
+// expired entries. It is used to match range and pattern bans
+// and to delete expired bans.
+// Backends that don't implement this interface are queried
+// using ExportBans instead.
+// All bundled backends implement this interface.
+type BanLister interface {
+	// Bans returns all ban entries including expired ones.
+	Bans() ([]Ban, error)
+}
+
 // DefaultAuth returns the authentication backend that is currently in use
 // or nil during initialization time.
 func DefaultAuth() AuthBackend {
@@ -116,3 +172,26 @@ func DecodeVerifierAndSalt(encodedPasswd string) ([]byte, []byte, error) {
 
 	return salt, verifier, nil
 }
+
+// oneLine replaces line breaks with spaces.
+func oneLine(s string) string {
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(s)
+}
+
+// unixOrZero returns the Unix time of t or 0 if t is the zero time.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// timeOrZero reverses unixOrZero.
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(unix, 0)
+}
@@ -1,7 +1,13 @@
 package proxy
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -69,6 +75,102 @@ func (a AuthFiles) SetLastSrv(name, srv string) error {
 	return os.WriteFile(Path("auth/", name, "/last_server"), []byte(srv), 0600)
 }
 
+// TOTPSecret returns the TOTP secret of a user
+// or nil if they haven't enrolled.
+func (a AuthFiles) TOTPSecret(name string) ([]byte, error) {
+	os.Mkdir(Path("auth"), 0700)
+
+	secret, err := os.ReadFile(Path("auth/", name, "/totp"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return secret, err
+}
+
+// SetTOTPSecret sets the TOTP secret of an existing user.
+func (a AuthFiles) SetTOTPSecret(name string, secret []byte) error {
+	if !a.Exists(name) {
+		return ErrNoSuchUser
+	}
+
+	return os.WriteFile(Path("auth/", name, "/totp"), secret, 0600)
+}
+
+// DeleteTOTPSecret deletes the TOTP secret of a user.
+func (a AuthFiles) DeleteTOTPSecret(name string) error {
+	os.Mkdir(Path("auth"), 0700)
+
+	if err := os.Remove(Path("auth/", name, "/totp")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// PasswdReset returns the pending password reset of a user
+// and whether it exists. The file contains the hex-encoded hash
+// of the reset code (empty if there is none), the issuer
+// and the creation and expiry times on separate lines.
+func (a AuthFiles) PasswdReset(name string) (PasswdReset, bool, error) {
+	os.Mkdir(Path("auth"), 0700)
+
+	data, err := os.ReadFile(Path("auth/", name, "/passwd_reset"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return PasswdReset{}, false, nil
+		}
+
+		return PasswdReset{}, false, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for len(lines) < 4 {
+		lines = append(lines, "")
+	}
+
+	r := PasswdReset{
+		Name:   name,
+		Issuer: lines[1],
+	}
+
+	if lines[0] != "" {
+		if r.Code, err = hex.DecodeString(lines[0]); err != nil {
+			return PasswdReset{}, false, err
+		}
+	}
+
+	created, _ := strconv.ParseInt(lines[2], 10, 64)
+	r.Created = timeOrZero(created)
+
+	expiry, _ := strconv.ParseInt(lines[3], 10, 64)
+	r.Expiry = timeOrZero(expiry)
+
+	return r, true, nil
+}
+
+// SetPasswdReset adds or replaces the password reset
+// of an existing user.
+func (a AuthFiles) SetPasswdReset(r PasswdReset) error {
+	if !a.Exists(r.Name) {
+		return ErrNoSuchUser
+	}
+
+	data := fmt.Sprintf("%s\n%s\n%d\n%d\n", hex.EncodeToString(r.Code), oneLine(r.Issuer), unixOrZero(r.Created), unixOrZero(r.Expiry))
+	return os.WriteFile(Path("auth/", r.Name, "/passwd_reset"), []byte(data), 0600)
+}
+
+// DeletePasswdReset deletes the pending password reset of a user.
+func (a AuthFiles) DeletePasswdReset(name string) error {
+	os.Mkdir(Path("auth"), 0700)
+
+	if err := os.Remove(Path("auth/", name, "/passwd_reset")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
 // Timestamp returns the last time an authentication entry was accessed
 // or an error.
 func (a AuthFiles) Timestamp(name string) (time.Time, error) {
@@ -94,6 +196,18 @@ func (a AuthFiles) Import(in []User) error {
 		if err := os.Chtimes(Path("auth/", u.Name, "/timestamp"), u.Timestamp, u.Timestamp); err != nil {
 			return err
 		}
+
+		if u.LastSrv != "" {
+			if err := a.SetLastSrv(u.Name, u.LastSrv); err != nil {
+				return err
+			}
+		}
+
+		if u.TOTPSecret != nil {
+			if err := a.SetTOTPSecret(u.Name, u.TOTPSecret); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -121,16 +235,119 @@ func (a AuthFiles) Export() ([]User, error) {
 			return nil, err
 		}
 
+		// The last server is optional.
+		u.LastSrv, _ = a.LastSrv(u.Name)
+
+		u.TOTPSecret, err = a.TOTPSecret(u.Name)
+		if err != nil {
+			return nil, err
+		}
+
 		out = append(out, u)
 	}
 
 	return out, nil
 }
 
-// Ban adds a ban entry for a network address and an associated name.
+// Delete deletes a user, their TOTP secret, their pending password reset
+// and their authentication failures.
+func (a AuthFiles) Delete(name string) error {
+	if !a.Exists(name) {
+		return ErrNoSuchUser
+	}
+
+	if err := os.RemoveAll(Path("auth/", name)); err != nil {
+		return err
+	}
+
+	return errors.Join(a.DeleteFailRecord(LockName, name), a.DeleteFailRecord(LockSudo, name), a.DeleteFailRecord(LockTOTP, name), a.DeleteFailRecord(LockResetCode, name))
+}
+
+// Rename changes the name of a user.
+func (a AuthFiles) Rename(name, newName string) error {
+	if !a.Exists(name) {
+		return ErrNoSuchUser
+	}
+
+	if a.Exists(newName) {
+		return ErrUserExists
+	}
+
+	return os.Rename(Path("auth/", name), Path("auth/", newName))
+}
+
+// List returns the names of the users that start with prefix
+// in ascending order.
+func (a AuthFiles) List(prefix string, offset, limit int) ([]string, error) {
+	names, err := a.names(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return paginate(names, offset, limit), nil
+}
+
+// Count returns the number of users that start with prefix.
+func (a AuthFiles) Count(prefix string) (int, error) {
+	names, err := a.names(prefix)
+	return len(names), err
+}
+
+// FoldedNames returns the names of all users whose names are equal
+// to name when compared case-insensitively.
+func (a AuthFiles) FoldedNames(name string) ([]string, error) {
+	names, err := a.names("")
+	if err != nil {
+		return nil, err
+	}
+
+	var folded []string
+	for _, existing := range names {
+		if strings.EqualFold(existing, name) {
+			folded = append(folded, existing)
+		}
+	}
+
+	return folded, nil
+}
+
+func (a AuthFiles) names(prefix string) ([]string, error) {
+	os.Mkdir(Path("auth"), 0700)
+
+	// ReadDir returns the entries sorted by name.
+	dir, err := os.ReadDir(Path("auth"))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range dir {
+		if strings.HasPrefix(f.Name(), prefix) {
+			names = append(names, f.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Ban adds a permanent ban entry for a network address
+// and an associated name.
 func (a AuthFiles) Ban(addr, name string) error {
+	return a.AddBan(Ban{
+		Addr:    addr,
+		Name:    name,
+		Created: time.Now(),
+	})
+}
+
+// AddBan adds a ban entry including its details.
+// The file contains the name, issuer, creation time, expiry
+// and reason on separate lines.
+func (a AuthFiles) AddBan(b Ban) error {
 	os.Mkdir(Path("ban"), 0700)
-	return os.WriteFile(Path("ban/", addr), []byte(name), 0600)
+
+	data := fmt.Sprintf("%s\n%s\n%d\n%d\n%s\n", b.Name, oneLine(b.Issuer), unixOrZero(b.Created), unixOrZero(b.Expiry), oneLine(b.Reason))
+	return os.WriteFile(a.banPath(b.Addr), []byte(data), 0600)
 }
 
 // Unban deletes a ban entry. It accepts both network addresses
@@ -138,7 +355,7 @@ func (a AuthFiles) Ban(addr, name string) error {
 func (a AuthFiles) Unban(id string) error {
 	os.Mkdir(Path("ban"), 0700)
 
-	if err := os.Remove(Path("ban/", id)); err != nil {
+	if err := os.Remove(a.banPath(id)); err != nil {
 		if os.IsNotExist(err) {
 			dir, err := os.ReadDir(Path("ban"))
 			if err != nil {
@@ -146,13 +363,13 @@ func (a AuthFiles) Unban(id string) error {
 			}
 
 			for _, f := range dir {
-				name, err := os.ReadFile(Path("ban/", f.Name()))
+				b, err := a.readBan(banFileAddr(f.Name()))
 				if err != nil {
 					return err
 				}
 
-				if string(name) == id {
-					return os.Remove(Path("ban/", f.Name()))
+				if b.Name == id {
+					return os.Remove(a.banPath(b.Addr))
 				}
 			}
 		}
@@ -164,27 +381,122 @@ func (a AuthFiles) Unban(id string) error {
 // Banned reports whether a network address is banned.
 // Error cases count as banned.
 func (a AuthFiles) Banned(addr, name string) bool {
+	_, banned, err := a.BanEntry(addr, name)
+	return banned || err != nil
+}
+
+// BanEntry returns the ban entry of a network address.
+// Expired entries are deleted.
+func (a AuthFiles) BanEntry(addr, name string) (Ban, bool, error) {
 	os.Mkdir(Path("ban"), 0700)
 
-	_, err := os.Stat(Path("ban/", addr))
-	if os.IsNotExist(err) {
-		return false
+	b, err := a.readBan(addr)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Ban{}, false, nil
+		}
+
+		return Ban{}, false, err
 	}
 
-	return true
+	if b.Expired() {
+		return Ban{}, false, a.Unban(addr)
+	}
+
+	return b, true, nil
 }
 
-// RecordFail is a no-op.
+// RecordFail records an authentication failure
+// and locks the network address or user out if necessary.
 func (a AuthFiles) RecordFail(addr, name string, sudo bool) error {
+	return recordFail(a, addr, name, sudo)
+}
+
+// FailRecord returns the authentication failures
+// of a network address or user.
+func (a AuthFiles) FailRecord(kind, id string) (FailRecord, error) {
+	os.Mkdir(Path("fail"), 0700)
+
+	r := FailRecord{Kind: kind, ID: id}
+
+	data, err := os.ReadFile(a.failPath(kind, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+
+		return FailRecord{}, err
+	}
+
+	var last, until int64
+	if _, err := fmt.Sscan(string(data), &r.Fails, &last, &until); err != nil {
+		return FailRecord{}, err
+	}
+
+	r.Last = time.Unix(last, 0)
+	r.Until = time.Unix(until, 0)
+
+	return r, nil
+}
+
+// SetFailRecord stores the authentication failures
+// of a network address or user.
+func (a AuthFiles) SetFailRecord(r FailRecord) error {
+	os.Mkdir(Path("fail"), 0700)
+	os.Mkdir(Path("fail/", url.PathEscape(r.Kind)), 0700)
+
+	data := fmt.Sprintf("%d %d %d\n", r.Fails, r.Last.Unix(), r.Until.Unix())
+	return os.WriteFile(a.failPath(r.Kind, r.ID), []byte(data), 0600)
+}
+
+// DeleteFailRecord deletes the authentication failures
+// of a network address or user.
+func (a AuthFiles) DeleteFailRecord(kind, id string) error {
+	os.Mkdir(Path("fail"), 0700)
+
+	if err := os.Remove(a.failPath(kind, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
 	return nil
 }
 
+// FailRecords returns the authentication failures
+// of all network addresses and users or an error.
+func (a AuthFiles) FailRecords() ([]FailRecord, error) {
+	os.Mkdir(Path("fail"), 0700)
+
+	kinds, err := os.ReadDir(Path("fail"))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []FailRecord
+	for _, kind := range kinds {
+		dir, err := os.ReadDir(Path("fail/", kind.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range dir {
+			r, err := a.FailRecord(banFileAddr(kind.Name()), banFileAddr(f.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, r)
+		}
+	}
+
+	return out, nil
+}
+
 // ImportBans deletes all ban entries and adds the passed entries.
 func (a AuthFiles) ImportBans(in []Ban) error {
 	os.Mkdir(Path("ban"), 0700)
 
 	for _, b := range in {
-		if err := a.Ban(b.Addr, b.Name); err != nil {
+		if err := a.AddBan(b); err != nil {
 			return err
 		}
 	}
@@ -193,8 +505,25 @@ func (a AuthFiles) ImportBans(in []Ban) error {
 }
 
 // ExportBans returns data that can be processed by ImportBans
-// or an error,
+// or an error. Expired entries are omitted.
 func (a AuthFiles) ExportBans() ([]Ban, error) {
+	bans, err := a.Bans()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Ban
+	for _, b := range bans {
+		if !b.Expired() {
+			out = append(out, b)
+		}
+	}
+
+	return out, nil
+}
+
+// Bans returns all ban entries including expired ones.
+func (a AuthFiles) Bans() ([]Ban, error) {
 	os.Mkdir(Path("ban"), 0700)
 
 	dir, err := os.ReadDir(Path("ban"))
@@ -204,20 +533,70 @@ func (a AuthFiles) ExportBans() ([]Ban, error) {
 
 	var out []Ban
 	for _, f := range dir {
-		b := Ban{Addr: f.Name()}
-
-		name, err := os.ReadFile(Path("ban/", f.Name()))
+		b, err := a.readBan(banFileAddr(f.Name()))
 		if err != nil {
 			return nil, err
 		}
 
-		b.Name = string(name)
 		out = append(out, b)
 	}
 
 	return out, nil
 }
 
+// readBan reads a ban entry. Entries created by older versions
+// only contain the name.
+func (a AuthFiles) readBan(addr string) (Ban, error) {
+	data, err := os.ReadFile(a.banPath(addr))
+	if err != nil {
+		return Ban{}, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for len(lines) < 5 {
+		lines = append(lines, "")
+	}
+
+	b := Ban{
+		Addr:   addr,
+		Name:   lines[0],
+		Issuer: lines[1],
+		Reason: lines[4],
+	}
+
+	created, _ := strconv.ParseInt(lines[2], 10, 64)
+	b.Created = timeOrZero(created)
+
+	expiry, _ := strconv.ParseInt(lines[3], 10, 64)
+	b.Expiry = timeOrZero(expiry)
+
+	return b, nil
+}
+
+// banPath returns the path of the file holding a ban entry.
+// Characters that are special in paths, e.g. the slash
+// in CIDR ranges, are escaped.
+func (a AuthFiles) banPath(addr string) string {
+	return Path("ban/", url.PathEscape(addr))
+}
+
+// failPath returns the path of the file holding a FailRecord.
+// The kind and the ID are escaped so that they can't refer
+// to files outside of the fail directory.
+func (a AuthFiles) failPath(kind, id string) string {
+	return Path("fail/", url.PathEscape(kind), "/", url.PathEscape(id))
+}
+
+// banFileAddr reverses the escaping of ban and FailRecord file names.
+func banFileAddr(name string) string {
+	addr, err := url.PathUnescape(name)
+	if err != nil {
+		return name
+	}
+
+	return addr
+}
+
 func (a AuthFiles) updateTimestamp(name string) {
 	os.Mkdir(Path("auth"), 0700)
 
@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	_ "github.com/lib/pq"
 )
@@ -92,6 +93,43 @@ func NewAuthMTPostgreSQL(conn string) (*AuthMTPostgreSQL, error) {
 		return nil, err
 	}
 
+	// The last server of a user is stored in a separate table
+	// to keep the upstream schema intact.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS public.last_server (name text PRIMARY KEY, server text NOT NULL);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Ban details are stored in the database because ipban.txt
+	// can't hold them without breaking compatibility.
+	// Range and pattern bans are only stored in this table
+	// because Minetest can't parse them.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS public.ban_info (addr text PRIMARY KEY, reason text DEFAULT '' NOT NULL, issuer text DEFAULT '' NOT NULL, created bigint DEFAULT 0 NOT NULL, expiry bigint DEFAULT 0 NOT NULL);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Authentication failures are stored in a separate table
+	// to keep the upstream schema intact.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS public.auth_fails (kind text NOT NULL, id text NOT NULL, fails integer DEFAULT 0 NOT NULL, last_fail bigint DEFAULT 0 NOT NULL, locked_until bigint DEFAULT 0 NOT NULL, PRIMARY KEY (kind, id));"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// TOTP secrets are stored in a separate table
+	// to keep the upstream schema intact.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS public.totp (name text PRIMARY KEY, secret bytea NOT NULL);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Pending password resets are stored in a separate table
+	// to keep the upstream schema intact.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS public.passwd_reset (name text PRIMARY KEY, code bytea, issuer text DEFAULT '' NOT NULL, created bigint DEFAULT 0 NOT NULL, expiry bigint DEFAULT 0 NOT NULL);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &AuthMTPostgreSQL{db}, nil
 }
 
@@ -137,16 +175,94 @@ func (a *AuthMTPostgreSQL) SetPasswd(name string, salt, verifier []byte) error {
 	return err
 }
 
-// LastSrv always returns an error
-// since the Minetest database schema cannot store this information.
-func (a *AuthMTPostgreSQL) LastSrv(_ string) (string, error) {
-	return "", ErrLastSrvNotSupported
+// LastSrv returns the last server a user was on.
+func (a *AuthMTPostgreSQL) LastSrv(name string) (string, error) {
+	result := a.db.QueryRow("SELECT server FROM last_server WHERE name = $1;", name)
+
+	var srv string
+	if err := result.Scan(&srv); err != nil {
+		return "", err
+	}
+
+	return srv, nil
 }
 
-// SetLastSrv is a no-op
-// since the Minetest database schema cannot store this information.
-func (a *AuthMTPostgreSQL) SetLastSrv(_, _ string) error {
-	return nil
+// SetLastSrv sets the last server a user was on.
+func (a *AuthMTPostgreSQL) SetLastSrv(name, srv string) error {
+	_, err := a.db.Exec("INSERT INTO last_server (name, server) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET server = EXCLUDED.server;", name, srv)
+	return err
+}
+
+// TOTPSecret returns the TOTP secret of a user
+// or nil if they haven't enrolled.
+func (a *AuthMTPostgreSQL) TOTPSecret(name string) ([]byte, error) {
+	result := a.db.QueryRow("SELECT secret FROM totp WHERE name = $1;", name)
+
+	var secret []byte
+	if err := result.Scan(&secret); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// SetTOTPSecret sets the TOTP secret of an existing user.
+func (a *AuthMTPostgreSQL) SetTOTPSecret(name string, secret []byte) error {
+	if !a.Exists(name) {
+		return ErrNoSuchUser
+	}
+
+	_, err := a.db.Exec("INSERT INTO totp (name, secret) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET secret = EXCLUDED.secret;", name, secret)
+	return err
+}
+
+// DeleteTOTPSecret deletes the TOTP secret of a user.
+func (a *AuthMTPostgreSQL) DeleteTOTPSecret(name string) error {
+	_, err := a.db.Exec("DELETE FROM totp WHERE name = $1;", name)
+	return err
+}
+
+// PasswdReset returns the pending password reset of a user
+// and whether it exists.
+func (a *AuthMTPostgreSQL) PasswdReset(name string) (PasswdReset, bool, error) {
+	result := a.db.QueryRow("SELECT code, issuer, created, expiry FROM passwd_reset WHERE name = $1;", name)
+
+	r := PasswdReset{Name: name}
+
+	var created, expiry int64
+	if err := result.Scan(&r.Code, &r.Issuer, &created, &expiry); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PasswdReset{}, false, nil
+		}
+
+		return PasswdReset{}, false, err
+	}
+
+	r.Created = timeOrZero(created)
+	r.Expiry = timeOrZero(expiry)
+
+	return r, true, nil
+}
+
+// SetPasswdReset adds or replaces the password reset
+// of an existing user.
+func (a *AuthMTPostgreSQL) SetPasswdReset(r PasswdReset) error {
+	if !a.Exists(r.Name) {
+		return ErrNoSuchUser
+	}
+
+	_, err := a.db.Exec("INSERT INTO passwd_reset (name, code, issuer, created, expiry) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (name) DO UPDATE SET code = EXCLUDED.code, issuer = EXCLUDED.issuer, created = EXCLUDED.created, expiry = EXCLUDED.expiry;", r.Name, r.Code, r.Issuer, unixOrZero(r.Created), unixOrZero(r.Expiry))
+	return err
+}
+
+// DeletePasswdReset deletes the pending password reset of a user.
+func (a *AuthMTPostgreSQL) DeletePasswdReset(name string) error {
+	_, err := a.db.Exec("DELETE FROM passwd_reset WHERE name = $1;", name)
+	return err
 }
 
 // Timestamp returns the last time an authentication entry was accessed
@@ -170,6 +286,18 @@ func (a *AuthMTPostgreSQL) Import(in []User) error {
 		}
 
 		a.setTimestamp(u.Name, u.Timestamp)
+
+		if u.LastSrv != "" {
+			if err := a.SetLastSrv(u.Name, u.LastSrv); err != nil {
+				return err
+			}
+		}
+
+		if u.TOTPSecret != nil {
+			if err := a.SetTOTPSecret(u.Name, u.TOTPSecret); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -217,24 +345,197 @@ func (a *AuthMTPostgreSQL) Export() ([]User, error) {
 			return nil, err
 		}
 
+		// The last server is optional.
+		u.LastSrv, _ = a.LastSrv(u.Name)
+
+		u.TOTPSecret, err = a.TOTPSecret(u.Name)
+		if err != nil {
+			return nil, err
+		}
+
 		out = append(out, u)
 	}
 
 	return out, nil
 }
 
-// Ban adds a ban entry for a network address and an associated name.
+// Delete deletes a user, their last server, their TOTP secret,
+// their pending password reset and their authentication failures.
+func (a *AuthMTPostgreSQL) Delete(name string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM auth WHERE name = $1;", name)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNoSuchUser
+	}
+
+	if _, err := tx.Exec("DELETE FROM last_server WHERE name = $1;", name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM totp WHERE name = $1;", name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM passwd_reset WHERE name = $1;", name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM auth_fails WHERE id = $1 AND kind IN ('name', 'sudo', 'totp', 'reset');", name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Rename changes the name of a user.
+func (a *AuthMTPostgreSQL) Rename(name, newName string) error {
+	if a.Exists(newName) {
+		return ErrUserExists
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE auth SET name = $1 WHERE name = $2;", newName, name)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNoSuchUser
+	}
+
+	if _, err := tx.Exec("UPDATE last_server SET name = $1 WHERE name = $2;", newName, name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE totp SET name = $1 WHERE name = $2;", newName, name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE passwd_reset SET name = $1 WHERE name = $2;", newName, name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// List returns the names of the users that start with prefix
+// in ascending order.
+func (a *AuthMTPostgreSQL) List(prefix string, offset, limit int) ([]string, error) {
+	if offset < 0 {
+		offset = 0
+	}
+
+	query := "SELECT name FROM auth WHERE substr(name, 1, $1) = $2 ORDER BY name OFFSET $3;"
+	args := []any{utf8.RuneCountInString(prefix), prefix, offset}
+	if limit > 0 {
+		query = "SELECT name FROM auth WHERE substr(name, 1, $1) = $2 ORDER BY name LIMIT $4 OFFSET $3;"
+		args = []any{utf8.RuneCountInString(prefix), prefix, offset, limit}
+	}
+
+	result, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	names := []string{}
+	for result.Next() {
+		var name string
+		if err := result.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// FoldedNames returns the names of all users whose names are equal
+// to name when compared case-insensitively.
+func (a *AuthMTPostgreSQL) FoldedNames(name string) ([]string, error) {
+	result, err := a.db.Query("SELECT name FROM auth WHERE lower(name) = lower($1);", name)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var names []string
+	for result.Next() {
+		var existing string
+		if err := result.Scan(&existing); err != nil {
+			return nil, err
+		}
+
+		names = append(names, existing)
+	}
+
+	return names, result.Err()
+}
+
+// Count returns the number of users that start with prefix.
+func (a *AuthMTPostgreSQL) Count(prefix string) (int, error) {
+	result := a.db.QueryRow("SELECT COUNT(1) FROM auth WHERE substr(name, 1, $1) = $2;", utf8.RuneCountInString(prefix), prefix)
+
+	var count int
+	if err := result.Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Ban adds a permanent ban entry for a network address
+// and an associated name.
 func (a *AuthMTPostgreSQL) Ban(addr, name string) error {
+	return a.AddBan(Ban{
+		Addr:    addr,
+		Name:    name,
+		Created: time.Now(),
+	})
+}
+
+// AddBan adds a ban entry including its details.
+func (a *AuthMTPostgreSQL) AddBan(b Ban) error {
 	bans, err := a.readBans()
 	if err != nil {
 		return err
 	}
 
-	bans[addr] = name
-	return a.writeBans(bans)
+	if plainBanAddr(b.Addr) {
+		bans[b.Addr] = b.Name
+		if err := a.writeBans(bans); err != nil {
+			return err
+		}
+	}
+
+	_, err = a.db.Exec("INSERT INTO ban_info (addr, reason, issuer, created, expiry) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (addr) DO UPDATE SET reason = EXCLUDED.reason, issuer = EXCLUDED.issuer, created = EXCLUDED.created, expiry = EXCLUDED.expiry;", b.Addr, b.Reason, b.Issuer, unixOrZero(b.Created), unixOrZero(b.Expiry))
+	return err
 }
 
-// Unban deletes a ban entry. It accepts bot network addresses
+// Unban deletes a ban entry. It accepts both network addresses
 // and player names.
 func (a *AuthMTPostgreSQL) Unban(id string) error {
 	bans, err := a.readBans()
@@ -242,9 +543,7 @@ func (a *AuthMTPostgreSQL) Unban(id string) error {
 		return err
 	}
 
-	delete(bans, id)
-
-	var flagged []string
+	flagged := []string{id}
 	for addr, name := range bans {
 		if name == id {
 			flagged = append(flagged, addr)
@@ -253,6 +552,10 @@ func (a *AuthMTPostgreSQL) Unban(id string) error {
 
 	for _, addr := range flagged {
 		delete(bans, addr)
+
+		if _, err := a.db.Exec("DELETE FROM ban_info WHERE addr = $1;", addr); err != nil {
+			return err
+		}
 	}
 
 	return a.writeBans(bans)
@@ -261,24 +564,111 @@ func (a *AuthMTPostgreSQL) Unban(id string) error {
 // Banned reports whether a network address is banned.
 // Error cases count as banned.
 func (a *AuthMTPostgreSQL) Banned(addr, name string) bool {
+	_, banned, err := a.BanEntry(addr, name)
+	return banned || err != nil
+}
+
+// BanEntry returns the ban entry of a network address.
+// Expired entries are deleted.
+func (a *AuthMTPostgreSQL) BanEntry(addr, name string) (Ban, bool, error) {
 	bans, err := a.readBans()
 	if err != nil {
-		return true
+		return Ban{}, false, err
+	}
+
+	banName, ok := bans[addr]
+	if !ok {
+		return Ban{}, false, nil
+	}
+
+	b, err := a.banInfo(addr, banName)
+	if err != nil {
+		return Ban{}, false, err
 	}
 
-	_, ok := bans[addr]
-	return ok
+	if b.Expired() {
+		return Ban{}, false, a.Unban(addr)
+	}
+
+	return b, true, nil
 }
 
-// RecordFail is a no-op.
+// RecordFail records an authentication failure
+// and locks the network address or user out if necessary.
 func (a *AuthMTPostgreSQL) RecordFail(addr, name string, sudo bool) error {
-	return nil
+	return recordFail(a, addr, name, sudo)
+}
+
+// FailRecord returns the authentication failures
+// of a network address or user.
+func (a *AuthMTPostgreSQL) FailRecord(kind, id string) (FailRecord, error) {
+	result := a.db.QueryRow("SELECT fails, last_fail, locked_until FROM auth_fails WHERE kind = $1 AND id = $2;", kind, id)
+
+	r := FailRecord{Kind: kind, ID: id}
+
+	var last, until int64
+	if err := result.Scan(&r.Fails, &last, &until); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return r, nil
+		}
+
+		return FailRecord{}, err
+	}
+
+	r.Last = time.Unix(last, 0)
+	r.Until = time.Unix(until, 0)
+
+	return r, nil
+}
+
+// SetFailRecord stores the authentication failures
+// of a network address or user.
+func (a *AuthMTPostgreSQL) SetFailRecord(r FailRecord) error {
+	_, err := a.db.Exec("INSERT INTO auth_fails (kind, id, fails, last_fail, locked_until) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (kind, id) DO UPDATE SET fails = EXCLUDED.fails, last_fail = EXCLUDED.last_fail, locked_until = EXCLUDED.locked_until;", r.Kind, r.ID, r.Fails, r.Last.Unix(), r.Until.Unix())
+	return err
+}
+
+// DeleteFailRecord deletes the authentication failures
+// of a network address or user.
+func (a *AuthMTPostgreSQL) DeleteFailRecord(kind, id string) error {
+	_, err := a.db.Exec("DELETE FROM auth_fails WHERE kind = $1 AND id = $2;", kind, id)
+	return err
+}
+
+// FailRecords returns the authentication failures
+// of all network addresses and users or an error.
+func (a *AuthMTPostgreSQL) FailRecords() ([]FailRecord, error) {
+	result, err := a.db.Query("SELECT kind, id, fails, last_fail, locked_until FROM auth_fails;")
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var out []FailRecord
+	for result.Next() {
+		var r FailRecord
+		var last, until int64
+		if err := result.Scan(&r.Kind, &r.ID, &r.Fails, &last, &until); err != nil {
+			return nil, err
+		}
+
+		r.Last = time.Unix(last, 0)
+		r.Until = time.Unix(until, 0)
+
+		out = append(out, r)
+	}
+
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
 }
 
 // ImportBans adds the passed entries.
 func (a *AuthMTPostgreSQL) ImportBans(in []Ban) error {
 	for _, b := range in {
-		if err := a.Ban(b.Addr, b.Name); err != nil {
+		if err := a.AddBan(b); err != nil {
 			return err
 		}
 	}
@@ -287,22 +677,103 @@ func (a *AuthMTPostgreSQL) ImportBans(in []Ban) error {
 }
 
 // ExportBans returns data that can be processed by ImportBans
-// or an error.
+// or an error. Expired entries are omitted.
 func (a *AuthMTPostgreSQL) ExportBans() ([]Ban, error) {
+	bans, err := a.Bans()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Ban
+	for _, b := range bans {
+		if !b.Expired() {
+			out = append(out, b)
+		}
+	}
+
+	return out, nil
+}
+
+// Bans returns all ban entries including expired ones.
+// The details of all entries are read using a single query.
+// Entries without details (e.g. created by Minetest) are permanent.
+func (a *AuthMTPostgreSQL) Bans() ([]Ban, error) {
 	bans, err := a.readBans()
 	if err != nil {
 		return nil, err
 	}
 
-	var unmapped []Ban
+	rows, err := a.db.Query("SELECT addr, reason, issuer, created, expiry FROM ban_info;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	infos := make(map[string]Ban)
+	for rows.Next() {
+		var b Ban
+		var created, expiry int64
+		if err := rows.Scan(&b.Addr, &b.Reason, &b.Issuer, &created, &expiry); err != nil {
+			return nil, err
+		}
+
+		b.Created = timeOrZero(created)
+		b.Expiry = timeOrZero(expiry)
+
+		infos[b.Addr] = b
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]Ban, 0, len(bans))
 	for addr, name := range bans {
-		unmapped = append(unmapped, Ban{
-			Addr: addr,
-			Name: name,
-		})
+		if !plainBanAddr(addr) {
+			continue
+		}
+
+		b, ok := infos[addr]
+		if !ok {
+			b = Ban{Addr: addr}
+		}
+
+		b.Name = name
+		out = append(out, b)
+	}
+
+	for addr, b := range infos {
+		if !plainBanAddr(addr) {
+			out = append(out, b)
+		}
+	}
+
+	return out, nil
+}
+
+// banInfo returns a ban entry including its details.
+// Entries without details (e.g. created by Minetest) are permanent.
+func (a *AuthMTPostgreSQL) banInfo(addr, name string) (Ban, error) {
+	b := Ban{
+		Addr: addr,
+		Name: name,
+	}
+
+	result := a.db.QueryRow("SELECT reason, issuer, created, expiry FROM ban_info WHERE addr = $1;", addr)
+
+	var created, expiry int64
+	if err := result.Scan(&b.Reason, &b.Issuer, &created, &expiry); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return b, nil
+		}
+
+		return Ban{}, err
 	}
 
-	return unmapped, nil
+	b.Created = timeOrZero(created)
+	b.Expiry = timeOrZero(expiry)
+
+	return b, nil
 }
 
 func (a *AuthMTPostgreSQL) setTimestamp(name string, t time.Time) {
@@ -327,8 +798,15 @@ func (a *AuthMTPostgreSQL) readBans() (map[string]string, error) {
 	for scanner.Scan() {
 		ban := scanner.Text()
 
-		addr := strings.Split(ban, "|")[0]
-		name := strings.Split(ban, "|")[1]
+		// Names can't contain pipes but regular expression bans
+		// written by older versions can.
+		i := strings.LastIndex(ban, "|")
+		if i == -1 {
+			continue
+		}
+
+		addr := ban[:i]
+		name := ban[i+1:]
 
 		bans[addr] = name
 	}
@@ -348,6 +826,11 @@ func (a *AuthMTPostgreSQL) writeBans(bans map[string]string) error {
 	defer f.Close()
 
 	for addr, name := range bans {
+		// Older versions also stored range and pattern bans here.
+		if !plainBanAddr(addr) {
+			continue
+		}
+
 		if _, err := fmt.Fprintln(f, addr+"|"+name); err != nil {
 			return err
 		}
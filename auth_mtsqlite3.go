@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -38,6 +39,43 @@ func NewAuthMTSQLite3() (*AuthMTSQLite3, error) {
 		return nil, err
 	}
 
+	// The last server of a user is stored in a separate table
+	// to keep the upstream schema intact.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS last_server (name VARCHAR(32) PRIMARY KEY, server TEXT);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Ban details are stored in the database because ipban.txt
+	// can't hold them without breaking compatibility.
+	// Range and pattern bans are only stored in this table
+	// because Minetest can't parse them.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS ban_info (addr VARCHAR(64) PRIMARY KEY, reason TEXT, issuer VARCHAR(32), created INTEGER, expiry INTEGER);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Authentication failures are stored in a separate table
+	// to keep the upstream schema intact.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS auth_fails (kind VARCHAR(8), id VARCHAR(64), fails INTEGER, last_fail INTEGER, locked_until INTEGER, PRIMARY KEY (kind, id));"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// TOTP secrets are stored in a separate table
+	// to keep the upstream schema intact.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS totp (name VARCHAR(32) PRIMARY KEY, secret BLOB);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Pending password resets are stored in a separate table
+	// to keep the upstream schema intact.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS passwd_reset (name VARCHAR(32) PRIMARY KEY, code BLOB, issuer VARCHAR(32), created INTEGER, expiry INTEGER);"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &AuthMTSQLite3{db}, nil
 }
 
@@ -83,16 +121,94 @@ func (a *AuthMTSQLite3) SetPasswd(name string, salt, verifier []byte) error {
 	return err
 }
 
-// LastSrv always returns an error
-// since the Minetest database schema cannot store this information.
-func (a *AuthMTSQLite3) LastSrv(_ string) (string, error) {
-	return "", ErrLastSrvNotSupported
+// LastSrv returns the last server a user was on.
+func (a *AuthMTSQLite3) LastSrv(name string) (string, error) {
+	result := a.db.QueryRow("SELECT server FROM last_server WHERE name = ?;", name)
+
+	var srv string
+	if err := result.Scan(&srv); err != nil {
+		return "", err
+	}
+
+	return srv, nil
 }
 
-// SetLastSrv is a no-op
-// since the Minetest database schema cannot store this information.
-func (a *AuthMTSQLite3) SetLastSrv(_, _ string) error {
-	return nil
+// SetLastSrv sets the last server a user was on.
+func (a *AuthMTSQLite3) SetLastSrv(name, srv string) error {
+	_, err := a.db.Exec("REPLACE INTO last_server (name, server) VALUES (?, ?);", name, srv)
+	return err
+}
+
+// TOTPSecret returns the TOTP secret of a user
+// or nil if they haven't enrolled.
+func (a *AuthMTSQLite3) TOTPSecret(name string) ([]byte, error) {
+	result := a.db.QueryRow("SELECT secret FROM totp WHERE name = ?;", name)
+
+	var secret []byte
+	if err := result.Scan(&secret); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// SetTOTPSecret sets the TOTP secret of an existing user.
+func (a *AuthMTSQLite3) SetTOTPSecret(name string, secret []byte) error {
+	if !a.Exists(name) {
+		return ErrNoSuchUser
+	}
+
+	_, err := a.db.Exec("REPLACE INTO totp (name, secret) VALUES (?, ?);", name, secret)
+	return err
+}
+
+// DeleteTOTPSecret deletes the TOTP secret of a user.
+func (a *AuthMTSQLite3) DeleteTOTPSecret(name string) error {
+	_, err := a.db.Exec("DELETE FROM totp WHERE name = ?;", name)
+	return err
+}
+
+// PasswdReset returns the pending password reset of a user
+// and whether it exists.
+func (a *AuthMTSQLite3) PasswdReset(name string) (PasswdReset, bool, error) {
+	result := a.db.QueryRow("SELECT code, issuer, created, expiry FROM passwd_reset WHERE name = ?;", name)
+
+	r := PasswdReset{Name: name}
+
+	var created, expiry int64
+	if err := result.Scan(&r.Code, &r.Issuer, &created, &expiry); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PasswdReset{}, false, nil
+		}
+
+		return PasswdReset{}, false, err
+	}
+
+	r.Created = timeOrZero(created)
+	r.Expiry = timeOrZero(expiry)
+
+	return r, true, nil
+}
+
+// SetPasswdReset adds or replaces the password reset
+// of an existing user.
+func (a *AuthMTSQLite3) SetPasswdReset(r PasswdReset) error {
+	if !a.Exists(r.Name) {
+		return ErrNoSuchUser
+	}
+
+	_, err := a.db.Exec("REPLACE INTO passwd_reset (name, code, issuer, created, expiry) VALUES (?, ?, ?, ?, ?);", r.Name, r.Code, r.Issuer, unixOrZero(r.Created), unixOrZero(r.Expiry))
+	return err
+}
+
+// DeletePasswdReset deletes the pending password reset of a user.
+func (a *AuthMTSQLite3) DeletePasswdReset(name string) error {
+	_, err := a.db.Exec("DELETE FROM passwd_reset WHERE name = ?;", name)
+	return err
 }
 
 // Timestamp returns the last time an authentication entry was accessed
@@ -116,6 +232,18 @@ func (a *AuthMTSQLite3) Import(in []User) error {
 		}
 
 		a.setTimestamp(u.Name, u.Timestamp)
+
+		if u.LastSrv != "" {
+			if err := a.SetLastSrv(u.Name, u.LastSrv); err != nil {
+				return err
+			}
+		}
+
+		if u.TOTPSecret != nil {
+			if err := a.SetTOTPSecret(u.Name, u.TOTPSecret); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -163,24 +291,195 @@ func (a *AuthMTSQLite3) Export() ([]User, error) {
 			return nil, err
 		}
 
+		// The last server is optional.
+		u.LastSrv, _ = a.LastSrv(u.Name)
+
+		u.TOTPSecret, err = a.TOTPSecret(u.Name)
+		if err != nil {
+			return nil, err
+		}
+
 		out = append(out, u)
 	}
 
 	return out, nil
 }
 
-// Ban adds a ban entry for a network address and an associated name.
+// Delete deletes a user, their last server, their TOTP secret,
+// their pending password reset and their authentication failures.
+func (a *AuthMTSQLite3) Delete(name string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM auth WHERE name = ?;", name)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNoSuchUser
+	}
+
+	if _, err := tx.Exec("DELETE FROM last_server WHERE name = ?;", name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM totp WHERE name = ?;", name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM passwd_reset WHERE name = ?;", name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM auth_fails WHERE id = ? AND kind IN ('name', 'sudo', 'totp', 'reset');", name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Rename changes the name of a user.
+func (a *AuthMTSQLite3) Rename(name, newName string) error {
+	if a.Exists(newName) {
+		return ErrUserExists
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE auth SET name = ? WHERE name = ?;", newName, name)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNoSuchUser
+	}
+
+	if _, err := tx.Exec("UPDATE last_server SET name = ? WHERE name = ?;", newName, name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE totp SET name = ? WHERE name = ?;", newName, name); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE passwd_reset SET name = ? WHERE name = ?;", newName, name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// List returns the names of the users that start with prefix
+// in ascending order.
+func (a *AuthMTSQLite3) List(prefix string, offset, limit int) ([]string, error) {
+	if offset < 0 {
+		offset = 0
+	}
+
+	// A negative limit means no limit to SQLite.
+	if limit <= 0 {
+		limit = -1
+	}
+
+	result, err := a.db.Query("SELECT name FROM auth WHERE substr(name, 1, ?) = ? ORDER BY name LIMIT ? OFFSET ?;", utf8.RuneCountInString(prefix), prefix, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	names := []string{}
+	for result.Next() {
+		var name string
+		if err := result.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// FoldedNames returns the names of all users whose names are equal
+// to name when compared case-insensitively.
+func (a *AuthMTSQLite3) FoldedNames(name string) ([]string, error) {
+	result, err := a.db.Query("SELECT name FROM auth WHERE lower(name) = lower(?);", name)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var names []string
+	for result.Next() {
+		var existing string
+		if err := result.Scan(&existing); err != nil {
+			return nil, err
+		}
+
+		names = append(names, existing)
+	}
+
+	return names, result.Err()
+}
+
+// Count returns the number of users that start with prefix.
+func (a *AuthMTSQLite3) Count(prefix string) (int, error) {
+	result := a.db.QueryRow("SELECT COUNT(1) FROM auth WHERE substr(name, 1, ?) = ?;", utf8.RuneCountInString(prefix), prefix)
+
+	var count int
+	if err := result.Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Ban adds a permanent ban entry for a network address
+// and an associated name.
 func (a *AuthMTSQLite3) Ban(addr, name string) error {
+	return a.AddBan(Ban{
+		Addr:    addr,
+		Name:    name,
+		Created: time.Now(),
+	})
+}
+
+// AddBan adds a ban entry including its details.
+func (a *AuthMTSQLite3) AddBan(b Ban) error {
 	bans, err := a.readBans()
 	if err != nil {
 		return err
 	}
 
-	bans[addr] = name
-	return a.writeBans(bans)
+	if plainBanAddr(b.Addr) {
+		bans[b.Addr] = b.Name
+		if err := a.writeBans(bans); err != nil {
+			return err
+		}
+	}
+
+	_, err = a.db.Exec("REPLACE INTO ban_info (addr, reason, issuer, created, expiry) VALUES (?, ?, ?, ?, ?);", b.Addr, b.Reason, b.Issuer, unixOrZero(b.Created), unixOrZero(b.Expiry))
+	return err
 }
 
-// Unban deletes a ban entry. It accepts bot network addresses
+// Unban deletes a ban entry. It accepts both network addresses
 // and player names.
 func (a *AuthMTSQLite3) Unban(id string) error {
 	bans, err := a.readBans()
@@ -188,9 +487,7 @@ func (a *AuthMTSQLite3) Unban(id string) error {
 		return err
 	}
 
-	delete(bans, id)
-
-	var flagged []string
+	flagged := []string{id}
 	for addr, name := range bans {
 		if name == id {
 			flagged = append(flagged, addr)
@@ -199,6 +496,10 @@ func (a *AuthMTSQLite3) Unban(id string) error {
 
 	for _, addr := range flagged {
 		delete(bans, addr)
+
+		if _, err := a.db.Exec("DELETE FROM ban_info WHERE addr = ?;", addr); err != nil {
+			return err
+		}
 	}
 
 	return a.writeBans(bans)
@@ -207,24 +508,111 @@ func (a *AuthMTSQLite3) Unban(id string) error {
 // Banned reports whether a network address is banned.
 // Error cases count as banned.
 func (a *AuthMTSQLite3) Banned(addr, name string) bool {
+	_, banned, err := a.BanEntry(addr, name)
+	return banned || err != nil
+}
+
+// BanEntry returns the ban entry of a network address.
+// Expired entries are deleted.
+func (a *AuthMTSQLite3) BanEntry(addr, name string) (Ban, bool, error) {
 	bans, err := a.readBans()
 	if err != nil {
-		return true
+		return Ban{}, false, err
+	}
+
+	banName, ok := bans[addr]
+	if !ok {
+		return Ban{}, false, nil
+	}
+
+	b, err := a.banInfo(addr, banName)
+	if err != nil {
+		return Ban{}, false, err
 	}
 
-	_, ok := bans[addr]
-	return ok
+	if b.Expired() {
+		return Ban{}, false, a.Unban(addr)
+	}
+
+	return b, true, nil
 }
 
-// RecordFail is a no-op.
+// RecordFail records an authentication failure
+// and locks the network address or user out if necessary.
 func (a *AuthMTSQLite3) RecordFail(addr, name string, sudo bool) error {
-	return nil
+	return recordFail(a, addr, name, sudo)
+}
+
+// FailRecord returns the authentication failures
+// of a network address or user.
+func (a *AuthMTSQLite3) FailRecord(kind, id string) (FailRecord, error) {
+	result := a.db.QueryRow("SELECT fails, last_fail, locked_until FROM auth_fails WHERE kind = ? AND id = ?;", kind, id)
+
+	r := FailRecord{Kind: kind, ID: id}
+
+	var last, until int64
+	if err := result.Scan(&r.Fails, &last, &until); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return r, nil
+		}
+
+		return FailRecord{}, err
+	}
+
+	r.Last = time.Unix(last, 0)
+	r.Until = time.Unix(until, 0)
+
+	return r, nil
+}
+
+// SetFailRecord stores the authentication failures
+// of a network address or user.
+func (a *AuthMTSQLite3) SetFailRecord(r FailRecord) error {
+	_, err := a.db.Exec("REPLACE INTO auth_fails (kind, id, fails, last_fail, locked_until) VALUES (?, ?, ?, ?, ?);", r.Kind, r.ID, r.Fails, r.Last.Unix(), r.Until.Unix())
+	return err
+}
+
+// DeleteFailRecord deletes the authentication failures
+// of a network address or user.
+func (a *AuthMTSQLite3) DeleteFailRecord(kind, id string) error {
+	_, err := a.db.Exec("DELETE FROM auth_fails WHERE kind = ? AND id = ?;", kind, id)
+	return err
+}
+
+// FailRecords returns the authentication failures
+// of all network addresses and users or an error.
+func (a *AuthMTSQLite3) FailRecords() ([]FailRecord, error) {
+	result, err := a.db.Query("SELECT kind, id, fails, last_fail, locked_until FROM auth_fails;")
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var out []FailRecord
+	for result.Next() {
+		var r FailRecord
+		var last, until int64
+		if err := result.Scan(&r.Kind, &r.ID, &r.Fails, &last, &until); err != nil {
+			return nil, err
+		}
+
+		r.Last = time.Unix(last, 0)
+		r.Until = time.Unix(until, 0)
+
+		out = append(out, r)
+	}
+
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
 }
 
 // ImportBans adds the passed entries.
 func (a *AuthMTSQLite3) ImportBans(in []Ban) error {
 	for _, b := range in {
-		if err := a.Ban(b.Addr, b.Name); err != nil {
+		if err := a.AddBan(b); err != nil {
 			return err
 		}
 	}
@@ -233,22 +621,103 @@ func (a *AuthMTSQLite3) ImportBans(in []Ban) error {
 }
 
 // ExportBans returns data that can be processed by ImportBans
-// or an error.
+// or an error. Expired entries are omitted.
 func (a *AuthMTSQLite3) ExportBans() ([]Ban, error) {
+	bans, err := a.Bans()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Ban
+	for _, b := range bans {
+		if !b.Expired() {
+			out = append(out, b)
+		}
+	}
+
+	return out, nil
+}
+
+// Bans returns all ban entries including expired ones.
+// The details of all entries are read using a single query.
+// Entries without details (e.g. created by Minetest) are permanent.
+func (a *AuthMTSQLite3) Bans() ([]Ban, error) {
 	bans, err := a.readBans()
 	if err != nil {
 		return nil, err
 	}
 
-	var unmapped []Ban
+	rows, err := a.db.Query("SELECT addr, reason, issuer, created, expiry FROM ban_info;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	infos := make(map[string]Ban)
+	for rows.Next() {
+		var b Ban
+		var created, expiry int64
+		if err := rows.Scan(&b.Addr, &b.Reason, &b.Issuer, &created, &expiry); err != nil {
+			return nil, err
+		}
+
+		b.Created = timeOrZero(created)
+		b.Expiry = timeOrZero(expiry)
+
+		infos[b.Addr] = b
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]Ban, 0, len(bans))
 	for addr, name := range bans {
-		unmapped = append(unmapped, Ban{
-			Addr: addr,
-			Name: name,
-		})
+		if !plainBanAddr(addr) {
+			continue
+		}
+
+		b, ok := infos[addr]
+		if !ok {
+			b = Ban{Addr: addr}
+		}
+
+		b.Name = name
+		out = append(out, b)
+	}
+
+	for addr, b := range infos {
+		if !plainBanAddr(addr) {
+			out = append(out, b)
+		}
+	}
+
+	return out, nil
+}
+
+// banInfo returns a ban entry including its details.
+// Entries without details (e.g. created by Minetest) are permanent.
+func (a *AuthMTSQLite3) banInfo(addr, name string) (Ban, error) {
+	b := Ban{
+		Addr: addr,
+		Name: name,
+	}
+
+	result := a.db.QueryRow("SELECT reason, issuer, created, expiry FROM ban_info WHERE addr = ?;", addr)
+
+	var created, expiry int64
+	if err := result.Scan(&b.Reason, &b.Issuer, &created, &expiry); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return b, nil
+		}
+
+		return Ban{}, err
 	}
 
-	return unmapped, nil
+	b.Created = timeOrZero(created)
+	b.Expiry = timeOrZero(expiry)
+
+	return b, nil
 }
 
 func (a *AuthMTSQLite3) setTimestamp(name string, t time.Time) {
@@ -273,8 +742,15 @@ func (a *AuthMTSQLite3) readBans() (map[string]string, error) {
 	for scanner.Scan() {
 		ban := scanner.Text()
 
-		addr := strings.Split(ban, "|")[0]
-		name := strings.Split(ban, "|")[1]
+		// Names can't contain pipes but regular expression bans
+		// written by older versions can.
+		i := strings.LastIndex(ban, "|")
+		if i == -1 {
+			continue
+		}
+
+		addr := ban[:i]
+		name := ban[i+1:]
 
 		bans[addr] = name
 	}
@@ -294,6 +770,11 @@ func (a *AuthMTSQLite3) writeBans(bans map[string]string) error {
 	defer f.Close()
 
 	for addr, name := range bans {
+		// Older versions also stored range and pattern bans here.
+		if !plainBanAddr(addr) {
+			continue
+		}
+
 		if _, err := fmt.Fprintln(f, addr+"|"+name); err != nil {
 			return err
 		}
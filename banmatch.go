@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ban entries whose Addr starts with one of these prefixes
+// ban player names matching a pattern instead of a network address.
+// Glob patterns support `*` and `?` and are case-insensitive.
+// Regular expressions use the syntax of the regexp package
+// and match anywhere in the name unless anchored.
+const (
+	BanGlobPrefix  = "name:"
+	BanRegexPrefix = "regex:"
+)
+
+// banMatcherTTL is the maximum age of the cached range
+// and pattern bans. Changes made through the proxy
+// take effect immediately.
+const banMatcherTTL = 30 * time.Second
+
+var ErrInvalidBanTarget = errors.New("invalid ban target")
+
+var (
+	banMatcherCache *banMatcher
+	banMatcherMu    sync.Mutex
+)
+
+// A banMatcher matches network addresses against CIDR range bans
+// and names against pattern bans. Exact address bans
+// are handled by the AuthBackend.
+type banMatcher struct {
+	built time.Time
+
+	// nets maps prefix lengths to masked networks.
+	// IPv4 and IPv6 ranges are kept apart by the key length.
+	nets map[int]map[string]Ban
+
+	globs    *regexp.Regexp
+	globBans []Ban
+
+	regexes   []*regexp.Regexp
+	regexBans []Ban
+}
+
+// ValidateBanTarget reports whether a ban target is a valid
+// network address, CIDR range, glob pattern or regular expression.
+func ValidateBanTarget(target string) error {
+	switch {
+	case strings.HasPrefix(target, BanGlobPrefix):
+		if target == BanGlobPrefix {
+			return ErrInvalidBanTarget
+		}
+
+		return nil
+	case strings.HasPrefix(target, BanRegexPrefix):
+		_, err := regexp.Compile(strings.TrimPrefix(target, BanRegexPrefix))
+		return err
+	case strings.Contains(target, "/"):
+		_, _, err := net.ParseCIDR(target)
+		return err
+	case net.ParseIP(target) != nil:
+		return nil
+	}
+
+	return ErrInvalidBanTarget
+}
+
+// plainBanAddr reports whether a ban entry bans
+// a single network address rather than a range or pattern.
+func plainBanAddr(addr string) bool {
+	return net.ParseIP(addr) != nil
+}
+
+// BanTarget adds a ban entry for a network address, CIDR range
+// or name pattern (see BanGlobPrefix and BanRegexPrefix)
+// and kicks all matching clients. A duration of zero
+// makes the ban permanent.
+// The AuthBackend must implement BanInfoBackend to store the details,
+// otherwise they are discarded and the ban is permanent.
+func BanTarget(target string, d time.Duration, reason, issuer string) error {
+	if err := ValidateBanTarget(target); err != nil {
+		return err
+	}
+
+	if _, ipNet, err := net.ParseCIDR(target); err == nil {
+		target = ipNet.String()
+	}
+
+	b := Ban{
+		Addr:    target,
+		Reason:  reason,
+		Issuer:  issuer,
+		Created: time.Now(),
+	}
+
+	if d > 0 {
+		b.Expiry = b.Created.Add(d)
+	}
+
+	var err error
+	if bib, ok := DefaultAuth().(BanInfoBackend); ok {
+		err = bib.AddBan(b)
+	} else {
+		err = DefaultAuth().Ban(b.Addr, b.Name)
+	}
+
+	invalidateBanMatcher()
+	if err != nil {
+		return err
+	}
+
+	for cc := range Clts() {
+		ip := cc.RemoteAddr().(*net.UDPAddr).IP.String()
+		if _, banned := banEntry(ip, cc.Name()); banned {
+			cc.Log("<-", "banned")
+			cc.Kick(b.Message())
+		}
+	}
+
+	return nil
+}
+
+// invalidateBanMatcher makes the next call to currentBanMatcher
+// rebuild the banMatcher. The current one is kept
+// in case rebuilding it fails.
+func invalidateBanMatcher() {
+	banMatcherMu.Lock()
+	defer banMatcherMu.Unlock()
+
+	if banMatcherCache != nil {
+		banMatcherCache.built = time.Time{}
+	}
+}
+
+// currentBanMatcher returns the cached banMatcher,
+// rebuilding it if it is too old. If rebuilding fails,
+// the last banMatcher that was built successfully is returned
+// and the error is logged. An error is only returned
+// if no banMatcher has been built yet.
+func currentBanMatcher() (*banMatcher, error) {
+	banMatcherMu.Lock()
+	defer banMatcherMu.Unlock()
+
+	if banMatcherCache != nil && time.Since(banMatcherCache.built) < banMatcherTTL {
+		return banMatcherCache, nil
+	}
+
+	var bans []Ban
+	var err error
+	if bl, ok := DefaultAuth().(BanLister); ok {
+		bans, err = bl.Bans()
+	} else {
+		bans, err = DefaultAuth().ExportBans()
+	}
+
+	if err != nil {
+		if banMatcherCache == nil {
+			return nil, err
+		}
+
+		log.Print("refresh ban matcher: ", err)
+
+		// Don't retry on every connection attempt.
+		banMatcherCache.built = time.Now()
+		return banMatcherCache, nil
+	}
+
+	banMatcherCache = newBanMatcher(bans)
+	return banMatcherCache, nil
+}
+
+func newBanMatcher(bans []Ban) *banMatcher {
+	m := &banMatcher{
+		built: time.Now(),
+		nets:  make(map[int]map[string]Ban),
+	}
+
+	var globs []string
+	for _, b := range bans {
+		switch {
+		case strings.HasPrefix(b.Addr, BanGlobPrefix):
+			globs = append(globs, "("+globToRegexp(strings.TrimPrefix(b.Addr, BanGlobPrefix))+")")
+			m.globBans = append(m.globBans, b)
+		case strings.HasPrefix(b.Addr, BanRegexPrefix):
+			re, err := regexp.Compile(strings.TrimPrefix(b.Addr, BanRegexPrefix))
+			if err != nil {
+				continue
+			}
+
+			m.regexes = append(m.regexes, re)
+			m.regexBans = append(m.regexBans, b)
+		case strings.Contains(b.Addr, "/"):
+			_, ipNet, err := net.ParseCIDR(b.Addr)
+			if err != nil {
+				continue
+			}
+
+			ones, bits := ipNet.Mask.Size()
+			key := ones + bits<<8
+			if m.nets[key] == nil {
+				m.nets[key] = make(map[string]Ban)
+			}
+
+			m.nets[key][ipNet.IP.String()] = b
+		}
+	}
+
+	if len(globs) > 0 {
+		m.globs = regexp.MustCompile("(?i)^(?:" + strings.Join(globs, "|") + ")$")
+	}
+
+	return m
+}
+
+// match returns the range or pattern ban matching
+// a network address or name.
+func (m *banMatcher) match(addr, name string) (Ban, bool) {
+	if ip := net.ParseIP(addr); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		bits := len(ip) * 8
+		for key, nets := range m.nets {
+			ones := key & 0xff
+			if key>>8 != bits {
+				continue
+			}
+
+			masked := ip.Mask(net.CIDRMask(ones, bits))
+			if b, ok := nets[masked.String()]; ok && !b.Expired() {
+				return b, true
+			}
+		}
+	}
+
+	if m.globs != nil {
+		if groups := m.globs.FindStringSubmatchIndex(name); groups != nil {
+			for i := range m.globBans {
+				if groups[2*(i+1)] >= 0 && !m.globBans[i].Expired() {
+					return m.globBans[i], true
+				}
+			}
+		}
+	}
+
+	for i, re := range m.regexes {
+		if re.MatchString(name) && !m.regexBans[i].Expired() {
+			return m.regexBans[i], true
+		}
+	}
+
+	return Ban{}, false
+}
+
+// globToRegexp converts a glob pattern to a regular expression.
+func globToRegexp(glob string) string {
+	b := &strings.Builder{}
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanMatcher(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+
+	m := newBanMatcher([]Ban{
+		{Addr: "192.0.2.1"},
+		{Addr: "198.51.100.0/24"},
+		{Addr: "10.0.0.0/8", Expiry: past},
+		{Addr: "2001:db8::/32"},
+		{Addr: BanGlobPrefix + "griefer*"},
+		{Addr: BanGlobPrefix + "bot?"},
+		{Addr: BanGlobPrefix + "old*", Expiry: past},
+		{Addr: BanRegexPrefix + "^x+$"},
+		{Addr: BanRegexPrefix + "spam|scam"},
+	})
+
+	tests := []struct {
+		addr, name string
+		want       string
+	}{
+		{"192.0.2.1", "alice", ""},
+		{"198.51.100.7", "alice", "198.51.100.0/24"},
+		{"198.51.101.7", "alice", ""},
+		{"10.1.2.3", "alice", ""},
+		{"2001:db8:1::1", "alice", "2001:db8::/32"},
+		{"2001:db9::1", "alice", ""},
+		{"::ffff:198.51.100.7", "alice", "198.51.100.0/24"},
+		{"203.0.113.1", "Griefer42", BanGlobPrefix + "griefer*"},
+		{"203.0.113.1", "agriefer", ""},
+		{"203.0.113.1", "bot1", BanGlobPrefix + "bot?"},
+		{"203.0.113.1", "bot12", ""},
+		{"203.0.113.1", "oldname", ""},
+		{"203.0.113.1", "xxx", BanRegexPrefix + "^x+$"},
+		{"203.0.113.1", "xxy", ""},
+		{"203.0.113.1", "scammer", BanRegexPrefix + "spam|scam"},
+		{"203.0.113.1", "Spammer", ""},
+	}
+
+	for _, test := range tests {
+		b, ok := m.match(test.addr, test.name)
+		if ok != (test.want != "") || b.Addr != test.want {
+			t.Errorf("match(%q, %q) = %q, %v, want %q", test.addr, test.name, b.Addr, ok, test.want)
+		}
+	}
+}
+
+func TestValidateBanTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		valid  bool
+	}{
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+		{"192.0.2.0/24", true},
+		{"192.0.2.0/33", false},
+		{BanGlobPrefix + "a*", true},
+		{BanGlobPrefix, false},
+		{BanRegexPrefix + "a|b", true},
+		{BanRegexPrefix + "(", false},
+		{"alice", false},
+	}
+
+	for _, test := range tests {
+		if err := ValidateBanTarget(test.target); (err == nil) != test.valid {
+			t.Errorf("ValidateBanTarget(%q) = %v, want valid = %v", test.target, err, test.valid)
+		}
+	}
+}
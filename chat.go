@@ -68,10 +68,11 @@ func onChatMsg(cc *ClientConn, cmd *mt.ToSrvChatMsg) (string, bool) {
 			return "Command not found.", true
 		}
 
+		// Handlers may change chat commands,
+		// e.g. by reloading scripts.
 		chatCmdsMu.RLock()
-		defer chatCmdsMu.RUnlock()
-
 		cmd := chatCmds[cmdName]
+		chatCmdsMu.RUnlock()
 
 		if !cc.HasPerms(cmd.Perm) {
 			cc.Log("<-", "deny command", cmdName)
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/HimbeerserverDE/mt"
@@ -32,6 +33,7 @@ type ClientConn struct {
 	cstateMu sync.RWMutex
 	name     string
 	initCh   chan struct{}
+	readyCh  chan struct{}
 	hopMu    sync.Mutex
 
 	auth struct {
@@ -40,6 +42,24 @@ type ClientConn struct {
 	}
 	new bool
 
+	limbo atomic.Bool
+
+	passwd struct {
+		reset          *PasswdReset
+		expired        bool
+		salt, verifier []byte
+		change         bool
+		step           chan struct{}
+		done           bool
+	}
+
+	totp struct {
+		mu       sync.Mutex
+		pending  []byte
+		step     chan struct{}
+		verified bool
+	}
+
 	fallbackFrom string
 	whyKicked    *mt.ToCltKick
 
@@ -51,6 +71,7 @@ type ClientConn struct {
 	formspecVer         uint16
 
 	denyPools map[string]struct{}
+	newPools  map[string]struct{}
 	itemDefs  []mt.ItemDef
 	aliases   []struct{ Alias, Orig string }
 	nodeDefs  []mt.NodeDef
@@ -58,6 +79,9 @@ type ClientConn struct {
 	p0SrvMap  param0SrvMap
 	media     []mediaFile
 
+	pushTokens    map[uint32]struct{}
+	nextPushToken uint32
+
 	playerCAO, currentCAO mt.AOID
 
 	playerListInit bool
@@ -128,7 +152,7 @@ func handleClt(cc *ClientConn) {
 		pkt, err := cc.Recv()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				if cc.state() == csActive {
+				if cc.state() == csActive && cc.loggedIn() {
 					handleLeave(cc)
 				}
 
@@ -92,5 +92,14 @@ func convert(dst, src proxy.AuthBackend) error {
 		return err
 	}
 
+	bans, err := src.ExportBans()
+	if err != nil {
+		return err
+	}
+
+	if err := dst.ImportBans(bans); err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"regexp"
 	"sync"
 	"time"
 )
@@ -15,9 +16,30 @@ const (
 	defaultSendInterval = 0.09
 	defaultUserLimit    = 10
 	defaultAuthBackend  = "files"
+	defaultPermBackend  = "files"
 	defaultTelnetAddr   = "[::1]:40010"
 	defaultBindAddr     = ":40000"
 	defaultListInterval = 300
+
+	defaultRateLimitInterval = 60
+	defaultIPv4Prefix        = 24
+	defaultIPv6Prefix        = 64
+	defaultHandshakeTimeout  = 120
+
+	defaultLockoutAddrFails   = 10
+	defaultLockoutNameFails   = 0
+	defaultLockoutSudoFails   = 3
+	defaultLockoutTOTPFails   = 5
+	defaultLockoutResetFails  = 5
+	defaultLockoutDuration    = 30
+	defaultLockoutMaxDuration = 86400
+	defaultLockoutReset       = 3600
+
+	defaultTOTPIssuer  = "mt-multiserver-proxy"
+	defaultTOTPTimeout = 120
+
+	defaultResetCodeExpiry = 86400
+	defaultPasswdTimeout   = 300
 )
 
 var config Config
@@ -31,30 +53,95 @@ type Server struct {
 	Groups    []string
 	Fallback  string
 
+	// Secret is used to derive the passwords the proxy
+	// uses to log into the server.
+	Secret             string
+	MigrateEmptyPasswd bool
+	ForwardAddr        bool
+	Privs              map[string][]string
+
 	dynamic   bool
 	poolAdded time.Time
 }
 
+// BindAddrs is a list of addresses the proxy listens on.
+// In the configuration file it can be a single string
+// or a list of strings.
+type BindAddrs []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (ba *BindAddrs) UnmarshalJSON(data []byte) error {
+	addrs, err := unmarshalStrings(data)
+	if err != nil {
+		return err
+	}
+
+	*ba = addrs
+	return nil
+}
+
+// GroupList is a list of permission groups.
+// In the configuration file it can be a single string
+// or a list of strings.
+//
+// Config.UserGroups used to be a map[string]string.
+// Plugins that read it need to range over the GroupList
+// of a player instead of using it as a single group name.
+type GroupList []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (gl *GroupList) UnmarshalJSON(data []byte) error {
+	groups, err := unmarshalStrings(data)
+	if err != nil {
+		return err
+	}
+
+	*gl = groups
+	return nil
+}
+
+// unmarshalStrings decodes a JSON string or list of strings.
+func unmarshalStrings(data []byte) ([]string, error) {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		return []string{s}, nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
 // A Config contains information from the configuration file
 // that affects the way the proxy works.
 type Config struct {
-	NoPlugins        bool
-	NoAutoPlugins    bool
-	CmdPrefix        string
-	RequirePasswd    bool
-	SendInterval     float32
-	UserLimit        int
-	AuthBackend      string
-	AuthPostgresConn string
-	NoTelnet         bool
-	TelnetAddr       string
-	BindAddr         string
-	DefaultSrv       string
-	SrvSelector      string
-	Servers          map[string]Server
-	ForceDefaultSrv  bool
-	KickOnNewPool    bool
-	CSMRF            struct {
+	NoPlugins          bool
+	NoAutoPlugins      bool
+	RPCPlugins         map[string][]string
+	CmdPrefix          string
+	RequirePasswd      bool
+	SendInterval       float32
+	UserLimit          int
+	AuthBackend        string
+	AuthPostgresConn   string
+	PermBackend        string
+	PermPostgresConn   string
+	NoTelnet           bool
+	TelnetAddr         string
+	BindAddr           BindAddrs
+	DefaultSrv         string
+	SrvSelector        string
+	Servers            map[string]Server
+	ForceDefaultSrv    bool
+	KickOnNewPool      bool
+	InjectNewPools     bool
+	RejoinOnNewPool    bool
+	ContentDiagnostics bool
+	ShareMedia         bool
+	CSMRF              struct {
 		NoCSMs          bool
 		ChatMsgs        bool
 		ItemDefs        bool
@@ -62,11 +149,12 @@ type Config struct {
 		NoLimitMapRange bool
 		PlayerList      bool
 	}
-	MapRange   uint32
-	DropCSMRF  bool
-	Groups     map[string][]string
-	UserGroups map[string]string
-	List       struct {
+	MapRange     uint32
+	DropCSMRF    bool
+	Groups       map[string][]string
+	GroupParents map[string][]string
+	UserGroups   map[string]GroupList
+	List         struct {
 		Enable   bool
 		Addr     string
 		Interval int
@@ -81,6 +169,47 @@ type Config struct {
 		FarNames bool
 		Mods     []string
 	}
+	RateLimit struct {
+		Interval         int
+		ConnsPerIP       int
+		ConnsPerSubnet   int
+		InitsPerIP       int
+		InitsPerSubnet   int
+		IPv4Prefix       int
+		IPv6Prefix       int
+		MaxPreAuthClts   int
+		HandshakeTimeout int
+	}
+	FoldNameCase bool
+	Registration struct {
+		Disable       bool
+		MaxPerAddr    int
+		Allow         []string
+		Block         []string
+		RejectSimilar bool
+
+		allow, block []*regexp.Regexp
+	}
+	Lockout struct {
+		AddrFails   int
+		NameFails   int
+		SudoFails   int
+		TOTPFails   int
+		ResetFails  int
+		Duration    int
+		MaxDuration int
+		Reset       int
+	}
+	TOTP struct {
+		Perm    string
+		Issuer  string
+		Timeout int
+	}
+	PasswdPolicy struct {
+		ResetCodeExpiry int
+		MaxAge          int
+		Timeout         int
+	}
 }
 
 // Conf returns a copy of the Config used by the proxy.
@@ -101,9 +230,11 @@ func Conf() Config {
 // AddServer dynamically configures a new Server at runtime.
 // Servers added in this way are ephemeral and will be lost
 // when the proxy shuts down.
-// The server must be part of a media pool with at least one
-// other member. At least one of the other members always
-// needs to be reachable.
+// If the server is part of an existing media pool at least one
+// of the other members always needs to be reachable.
+// Media pools that don't exist yet are unknown to connected clients.
+// See the InjectNewPools and RejoinOnNewPool config options
+// for how clients can access them.
 // WARNING: Reloading the config will not overwrite servers
 // added using this function. The server definition from the
 // configuration file will silently be ignored.
@@ -112,21 +243,21 @@ func AddServer(name string, s Server) bool {
 	defer configMu.Unlock()
 
 	s.dynamic = true
-	s.poolAdded = startTime
 
 	if _, ok := config.Servers[name]; ok {
 		return false
 	}
 
-	var poolMembers bool
-	for _, srv := range config.Servers {
-		if !srv.dynamic && srv.MediaPool == s.MediaPool {
-			poolMembers = true
-		}
+	if s.MediaPool == "" {
+		s.MediaPool = name
 	}
 
-	if !poolMembers {
-		return false
+	if poolServers, ok := config.Pools()[s.MediaPool]; ok {
+		for _, s2 := range poolServers {
+			s.poolAdded = s2.poolAdded
+		}
+	} else { // New media pool.
+		s.poolAdded = time.Now()
 	}
 
 	config.Servers[name] = s
@@ -166,7 +297,23 @@ func (cnf Config) clone() Config {
 	newConfig.Servers = copyMap(cnf.Servers)
 
 	newConfig.Groups = copyMapSlice(cnf.Groups)
-	newConfig.UserGroups = copyMap(cnf.UserGroups)
+	newConfig.GroupParents = copyMapSlice(cnf.GroupParents)
+	newConfig.RPCPlugins = copyMapSlice(cnf.RPCPlugins)
+
+	newConfig.UserGroups = make(map[string]GroupList)
+	for name, groups := range cnf.UserGroups {
+		newConfig.UserGroups[name] = make(GroupList, len(groups))
+		copy(newConfig.UserGroups[name], groups)
+	}
+
+	newConfig.BindAddr = make(BindAddrs, len(cnf.BindAddr))
+	copy(newConfig.BindAddr, cnf.BindAddr)
+
+	newConfig.Registration.Allow = make([]string, len(cnf.Registration.Allow))
+	copy(newConfig.Registration.Allow, cnf.Registration.Allow)
+
+	newConfig.Registration.Block = make([]string, len(cnf.Registration.Block))
+	copy(newConfig.Registration.Block, cnf.Registration.Block)
 
 	newConfig.List.Mods = make([]string, len(cnf.List.Mods))
 	copy(newConfig.List.Mods, cnf.List.Mods)
@@ -296,13 +443,32 @@ func LoadConfig() error {
 	config.SendInterval = defaultSendInterval
 	config.UserLimit = defaultUserLimit
 	config.AuthBackend = defaultAuthBackend
+	config.PermBackend = defaultPermBackend
 	config.TelnetAddr = defaultTelnetAddr
-	config.BindAddr = defaultBindAddr
+	config.BindAddr = BindAddrs{defaultBindAddr}
 	config.Servers = make(map[string]Server)
 	config.Groups = make(map[string][]string)
-	config.UserGroups = make(map[string]string)
+	config.GroupParents = make(map[string][]string)
+	config.RPCPlugins = make(map[string][]string)
+	config.UserGroups = make(map[string]GroupList)
 	config.List.Interval = defaultListInterval
 	config.List.Mods = make([]string, 0)
+	config.RateLimit.Interval = defaultRateLimitInterval
+	config.RateLimit.IPv4Prefix = defaultIPv4Prefix
+	config.RateLimit.IPv6Prefix = defaultIPv6Prefix
+	config.RateLimit.HandshakeTimeout = defaultHandshakeTimeout
+	config.Lockout.AddrFails = defaultLockoutAddrFails
+	config.Lockout.NameFails = defaultLockoutNameFails
+	config.Lockout.SudoFails = defaultLockoutSudoFails
+	config.Lockout.TOTPFails = defaultLockoutTOTPFails
+	config.Lockout.ResetFails = defaultLockoutResetFails
+	config.Lockout.Duration = defaultLockoutDuration
+	config.Lockout.MaxDuration = defaultLockoutMaxDuration
+	config.Lockout.Reset = defaultLockoutReset
+	config.TOTP.Issuer = defaultTOTPIssuer
+	config.TOTP.Timeout = defaultTOTPTimeout
+	config.PasswdPolicy.ResetCodeExpiry = defaultResetCodeExpiry
+	config.PasswdPolicy.Timeout = defaultPasswdTimeout
 
 	f, err := os.OpenFile(Path("config.json"), os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
@@ -322,6 +488,16 @@ func LoadConfig() error {
 		return err
 	}
 
+	if config.Registration.allow, err = compileNamePatterns(config.Registration.Allow); err != nil {
+		config = oldConf.clone()
+		return err
+	}
+
+	if config.Registration.block, err = compileNamePatterns(config.Registration.Block); err != nil {
+		config = oldConf.clone()
+		return err
+	}
+
 	// Dynamic servers shouldn't be deleted silently.
 	for name, srv := range oldConf.Servers {
 		if srv.dynamic {
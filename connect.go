@@ -10,6 +10,12 @@ import (
 )
 
 func connect(conn net.Conn, name string, cc *ClientConn) *ServerConn {
+	return connectPasswd(conn, name, cc, false)
+}
+
+// connectPasswd is like connect. If migrate is true it logs in
+// with an empty password and changes it to the derived password afterwards.
+func connectPasswd(conn net.Conn, name string, cc *ClientConn, migrate bool) *ServerConn {
 	cc.mu.RLock()
 	if cc.srv != nil {
 		cc.Log("<->", "already connected to server")
@@ -19,12 +25,19 @@ func connect(conn net.Conn, name string, cc *ClientConn) *ServerConn {
 	cc.mu.RUnlock()
 
 	var mediaPool string
+	var passwd []byte
 	for srvName, srv := range Conf().Servers {
 		if srvName == name {
 			mediaPool = srv.MediaPool
+			passwd = upstreamPasswd(srv, cc.Name())
 		}
 	}
 
+	var newPasswd []byte
+	if migrate {
+		newPasswd, passwd = passwd, []byte{}
+	}
+
 	logPrefix := fmt.Sprintf("[server %s as %s %s] ", name, cc.Name(), conn.LocalAddr())
 	sc := &ServerConn{
 		Peer:      mt.Connect(conn),
@@ -32,6 +45,8 @@ func connect(conn net.Conn, name string, cc *ClientConn) *ServerConn {
 		initCh:    make(chan struct{}),
 		clt:       cc,
 		name:      name,
+		passwd:    passwd,
+		newPasswd: newPasswd,
 		mediaPool: mediaPool,
 		dynMedia: make(map[string]struct {
 			ephemeral bool
@@ -73,6 +88,7 @@ func connectContent(conn net.Conn, name, userName, mediaPool string) (*contentCo
 		doneCh:    make(chan struct{}),
 		name:      name,
 		userName:  userName,
+		passwd:    upstreamPasswd(Conf().Servers[name], userName),
 		mediaPool: mediaPool,
 	}
 
@@ -47,6 +47,7 @@ type contentConn struct {
 		salt, srpA, a, srpK []byte
 	}
 
+	passwd    []byte
 	mediaPool string
 
 	itemDefs []mt.ItemDef
@@ -116,6 +117,34 @@ func handleContent(cc *contentConn) {
 		}
 	}()
 
+	for cc.session() {
+		cc.log("->", "retry with empty password")
+
+		addr, err := net.ResolveUDPAddr("udp", Conf().Servers[cc.name].Addr)
+		if err != nil {
+			cc.log("->", err)
+			return
+		}
+
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			cc.log("->", err)
+			return
+		}
+
+		cc.Peer = mt.Connect(conn)
+		cc.passwd = []byte{}
+		cc.auth.method = 0
+		cc.setState(csCreated)
+	}
+}
+
+// session handles a single connection to the server.
+// It returns true if the connection should be retried
+// with an empty password.
+func (cc *contentConn) session() (retry bool) {
+	peer := cc.Peer
+
 	go func() {
 		init := make(chan struct{})
 		defer close(init)
@@ -125,12 +154,18 @@ func handleContent(cc *contentConn) {
 			case <-init:
 			case <-time.After(10 * time.Second):
 				cc.log("->", "timeout")
-				cc.Close()
+				peer.Close()
 			}
 		}(init)
 
 		for cc.state() == csCreated {
-			cc.SendCmd(&mt.ToSrvInit{
+			select {
+			case <-peer.Closed():
+				return
+			default:
+			}
+
+			peer.SendCmd(&mt.ToSrvInit{
 				SerializeVer: serializeVer,
 				MinProtoVer:  protoVer,
 				MaxProtoVer:  protoVer,
@@ -191,7 +226,7 @@ func handleContent(cc *contentConn) {
 			case mt.FirstSRP:
 				id := strings.ToLower(cc.userName)
 
-				salt, verifier, err := srp.NewClient([]byte(id), []byte{})
+				salt, verifier, err := srp.NewClient([]byte(id), cc.passwd)
 				if err != nil {
 					cc.log("->", err)
 					break
@@ -200,7 +235,7 @@ func handleContent(cc *contentConn) {
 				cc.SendCmd(&mt.ToSrvFirstSRP{
 					Salt:        salt,
 					Verifier:    verifier,
-					EmptyPasswd: true,
+					EmptyPasswd: len(cc.passwd) == 0,
 				})
 			default:
 				cc.log("<->", "invalid auth method")
@@ -214,7 +249,7 @@ func handleContent(cc *contentConn) {
 
 			id := strings.ToLower(cc.userName)
 
-			cc.auth.srpK, err = srp.CompleteHandshake(cc.auth.srpA, cc.auth.a, []byte(id), []byte{}, cmd.Salt, cmd.B)
+			cc.auth.srpK, err = srp.CompleteHandshake(cc.auth.srpA, cc.auth.a, []byte(id), cc.passwd, cmd.Salt, cmd.B)
 			if err != nil {
 				cc.log("->", err)
 				break
@@ -231,6 +266,10 @@ func handleContent(cc *contentConn) {
 			})
 		case *mt.ToCltKick:
 			cc.log("<-", "deny access", cmd)
+
+			if cmd.Reason == mt.WrongPasswd && canMigratePasswd(Conf().Servers[cc.name], cc.passwd) {
+				retry = true
+			}
 		case *mt.ToCltAcceptAuth:
 			cc.auth.method = 0
 			cc.SendCmd(&mt.ToSrvInit2{})
@@ -297,40 +336,20 @@ func handleContent(cc *contentConn) {
 			}
 		}
 	}
+
+	return
 }
 
 func (cc *ClientConn) sendMedia(filenames []string) {
-	var bunches [][]struct {
-		Name string
-		Data []byte
-	}
-	bunches = append(bunches, []struct {
-		Name string
-		Data []byte
-	}{})
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
 
-	var bunchSize int
+	var files []mediaFile
 	for _, filename := range filenames {
 		var known bool
 		for _, f := range cc.media {
 			if f.name == filename {
-				mfile := struct {
-					Name string
-					Data []byte
-				}{
-					Name: f.name,
-					Data: f.data,
-				}
-				bunches[len(bunches)-1] = append(bunches[len(bunches)-1], mfile)
-
-				bunchSize += len(f.data)
-				if bunchSize >= bytesPerMediaBunch {
-					bunches = append(bunches, []struct {
-						Name string
-						Data []byte
-					}{})
-					bunchSize = 0
-				}
+				files = append(files, f)
 
 				known = true
 				break
@@ -343,6 +362,40 @@ func (cc *ClientConn) sendMedia(filenames []string) {
 		}
 	}
 
+	cc.sendMediaFiles(files)
+}
+
+func (cc *ClientConn) sendMediaFiles(files []mediaFile) {
+	var bunches [][]struct {
+		Name string
+		Data []byte
+	}
+	bunches = append(bunches, []struct {
+		Name string
+		Data []byte
+	}{})
+
+	var bunchSize int
+	for _, f := range files {
+		mfile := struct {
+			Name string
+			Data []byte
+		}{
+			Name: f.name,
+			Data: f.data,
+		}
+		bunches[len(bunches)-1] = append(bunches[len(bunches)-1], mfile)
+
+		bunchSize += len(f.data)
+		if bunchSize >= bytesPerMediaBunch {
+			bunches = append(bunches, []struct {
+				Name string
+				Data []byte
+			}{})
+			bunchSize = 0
+		}
+	}
+
 	for i := uint16(0); i < uint16(len(bunches)); i++ {
 		cc.SendCmd(&mt.ToCltMedia{
 			N:     uint16(len(bunches)),
@@ -510,6 +563,10 @@ func muxMedia(conns []*contentConn) []mediaFile {
 		}
 	}
 
+	if Conf().ShareMedia {
+		media = shareMedia(media)
+	}
+
 	return media
 }
 
@@ -566,9 +623,17 @@ PoolLoop:
 	}
 
 	failedPools := muxErrors(conns)
+	if Conf().ContentDiagnostics {
+		if r, changed := diagnoseContent(conns); changed {
+			r.Log()
+		}
+	}
+
+	// Media needs to be processed first so that definitions
+	// can reference shared media files.
+	media = muxMedia(conns)
 	itemDefs, aliases = muxItemDefs(conns)
 	nodeDefs, p0Map, p0SrvMap = muxNodeDefs(conns)
-	media = muxMedia(conns)
 	remotes = muxRemotes(conns)
 
 	for pool := range failedPools {
@@ -582,7 +647,11 @@ func (sc *ServerConn) globalParam0(p0 *mt.Content) {
 	clt := sc.client()
 	if clt != nil && clt.p0Map != nil {
 		if clt.p0Map[sc.name] != nil {
-			*p0 = clt.p0Map[sc.name][*p0]
+			if global, ok := clt.p0Map[sc.name][*p0]; ok {
+				*p0 = global
+			} else {
+				*p0 = mt.Unknown
+			}
 		}
 	}
 }
@@ -626,8 +695,12 @@ func isDefaultNode(s string, isTexture bool) bool {
 func prependRaw(prep string, s *string, isTexture bool) {
 	if !isDefaultNode(*s, isTexture) {
 		if isTexture {
-			*s = ReplaceAllStringSubmatchFunc(textureName, *s, func(groups []string) string {
-				return prep + "_" + groups[1]
+			*s = RewriteTexture(*s, func(name string) string {
+				if isDefaultNode(name, true) {
+					return name
+				}
+
+				return sharedMediaName(prep + "_" + name)
 			})
 		} else {
 			*s = prep + "_" + *s
@@ -663,7 +736,7 @@ func (sc *ServerConn) prependInv(inv mt.Inv) {
 
 				m := &inv[k].InvList.Stacks[i].ItemMeta
 				if s, ok := m.Field("inventory_image"); ok {
-					prepend(sc.mediaPool, &s)
+					prependRaw(sc.mediaPool, &s, true)
 					m.SetField("inventory_image", s)
 				}
 			}
@@ -679,7 +752,7 @@ func (sc *ServerConn) prependInvKeep(inv, old mt.Inv) {
 
 				m := &inv[k].InvList.Stacks[i].ItemMeta
 				if s, ok := m.Field("inventory_image"); ok {
-					prepend(sc.mediaPool, &s)
+					prependRaw(sc.mediaPool, &s, true)
 					m.SetField("inventory_image", s)
 				}
 			}
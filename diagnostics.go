@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HimbeerserverDE/mt"
+)
+
+// maxContent is the highest param0 value the client accepts
+// for registered nodes.
+const maxContent mt.Content = 0x7fff
+
+// param0WarnRatio is the share of the param0 space that
+// can be used before a warning is included in content reports.
+const param0WarnRatio = 0.9
+
+var lastContentReport *ContentReport
+var lastContentReportMu sync.RWMutex
+
+// A PoolReport contains the number of definitions and media files
+// a media pool contributes to the multiplexed content.
+type PoolReport struct {
+	Server   string
+	ItemDefs int
+	NodeDefs int
+	Aliases  int
+	Media    int
+}
+
+// A NameCollision is a (prefixed) name that is defined more than once
+// by item definitions, node definitions or aliases.
+// This can happen if media pool names and content names combine
+// to the same string, e.g. pool "a" with item "b_c"
+// and pool "a_b" with item "c".
+type NameCollision struct {
+	Name  string
+	Pools []string
+}
+
+// A MissingTexture is a texture that is referenced by a definition
+// but not provided by the media of the same pool.
+// Textures built into the client may show up as false positives.
+type MissingTexture struct {
+	Pool    string
+	Def     string
+	Texture string
+}
+
+// A ContentReport summarizes the multiplexed content sent to a client
+// and lists potential problems with it.
+type ContentReport struct {
+	Time  time.Time
+	Pools map[string]PoolReport
+
+	// Param0Used is the number of param0 values assigned to nodes
+	// including the reserved builtin ones.
+	Param0Used int
+	// Param0Free is the number of param0 values that can still
+	// be assigned before the client limit is exceeded.
+	Param0Free int
+
+	Collisions      []NameCollision
+	MissingTextures []MissingTexture
+}
+
+// Warnings returns human-readable descriptions of all problems
+// in the ContentReport.
+func (r *ContentReport) Warnings() []string {
+	var warnings []string
+
+	if r.Param0Free <= 0 {
+		warnings = append(warnings, fmt.Sprintf("param0 space exhausted, %d nodes don't fit", -r.Param0Free))
+	} else if float64(r.Param0Used) >= param0WarnRatio*float64(maxContent) {
+		warnings = append(warnings, fmt.Sprintf("param0 space almost exhausted, %d values left", r.Param0Free))
+	}
+
+	for _, c := range r.Collisions {
+		warnings = append(warnings, fmt.Sprintf("name collision %s in pools %s", c.Name, strings.Join(c.Pools, ", ")))
+	}
+
+	for _, t := range r.MissingTextures {
+		warnings = append(warnings, fmt.Sprintf("missing texture %s referenced by %s in pool %s", t.Texture, t.Def, t.Pool))
+	}
+
+	return warnings
+}
+
+// Log writes the ContentReport to the log.
+func (r *ContentReport) Log() {
+	for _, line := range r.lines() {
+		log.Print(line)
+	}
+}
+
+// lines returns the ContentReport as human-readable lines.
+func (r *ContentReport) lines() []string {
+	pools := make([]string, 0, len(r.Pools))
+	for pool := range r.Pools {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	var lines []string
+	for _, pool := range pools {
+		pr := r.Pools[pool]
+		lines = append(lines, fmt.Sprintf("content pool %s (via %s): %d item defs, %d node defs, %d aliases, %d media", pool, pr.Server, pr.ItemDefs, pr.NodeDefs, pr.Aliases, pr.Media))
+	}
+
+	lines = append(lines, fmt.Sprintf("content param0: %d used, %d free", r.Param0Used, r.Param0Free))
+
+	for _, warning := range r.Warnings() {
+		lines = append(lines, "content warning: "+warning)
+	}
+
+	return lines
+}
+
+// sameContent reports whether two ContentReports describe
+// the same content, ignoring the time they were generated at.
+func (r *ContentReport) sameContent(other *ContentReport) bool {
+	a, b := *r, *other
+	a.Time, b.Time = time.Time{}, time.Time{}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// LastContentReport returns the ContentReport of the most recent
+// content multiplexing procedure. It is only generated if the
+// `ContentDiagnostics` config option is enabled.
+// The boolean is false if no report is available.
+func LastContentReport() (ContentReport, bool) {
+	lastContentReportMu.RLock()
+	defer lastContentReportMu.RUnlock()
+
+	if lastContentReport == nil {
+		return ContentReport{}, false
+	}
+
+	return *lastContentReport, true
+}
+
+// diagnoseContent generates a ContentReport and makes it available
+// through LastContentReport. The boolean is true if the content
+// differs from the previous report.
+func diagnoseContent(conns []*contentConn) (*ContentReport, bool) {
+	r := &ContentReport{
+		Time:  time.Now(),
+		Pools: make(map[string]PoolReport),
+	}
+
+	definedBy := make(map[string][]string)
+	define := func(name, pool string) {
+		for _, p := range definedBy[name] {
+			if p == pool {
+				return
+			}
+		}
+
+		definedBy[name] = append(definedBy[name], pool)
+	}
+
+	var nodes int
+	for _, cc := range conns {
+		<-cc.done()
+
+		r.Pools[cc.mediaPool] = PoolReport{
+			Server:   cc.name,
+			ItemDefs: len(cc.itemDefs),
+			NodeDefs: len(cc.nodeDefs),
+			Aliases:  len(cc.aliases),
+			Media:    len(cc.media),
+		}
+		nodes += len(cc.nodeDefs)
+
+		media := make(map[string]struct{})
+		for _, f := range cc.media {
+			media[f.name] = struct{}{}
+		}
+
+		checkTextures := func(def string, textures ...mt.Texture) {
+			for _, t := range textures {
+				RewriteTexture(string(t), func(name string) string {
+					if isDefaultNode(name, true) {
+						return name
+					}
+
+					if _, ok := media[name]; !ok {
+						r.MissingTextures = append(r.MissingTextures, MissingTexture{
+							Pool:    cc.mediaPool,
+							Def:     def,
+							Texture: name,
+						})
+					}
+
+					return name
+				})
+			}
+		}
+
+		// Item and node definitions with the same name are expected,
+		// the client treats them as the same content.
+		names := make(map[string]struct{})
+		for _, def := range cc.itemDefs {
+			name := def.Name
+			if name == "" {
+				name = "hand"
+			}
+
+			prepend(cc.mediaPool, &name)
+			names[name] = struct{}{}
+
+			checkTextures(def.Name, def.InvImg.Texture, def.WieldImg.Texture, def.Palette, def.InvOverlay.Texture, def.WieldOverlay.Texture)
+		}
+
+		for _, def := range cc.nodeDefs {
+			name := def.Name
+			prepend(cc.mediaPool, &name)
+			names[name] = struct{}{}
+
+			var textures []mt.Texture
+			for _, tile := range def.Tiles {
+				textures = append(textures, tile.Texture)
+			}
+			for _, tile := range def.OverlayTiles {
+				textures = append(textures, tile.Texture)
+			}
+			for _, tile := range def.SpecialTiles {
+				textures = append(textures, tile.Texture)
+			}
+			textures = append(textures, def.Palette)
+
+			checkTextures(def.Name, textures...)
+		}
+
+		for _, alias := range cc.aliases {
+			name := alias.Alias
+			prepend(cc.mediaPool, &name)
+			names[name] = struct{}{}
+		}
+
+		for name := range names {
+			define(name, cc.mediaPool)
+		}
+	}
+
+	for name, pools := range definedBy {
+		if len(pools) > 1 {
+			sort.Strings(pools)
+			r.Collisions = append(r.Collisions, NameCollision{
+				Name:  name,
+				Pools: pools,
+			})
+		}
+	}
+
+	sort.Slice(r.Collisions, func(i, j int) bool {
+		return r.Collisions[i].Name < r.Collisions[j].Name
+	})
+
+	// muxNodeDefs skips the builtin param0 values.
+	r.Param0Used = nodes
+	if nodes > int(mt.Unknown) {
+		r.Param0Used += int(mt.Ignore-mt.Unknown) + 1
+	}
+	r.Param0Free = int(maxContent) + 1 - r.Param0Used
+
+	lastContentReportMu.Lock()
+	defer lastContentReportMu.Unlock()
+
+	changed := lastContentReport == nil || !r.sameContent(lastContentReport)
+	lastContentReport = r
+
+	return r, changed
+}
+
+// diagnoseFormspec logs formspec textures referencing files
+// that don't have a known image or model extension.
+// These are usually malformed or not meant to be textures.
+func (sc *ServerConn) diagnoseFormspec(fs *Formspec) {
+	fs.rewrite(func(s string) string {
+		RewriteTexture(s, func(name string) string {
+			if !isDefaultNode(name, true) && !textureName.MatchString(name) {
+				sc.Log("<-", "unrecognized formspec texture", name)
+			}
+
+			return name
+		})
+
+		return s
+	}, func(s string) string { return s })
+}
+
+func init() {
+	registerCoreChatCmd(ChatCmd{
+		Name:  "contentreport",
+		Perm:  "cmd.contentreport",
+		Help:  "Show the report on the most recently multiplexed content.",
+		Usage: "contentreport",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 0 {
+				return "Usage: contentreport"
+			}
+
+			r, ok := LastContentReport()
+			if !ok {
+				return "No content report available."
+			}
+
+			return fmt.Sprintf("Report from %s:\n", r.Time.Format(time.RFC1123)) + strings.Join(r.lines(), "\n")
+		},
+	})
+}
@@ -2,22 +2,374 @@ package proxy
 
 import (
 	"regexp"
+	"strings"
 )
 
-var itemName = regexp.MustCompile("(item_image\\[[0-9.-]+,[0-9.-]+;[0-9.-]+,[0-9.-]+;)([a-zA-Z0-9-_.: ]+)(\\])")
-var itemButtonName = regexp.MustCompile("(item_image_button\\[[0-9.-]+,[0-9.-]+;[0-9.-]+,[0-9.-]+;)([a-zA-Z0-9-_.: ]+)(;[a-zA-Z0-9-_.: ]+;[^\\[\\]]*\\])")
 var textureName = regexp.MustCompile("([a-zA-Z0-9-_.]+\\.(?i:png|jpg|jpeg|tga|obj|b3d|x|gltf|glb))")
 
+// styleTextureProps are the style properties that take textures.
+var styleTextureProps = map[string]struct{}{
+	"bgimg":         {},
+	"bgimg_hovered": {},
+	"bgimg_pressed": {},
+	"fgimg":         {},
+	"fgimg_hovered": {},
+	"fgimg_pressed": {},
+}
+
+// plainFormspecElems are the elements that are known not to reference
+// any textures or items. The arguments of elements that are neither
+// in this set nor handled explicitly are searched for texture file names.
+var plainFormspecElems = map[string]struct{}{
+	"formspec_version":       {},
+	"size":                   {},
+	"position":               {},
+	"anchor":                 {},
+	"padding":                {},
+	"no_prepend":             {},
+	"real_coordinates":       {},
+	"allow_close":            {},
+	"container":              {},
+	"container_end":          {},
+	"scroll_container":       {},
+	"scroll_container_end":   {},
+	"list":                   {},
+	"listring":               {},
+	"listcolors":             {},
+	"tooltip":                {},
+	"bgcolor":                {},
+	"pwdfield":               {},
+	"field":                  {},
+	"field_enter_after_edit": {},
+	"field_close_on_enter":   {},
+	"textarea":               {},
+	"label":                  {},
+	"vertlabel":              {},
+	"button":                 {},
+	"button_exit":            {},
+	"button_url":             {},
+	"button_url_exit":        {},
+	"textlist":               {},
+	"tabheader":              {},
+	"box":                    {},
+	"dropdown":               {},
+	"checkbox":               {},
+	"scrollbar":              {},
+	"scrollbaroptions":       {},
+	"table":                  {},
+	"tableoptions":           {},
+	"set_focus":              {},
+}
+
+// hypertextTag matches the tags of hypertext elements
+// that reference textures or items.
+var hypertextTag = regexp.MustCompile(`<(img|item)(\s[^>]*)>`)
+
+// hypertextName matches the name attribute of a hypertext tag.
+var hypertextName = regexp.MustCompile(`(\sname=)([^\s>]+)`)
+
+// A Formspec is a parsed formspec string.
+// It preserves the original formatting, so converting an unmodified
+// Formspec back to a string returns the input to ParseFormspec.
+type Formspec struct {
+	Elems []*FormspecElem
+}
+
+// A FormspecElem is a single element of a Formspec,
+// e.g. `image[0,0;1,1;default_dirt.png]`.
+// Args contains the arguments (separated by semicolons) in escaped form.
+// Use the Arg and SetArg methods to access them in unescaped form
+// or SplitFormspecArg to split arguments that are lists.
+type FormspecElem struct {
+	Type string
+	Args []string
+
+	space      string // Whitespace preceding the type.
+	text       string // Content that isn't an element.
+	unfinished bool   // Not terminated by a closing bracket.
+}
+
+// ParseFormspec parses a formspec string into its elements.
+// It follows the rules used by the client, i.e. elements are separated
+// by unescaped closing brackets and arguments by unescaped semicolons.
+// Backslashes escape the next character.
+// Parsing never fails, content that isn't a valid element
+// is preserved as is.
+func ParseFormspec(s string) *Formspec {
+	fs := &Formspec{}
+
+	for _, raw := range splitEscaped(s, ']') {
+		elem := &FormspecElem{}
+
+		trimmed := strings.TrimLeft(raw.s, " \t\r\n")
+		elem.space = raw.s[:len(raw.s)-len(trimmed)]
+		elem.unfinished = !raw.terminated
+
+		typ, args, ok := strings.Cut(trimmed, "[")
+		if !ok {
+			if trimmed == "" && !raw.terminated {
+				if raw.s != "" {
+					fs.Elems = append(fs.Elems, elem)
+				}
+
+				continue
+			}
+
+			elem.text = trimmed
+			fs.Elems = append(fs.Elems, elem)
+			continue
+		}
+
+		elem.Type = typ
+		for _, arg := range splitEscaped(args, ';') {
+			elem.Args = append(elem.Args, arg.s)
+		}
+
+		fs.Elems = append(fs.Elems, elem)
+	}
+
+	return fs
+}
+
+// String returns the formspec string representation of the Formspec.
+func (fs *Formspec) String() string {
+	b := &strings.Builder{}
+	for _, elem := range fs.Elems {
+		b.WriteString(elem.String())
+	}
+
+	return b.String()
+}
+
+// Find returns all elements of the specified type.
+func (fs *Formspec) Find(typ string) []*FormspecElem {
+	var elems []*FormspecElem
+	for _, elem := range fs.Elems {
+		if elem.Type == typ {
+			elems = append(elems, elem)
+		}
+	}
+
+	return elems
+}
+
+// String returns the formspec string representation of the FormspecElem.
+func (e *FormspecElem) String() string {
+	b := &strings.Builder{}
+	b.WriteString(e.space)
+
+	if e.Type == "" && e.Args == nil {
+		b.WriteString(e.text)
+	} else {
+		b.WriteString(e.Type)
+		b.WriteString("[")
+		b.WriteString(strings.Join(e.Args, ";"))
+	}
+
+	if !e.unfinished {
+		b.WriteString("]")
+	}
+
+	return b.String()
+}
+
+// Arg returns the unescaped argument at the specified index.
+// It is empty if the argument doesn't exist.
+func (e *FormspecElem) Arg(i int) string {
+	if i < 0 || i >= len(e.Args) {
+		return ""
+	}
+
+	return FormspecUnescape(e.Args[i])
+}
+
+// SetArg escapes the value and sets the argument at the specified index
+// to it, adding empty arguments if necessary.
+func (e *FormspecElem) SetArg(i int, v string) {
+	for len(e.Args) <= i {
+		e.Args = append(e.Args, "")
+	}
+
+	e.Args[i] = FormspecEscape(v)
+}
+
+// SplitFormspecArg splits an escaped argument at every unescaped
+// occurence of sep. This is useful for arguments that are lists,
+// e.g. positions or the textures of a model. The parts remain escaped.
+func SplitFormspecArg(arg string, sep byte) []string {
+	var parts []string
+	for _, part := range splitEscaped(arg, sep) {
+		parts = append(parts, part.s)
+	}
+
+	return parts
+}
+
+// FormspecUnescape reverses FormspecEscape.
+func FormspecUnescape(s string) string {
+	return unescapeBackslashes(s)
+}
+
+type escapedPart struct {
+	s          string
+	terminated bool
+}
+
+func splitEscaped(s string, sep byte) []escapedPart {
+	var parts []escapedPart
+
+	var start int
+	var escaped bool
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == sep:
+			parts = append(parts, escapedPart{s[start:i], true})
+			start = i + 1
+		}
+	}
+
+	return append(parts, escapedPart{s[start:], false})
+}
+
+// rewrite calls the texture callback for every texture
+// and the item callback for every item name referenced by the Formspec.
+// The arguments are replaced with the return values.
+// Both callbacks receive and return unescaped strings.
+func (fs *Formspec) rewrite(texture, item func(string) string) {
+	rewriteArg := func(elem *FormspecElem, i int, f func(string) string) {
+		if i >= len(elem.Args) || elem.Args[i] == "" {
+			return
+		}
+
+		if v := f(elem.Arg(i)); v != elem.Arg(i) {
+			elem.SetArg(i, v)
+		}
+	}
+
+	rewriteList := func(arg string, sep byte, f func(int, string) string) string {
+		parts := SplitFormspecArg(arg, sep)
+		for i, part := range parts {
+			unescaped := FormspecUnescape(part)
+			if v := f(i, unescaped); v != unescaped {
+				parts[i] = FormspecEscape(v)
+			}
+		}
+
+		return strings.Join(parts, string(sep))
+	}
+
+	itemstring := func(s string) string {
+		name, rest, _ := strings.Cut(s, " ")
+		name = item(name)
+		if rest != "" {
+			return name + " " + rest
+		}
+
+		return name
+	}
+
+	for _, elem := range fs.Elems {
+		switch strings.TrimSpace(elem.Type) {
+		case "background", "background9", "image":
+			rewriteArg(elem, 2, texture)
+		case "animated_image":
+			rewriteArg(elem, 3, texture)
+		case "image_button", "image_button_exit":
+			rewriteArg(elem, 2, texture)
+			rewriteArg(elem, 7, texture)
+		case "item_image":
+			rewriteArg(elem, 2, itemstring)
+		case "item_image_button":
+			rewriteArg(elem, 2, itemstring)
+		case "model":
+			rewriteArg(elem, 3, texture)
+			if len(elem.Args) > 4 {
+				elem.Args[4] = rewriteList(elem.Args[4], ',', func(_ int, s string) string {
+					return texture(s)
+				})
+			}
+		case "style", "style_type":
+			for i := 1; i < len(elem.Args); i++ {
+				prop, v, ok := strings.Cut(elem.Arg(i), "=")
+				if !ok {
+					continue
+				}
+
+				if _, ok := styleTextureProps[strings.TrimSpace(prop)]; ok {
+					if nv := texture(v); nv != v {
+						elem.SetArg(i, prop+"="+nv)
+					}
+				}
+			}
+		case "hypertext":
+			rewriteArg(elem, 3, func(text string) string {
+				return ReplaceAllStringSubmatchFunc(hypertextTag, text, func(tag []string) string {
+					f := texture
+					if tag[1] == "item" {
+						f = item
+					}
+
+					attrs := ReplaceAllStringSubmatchFunc(hypertextName, tag[2], func(attr []string) string {
+						return attr[1] + f(attr[2])
+					})
+
+					return "<" + tag[1] + attrs + ">"
+				})
+			})
+		case "tablecolumns":
+			for i, column := range elem.Args {
+				parts := SplitFormspecArg(column, ',')
+				if len(parts) == 0 || FormspecUnescape(parts[0]) != "image" {
+					continue
+				}
+
+				elem.Args[i] = rewriteList(column, ',', func(j int, s string) string {
+					k, v, ok := strings.Cut(s, "=")
+					if j == 0 || !ok || strings.Trim(k, "0123456789") != "" {
+						return s
+					}
+
+					return k + "=" + texture(v)
+				})
+			}
+		default:
+			if _, ok := plainFormspecElems[strings.TrimSpace(elem.Type)]; ok || elem.Type == "" {
+				continue
+			}
+
+			// Unknown elements, e.g. ones added by newer engine versions,
+			// are searched for anything that looks like a texture.
+			for i := range elem.Args {
+				rewriteArg(elem, i, func(arg string) string {
+					return ReplaceAllStringSubmatchFunc(textureName, arg, func(groups []string) string {
+						return texture(groups[1])
+					})
+				})
+			}
+		}
+	}
+}
+
 func (sc *ServerConn) prependFormspec(fs *string) {
-	*fs = ReplaceAllStringSubmatchFunc(textureName, *fs, func(groups []string) string {
-		return sc.mediaPool + "_" + groups[1]
-	})
-	*fs = ReplaceAllStringSubmatchFunc(itemName, *fs, func(groups []string) string {
-		return groups[1] + sc.name + "_" + groups[2] + groups[3]
-	})
-	*fs = ReplaceAllStringSubmatchFunc(itemButtonName, *fs, func(groups []string) string {
-		return groups[1] + sc.name + "_" + groups[2] + groups[3]
+	parsed := ParseFormspec(*fs)
+
+	if Conf().ContentDiagnostics {
+		sc.diagnoseFormspec(parsed)
+	}
+
+	parsed.rewrite(func(s string) string {
+		prependRaw(sc.mediaPool, &s, true)
+		return s
+	}, func(s string) string {
+		prependRaw(sc.mediaPool, &s, false)
+		return s
 	})
+
+	*fs = parsed.String()
 }
 
 func ReplaceAllStringSubmatchFunc(re *regexp.Regexp, str string, repl func([]string) string) string {
@@ -0,0 +1,131 @@
+package proxy
+
+import "testing"
+
+func TestParseFormspecRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"size[8,9]",
+		"formspec_version[6]size[8,9]label[0,0;Hello]",
+		"  image[0,0;1,1;a.png]\nlabel[1,1;x]",
+		`label[0,0;a\]b\;c\[d]`,
+		`label[0,0;trailing backslash\\]`,
+		`field[0,0;1,1;name;Label;default\\\]]`,
+		"style[btn;bgimg=a.png;textcolor=red]",
+		"unterminated[0,0",
+		"text without element",
+		"image[0,0;1,1;a.png]]]",
+		"label[0,0;ü → ✓]",
+		"[]",
+		`\`,
+	}
+
+	for _, test := range tests {
+		if got := ParseFormspec(test).String(); got != test {
+			t.Errorf("ParseFormspec(%q).String() = %q", test, got)
+		}
+	}
+}
+
+func TestFormspecElemArgs(t *testing.T) {
+	fs := ParseFormspec(`label[0,0;a\]b\;c\\]image[0,0;1,1;a.png]`)
+	if len(fs.Elems) != 2 {
+		t.Fatalf("got %d elements, want 2", len(fs.Elems))
+	}
+
+	label := fs.Elems[0]
+	if label.Type != "label" {
+		t.Errorf("Type = %q, want label", label.Type)
+	}
+
+	if got, want := label.Arg(1), `a]b;c\`; got != want {
+		t.Errorf("Arg(1) = %q, want %q", got, want)
+	}
+
+	label.SetArg(1, "x[y];z")
+	if got, want := label.String(), `label[0,0;x\[y\]\;z]`; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	if got := ParseFormspec(label.String()).Elems[0].Arg(1); got != "x[y];z" {
+		t.Errorf("Arg(1) after round trip = %q, want %q", got, "x[y];z")
+	}
+
+	if images := fs.Find("image"); len(images) != 1 || images[0].Arg(2) != "a.png" {
+		t.Errorf("Find(image) = %v", images)
+	}
+}
+
+func TestFormspecRewrite(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{
+			"image[0,0;1,1;a.png]",
+			"image[0,0;1,1;p_a.png]",
+		},
+		{
+			"background9[0,0;1,1;a.png^b.png;false;2]",
+			"background9[0,0;1,1;p_a.png^p_b.png;false;2]",
+		},
+		{
+			"image_button[0,0;1,1;a.png;btn;Label;false;true;b.png]",
+			"image_button[0,0;1,1;p_a.png;btn;Label;false;true;p_b.png]",
+		},
+		{
+			"item_image[0,0;1,1;default:dirt 5]",
+			"item_image[0,0;1,1;i_default:dirt 5]",
+		},
+		{
+			"item_image_button[0,0;1,1;default:dirt;btn;]",
+			"item_image_button[0,0;1,1;i_default:dirt;btn;]",
+		},
+		{
+			"model[0,0;1,1;m;mesh.b3d;a.png,b.png;0,0]",
+			"model[0,0;1,1;m;p_mesh.b3d;p_a.png,p_b.png;0,0]",
+		},
+		{
+			"style[btn;bgimg=a.png;textcolor=red]",
+			"style[btn;bgimg=p_a.png;textcolor=red]",
+		},
+		{
+			"tablecolumns[image,1=a.png,2=b.png;text]",
+			"tablecolumns[image,1=p_a.png,2=p_b.png;text]",
+		},
+		{
+			"hypertext[0,0;1,1;ht;<img name=a.png width=16> and <item name=default:dirt>]",
+			"hypertext[0,0;1,1;ht;<img name=p_a.png width=16> and <item name=i_default:dirt>]",
+		},
+		{
+			"hypertext[0,0;1,1;ht;<b>a.png</b>]",
+			"hypertext[0,0;1,1;ht;<b>a.png</b>]",
+		},
+		{
+			"label[0,0;a.png]",
+			"label[0,0;a.png]",
+		},
+		{
+			"image_scaled[0,0;a.png;label]",
+			"image_scaled[0,0;p_a.png;label]",
+		},
+		{
+			`image[0,0;1,1;a.png^\[combine:8x8:0\,0=b.png]`,
+			`image[0,0;1,1;p_a.png^\[combine:8x8:0\,0=p_b.png]`,
+		},
+	}
+
+	for _, test := range tests {
+		fs := ParseFormspec(test.in)
+		fs.rewrite(func(s string) string {
+			return RewriteTexture(s, func(name string) string {
+				return "p_" + name
+			})
+		}, func(s string) string {
+			return "i_" + s
+		})
+
+		if got := fs.String(); got != test.want {
+			t.Errorf("rewrite(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
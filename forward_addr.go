@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HimbeerserverDE/mt"
+)
+
+// addrModChan is the modchannel the network address of a client
+// is sent to its upstream server on. Clients cannot use it.
+const addrModChan = "mt_multiserver_proxy:addr"
+
+// addrMsg returns the sealed modchannel message that tells
+// the upstream server the network address of a client.
+func addrMsg(srv Server, name, addr string, t time.Time) (string, error) {
+	return sealMsg(srv.Secret, addrModChan, name, addr, t)
+}
+
+// sealKey derives the key of the messages sent on a modchannel
+// from the secret of a server. It is the HMAC-SHA256 of the name
+// of the modchannel, so every modchannel uses a different key.
+func sealKey(secret, channel string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(channel))
+
+	return mac.Sum(nil)
+}
+
+// sealMsg encrypts and authenticates a modchannel message
+// for an upstream server. Modchannel messages are relayed to every peer
+// that has joined the channel, including clients that connect
+// to the server directly, so the payload is encrypted.
+// The message has the format `<nonce> <ciphertext> <unix time>`.
+// The ciphertext is the payload sealed with AES-256-GCM
+// using the key returned by sealKey, a random 12 byte nonce
+// and `<lowercase name> <unix time>` as additional data.
+// It includes the authentication tag.
+// All binary values are hex encoded.
+func sealMsg(secret, channel, name, payload string, t time.Time) (string, error) {
+	block, err := aes.NewCipher(sealKey(secret, channel))
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	unix := strconv.FormatInt(t.Unix(), 10)
+	data := strings.ToLower(name) + " " + unix
+
+	ciphertext := gcm.Seal(nil, nonce, []byte(payload), []byte(data))
+
+	return fmt.Sprintf("%s %s %s", hex.EncodeToString(nonce), hex.EncodeToString(ciphertext), unix), nil
+}
+
+// forwardAddr sends the network address of the client
+// to the upstream server if it is enabled for the server.
+// It must be called after the client is ready.
+func (sc *ServerConn) forwardAddr() {
+	clt := sc.client()
+	if clt == nil {
+		return
+	}
+
+	srv, ok := Conf().Servers[sc.name]
+	if !ok || !srv.ForwardAddr {
+		return
+	}
+
+	if srv.Secret == "" {
+		sc.Log("->", "can't forward address without secret")
+		return
+	}
+
+	addr := clt.RemoteAddr().String()
+
+	msg, err := addrMsg(srv, clt.Name(), addr, time.Now())
+	if err != nil {
+		sc.Log("->", "forward address:", err)
+		return
+	}
+
+	sc.SendCmd(&mt.ToSrvJoinModChan{Channel: addrModChan})
+	sc.SendCmd(&mt.ToSrvMsgModChan{
+		Channel: addrModChan,
+		Msg:     msg,
+	})
+	sc.SendCmd(&mt.ToSrvLeaveModChan{Channel: addrModChan})
+
+	sc.Log("->", "forward address", addr)
+}
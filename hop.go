@@ -25,6 +25,9 @@ func (cc *ClientConn) Hop(serverName string) (err error) {
 	defer func() {
 		if err == nil && !Conf().ForceDefaultSrv {
 			err = DefaultAuth().SetLastSrv(cc.Name(), serverName)
+			if errors.Is(err, ErrLastSrvNotSupported) {
+				err = nil
+			}
 		}
 	}()
 
@@ -72,12 +75,19 @@ func (cc *ClientConn) HopRaw(serverName string) error {
 		return ErrNoSuchServer
 	}
 
-	if _, ok := cc.denyPools[newSrv.MediaPool]; ok {
-		return ErrNewMediaPool
-	}
-
-	if newSrv.poolAdded.After(cc.created) {
-		return ErrNewMediaPool
+	var content *contentConn
+	if !cc.knowsPool(newSrv) {
+		switch {
+		case Conf().RejoinOnNewPool:
+			return cc.rejoinPool(serverName)
+		case Conf().InjectNewPools:
+			var err error
+			if content, err = cc.fetchPool(serverName, newSrv); err != nil {
+				return err
+			}
+		default:
+			return ErrNewMediaPool
+		}
 	}
 
 	// This needs to be done before the ServerConn is closed
@@ -211,6 +221,10 @@ func (cc *ClientConn) HopRaw(serverName string) error {
 	cc.srv = nil
 	cc.mu.Unlock()
 
+	if content != nil {
+		cc.injectPool(content)
+	}
+
 	addr, err := net.ResolveUDPAddr("udp", newSrv.Addr)
 	if err != nil {
 		return err
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"errors"
+	"net"
+
+	"github.com/HimbeerserverDE/mt"
+)
+
+var (
+	ErrRejoinRequired   = errors.New("reconnect required to access media pool")
+	ErrPoolInjectFailed = errors.New("media pool content retrieval failed")
+	ErrPoolHasDefs      = errors.New("media pool has node or item definitions")
+)
+
+// knowsPool reports whether the client has received the content
+// of the media pool of the specified server, either when it joined
+// or by injection at runtime.
+func (cc *ClientConn) knowsPool(srv Server) bool {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+
+	if _, ok := cc.newPools[srv.MediaPool]; ok {
+		return true
+	}
+
+	if _, ok := cc.denyPools[srv.MediaPool]; ok {
+		return false
+	}
+
+	return !srv.poolAdded.After(cc.created)
+}
+
+// fetchPool retrieves the content of the media pool of the specified
+// server by connecting to it. The returned contentConn is closed.
+// ErrPoolHasDefs is returned if the pool has node or item definitions
+// because they can't be injected.
+func (cc *ClientConn) fetchPool(serverName string, srv Server) (*contentConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := connectContent(conn, serverName, cc.Name(), srv.MediaPool)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	<-content.done()
+	if !content.success {
+		return nil, ErrPoolInjectFailed
+	}
+
+	if content.hasDefs() {
+		return nil, ErrPoolHasDefs
+	}
+
+	return content, nil
+}
+
+// hasDefs reports whether the contentConn has received
+// any node or item definitions other than the builtin ones.
+func (cc *contentConn) hasDefs() bool {
+	for _, def := range cc.nodeDefs {
+		if !isDefaultNode(def.Name, false) {
+			return true
+		}
+	}
+
+	for _, def := range cc.itemDefs {
+		if !isDefaultNode(def.Name, false) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// injectPool makes the previously fetched content of a media pool
+// available to the client. Media files are pushed using the dynamic media
+// mechanism. Node and item definitions can't be sent after the client
+// has finished connecting due to engine limitations,
+// so only pools without them can be injected (see fetchPool).
+// The client must not be connected to a server.
+func (cc *ClientConn) injectPool(content *contentConn) {
+	cc.Log("<-", "inject media pool", content.mediaPool)
+
+	media := muxMedia([]*contentConn{content})
+
+	// The files have to be known before they are pushed
+	// because the client may request them at any time.
+	cc.mu.Lock()
+	if cc.pushTokens == nil {
+		cc.pushTokens = make(map[uint32]struct{})
+	}
+
+	pushes := make([]*mt.ToCltMediaPush, 0, len(media))
+	for _, f := range media {
+		digest, err := b64.DecodeString(f.base64SHA1)
+		if err != nil {
+			cc.Log("<-", "base64decode media digest: "+err.Error())
+			continue
+		}
+
+		var sum [sha1.Size]byte
+		copy(sum[:], digest)
+
+		known := false
+		for i, mf := range cc.media {
+			if mf.name == f.name {
+				cc.media[i] = f
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			cc.media = append(cc.media, f)
+		}
+
+		cc.nextPushToken++
+		cc.pushTokens[cc.nextPushToken] = struct{}{}
+
+		pushes = append(pushes, &mt.ToCltMediaPush{
+			SHA1:          sum,
+			Filename:      f.name,
+			CallbackToken: cc.nextPushToken,
+		})
+	}
+	cc.mu.Unlock()
+
+	for _, push := range pushes {
+		cc.SendCmd(push)
+	}
+
+	cc.sendMediaFiles(media)
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.p0Map == nil {
+		cc.p0Map = make(param0Map)
+	}
+
+	// The pool only has builtin nodes.
+	cc.p0Map[content.name] = map[mt.Content]mt.Content{
+		mt.Unknown: mt.Unknown,
+		mt.Air:     mt.Air,
+		mt.Ignore:  mt.Ignore,
+	}
+
+	cc.newPools[content.mediaPool] = struct{}{}
+	delete(cc.denyPools, content.mediaPool)
+}
+
+// rejoinPool kicks the client so that it receives the content
+// of a new media pool when it reconnects. Unless `ForceDefaultSrv`
+// is enabled, the specified server is saved as the last server
+// of the player so that the client is connected to it after rejoining.
+// If the auth backend doesn't support this the player is asked
+// to join the server again after reconnecting.
+func (cc *ClientConn) rejoinPool(serverName string) error {
+	cc.Log("<-", "rejoin for media pool", serverName)
+
+	if !Conf().ForceDefaultSrv {
+		err := DefaultAuth().SetLastSrv(cc.Name(), serverName)
+		switch {
+		case errors.Is(err, ErrLastSrvNotSupported):
+			cc.Kick("The server you are trying to join uses new media. Please reconnect and join it again.")
+			return ErrRejoinRequired
+		case err != nil:
+			return err
+		}
+	}
+
+	cc.Kick("The server you are trying to join uses new media. Please reconnect to access it.")
+	return ErrRejoinRequired
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"log"
 	"math"
 	"mime/multipart"
@@ -21,19 +22,78 @@ const (
 
 var announceMu sync.Mutex
 
+// announceWarned contains the local bind addresses
+// a warning has already been logged for.
+var announceWarned = make(map[string]struct{})
+
 func announce(action string) error {
 	announceMu.Lock()
 	defer announceMu.Unlock()
 
-	addr, err := net.ResolveUDPAddr("udp", Conf().BindAddr)
+	addrs, err := announceAddrs()
 	if err != nil {
 		return err
 	}
 
+	var errs []error
+	for _, addr := range addrs {
+		if err := announceAddr(action, addr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// announceAddrs returns the bind addresses that are announced
+// to the server list. Unspecified, loopback, private and link-local
+// addresses are returned without an IP, letting the server list use
+// the source address of the request instead. This is the public address
+// if the proxy is behind NAT. A warning is logged for local addresses
+// because the proxy may not be reachable from the internet.
+// Addresses that are equal after this are only returned once.
+// The caller must hold announceMu.
+func announceAddrs() ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	seen := make(map[string]struct{})
+	for _, bindAddr := range Conf().BindAddr {
+		addr, err := net.ResolveUDPAddr("udp", bindAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		if ip := addr.IP; ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()) {
+			if _, ok := announceWarned[bindAddr]; !ok {
+				log.Println("announce local bind address", bindAddr, "without ip, make sure port", addr.Port, "is forwarded")
+				announceWarned[bindAddr] = struct{}{}
+			}
+
+			addr.IP = nil
+		}
+
+		if addr.IP.IsUnspecified() {
+			addr.IP = nil
+		}
+
+		if _, ok := seen[addr.String()]; ok {
+			continue
+		}
+
+		seen[addr.String()] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+func announceAddr(action string, addr *net.UDPAddr) error {
 	a := map[string]interface{}{
-		"action":  action,
-		"address": addr.IP.String(),
-		"port":    addr.Port,
+		"action": action,
+		"port":   addr.Port,
+	}
+
+	if addr.IP != nil {
+		a["address"] = addr.IP.String()
 	}
 
 	if action != listRm {
@@ -88,7 +148,7 @@ func announce(action string) error {
 		return err
 	}
 
-	log.Println("announce", action)
+	log.Println("announce", action, addr)
 	return nil
 }
 
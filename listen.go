@@ -70,13 +70,30 @@ func (l *listener) accept() (*ClientConn, error) {
 		return nil, err
 	}
 
+	conf := Conf()
+
+	// Rejected clients keep sending packets, each of which
+	// is accepted as a new connection, so rejections are only
+	// logged once per address and rate limit interval.
+	if !allowConn(p.RemoteAddr().(*net.UDPAddr).IP) {
+		p.Close()
+		return nil, rejectErr(p.RemoteAddr(), "connection rate limit exceeded")
+	}
+
+	if max := conf.RateLimit.MaxPreAuthClts; max > 0 && int(preAuthClts.Load()) >= max {
+		p.Close()
+		return nil, rejectErr(p.RemoteAddr(), "too many unauthenticated clients")
+	}
+
 	prefix := fmt.Sprintf("[%s] ", p.RemoteAddr())
 	cc := &ClientConn{
-		Peer:    p,
-		created: time.Now(),
-		logger:  log.New(logWriter, prefix, log.LstdFlags|log.Lmsgprefix),
-		initCh:  make(chan struct{}),
-		modChs:  make(map[string]struct{}),
+		Peer:     p,
+		created:  time.Now(),
+		logger:   log.New(logWriter, prefix, log.LstdFlags|log.Lmsgprefix),
+		initCh:   make(chan struct{}),
+		readyCh:  make(chan struct{}),
+		newPools: make(map[string]struct{}),
+		modChs:   make(map[string]struct{}),
 	}
 
 	l.mu.Lock()
@@ -91,6 +108,26 @@ func (l *listener) accept() (*ClientConn, error) {
 		delete(l.clts, cc)
 	}()
 
+	preAuthClts.Add(1)
+	go func() {
+		defer preAuthClts.Add(-1)
+
+		var timeout <-chan time.Time
+		if t := conf.RateLimit.HandshakeTimeout; t > 0 {
+			timeout = time.After(time.Duration(t) * time.Second)
+		}
+
+		// Password changes and two-factor authentication
+		// have their own timeouts.
+		select {
+		case <-cc.readyCh:
+		case <-cc.Closed():
+		case <-timeout:
+			cc.Log("<-", "handshake timeout")
+			cc.Kick("Handshake timed out.")
+		}
+	}()
+
 	cc.Log("->", "connect")
 	go handleClt(cc)
 
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of FailRecords.
+const (
+	LockAddr = "addr" // Login failures of a network address.
+	LockName = "name" // Login failures of an account.
+	LockSudo = "sudo" // Sudo failures of an account.
+	LockTOTP = "totp" // Two-factor authentication failures of an account.
+
+	LockResetCode = "reset" // Invalid password reset codes of an account.
+)
+
+var ErrFailsNotSupported = errors.New("auth backend does not support failure records")
+
+var lockoutMu sync.Mutex
+
+// A FailRecord tracks the authentication failures of a network address
+// or an account. Authentication is blocked until Until
+// if it is in the future.
+type FailRecord struct {
+	Kind  string
+	ID    string
+	Fails int
+	Last  time.Time
+	Until time.Time
+}
+
+// Locked reports whether the FailRecord currently blocks authentication.
+func (r FailRecord) Locked() bool {
+	return time.Now().Before(r.Until)
+}
+
+// A FailRecorder is an AuthBackend that persists FailRecords.
+// The builtin lockout policy is only enforced
+// if the active AuthBackend implements this interface.
+// All bundled backends do.
+type FailRecorder interface {
+	// FailRecord returns the FailRecord of the specified kind and ID.
+	// If it doesn't exist, an empty FailRecord is returned
+	// instead of an error.
+	FailRecord(kind, id string) (FailRecord, error)
+	// SetFailRecord adds or replaces a FailRecord.
+	SetFailRecord(r FailRecord) error
+	// DeleteFailRecord deletes a FailRecord.
+	// Deleting a FailRecord that doesn't exist is not an error.
+	DeleteFailRecord(kind, id string) error
+	// FailRecords returns all FailRecords or an error.
+	FailRecords() ([]FailRecord, error)
+}
+
+// recordFail updates the FailRecords affected by an authentication failure
+// according to the Lockout config. It is used by the bundled
+// AuthBackend implementations to implement RecordFail.
+func recordFail(fr FailRecorder, addr, name string, sudo bool) error {
+	lockoutMu.Lock()
+	defer lockoutMu.Unlock()
+
+	conf := Conf().Lockout
+
+	if sudo {
+		return bumpFail(fr, LockSudo, name, conf.SudoFails)
+	}
+
+	return errors.Join(bumpFail(fr, LockAddr, addr, conf.AddrFails), bumpFail(fr, LockName, name, conf.NameFails))
+}
+
+// bumpFail counts a failure in the FailRecord of the specified kind and ID
+// and locks it once the threshold is reached.
+// The caller must hold lockoutMu.
+func bumpFail(fr FailRecorder, kind, id string, threshold int) error {
+	if threshold <= 0 {
+		return nil
+	}
+
+	r, err := fr.FailRecord(kind, id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Sub(r.Last) > time.Duration(Conf().Lockout.Reset)*time.Second && !r.Locked() {
+		r.Fails = 0
+	}
+
+	r.Kind = kind
+	r.ID = id
+	r.Fails++
+	r.Last = now
+
+	if r.Fails >= threshold {
+		r.Until = now.Add(lockDuration(r.Fails - threshold))
+	}
+
+	return fr.SetFailRecord(r)
+}
+
+// lockDuration returns the duration of a lock after the specified
+// number of failures beyond the threshold. It doubles with every failure.
+func lockDuration(n int) time.Duration {
+	conf := Conf().Lockout
+
+	d := time.Duration(conf.Duration) * time.Second
+	max := time.Duration(conf.MaxDuration) * time.Second
+
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	return d
+}
+
+// lockedUntil returns the time until which authentication attempts
+// of the specified kinds are blocked. It is zero if they aren't.
+// Errors are logged by the caller and don't block authentication.
+func lockedUntil(addr, name string, sudo bool) (time.Time, error) {
+	fr, ok := DefaultAuth().(FailRecorder)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	ids := map[string]string{LockAddr: addr, LockName: name}
+	if sudo {
+		ids = map[string]string{LockSudo: name}
+	}
+
+	var until time.Time
+	for kind, id := range ids {
+		r, err := fr.FailRecord(kind, id)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if r.Locked() && r.Until.After(until) {
+			until = r.Until
+		}
+	}
+
+	return until, nil
+}
+
+// kindLockedUntil returns the time until which the FailRecord
+// of the specified kind and ID blocks authentication.
+// It is zero if it doesn't.
+func kindLockedUntil(kind, id string) (time.Time, error) {
+	fr, ok := DefaultAuth().(FailRecorder)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	r, err := fr.FailRecord(kind, id)
+	if err != nil || !r.Locked() {
+		return time.Time{}, err
+	}
+
+	return r.Until, nil
+}
+
+// clearFails deletes the FailRecord of the account
+// after a successful authentication. The FailRecord of the network
+// address is kept, otherwise attackers could reset it
+// by logging into an account of their own.
+func clearFails(name string, sudo bool) error {
+	fr, ok := DefaultAuth().(FailRecorder)
+	if !ok {
+		return nil
+	}
+
+	lockoutMu.Lock()
+	defer lockoutMu.Unlock()
+
+	if sudo {
+		return fr.DeleteFailRecord(LockSudo, name)
+	}
+
+	return fr.DeleteFailRecord(LockName, name)
+}
+
+// AuthLocks returns all FailRecords that currently block authentication.
+// FailRecords that have expired are deleted.
+func AuthLocks() ([]FailRecord, error) {
+	fr, ok := DefaultAuth().(FailRecorder)
+	if !ok {
+		return nil, ErrFailsNotSupported
+	}
+
+	lockoutMu.Lock()
+	defer lockoutMu.Unlock()
+
+	records, err := fr.FailRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	reset := time.Duration(Conf().Lockout.Reset) * time.Second
+
+	var locks []FailRecord
+	for _, r := range records {
+		if r.Locked() {
+			locks = append(locks, r)
+		} else if time.Since(r.Last) > reset {
+			if err := fr.DeleteFailRecord(r.Kind, r.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Until.Before(locks[j].Until)
+	})
+
+	return locks, nil
+}
+
+// ClearAuthLock deletes the FailRecord of the specified kind and ID,
+// unblocking authentication.
+func ClearAuthLock(kind, id string) error {
+	fr, ok := DefaultAuth().(FailRecorder)
+	if !ok {
+		return ErrFailsNotSupported
+	}
+
+	lockoutMu.Lock()
+	defer lockoutMu.Unlock()
+
+	return fr.DeleteFailRecord(kind, id)
+}
+
+func lockoutMsg(until time.Time) string {
+	return fmt.Sprintf("Too many failed authentication attempts. Try again in %s.", time.Until(until).Round(time.Second))
+}
+
+func init() {
+	registerCoreChatCmd(ChatCmd{
+		Name:  "lockouts",
+		Perm:  "cmd.lockouts",
+		Help:  "List network addresses and accounts that are locked out due to authentication failures.",
+		Usage: "lockouts",
+		Handler: func(cc *ClientConn, args ...string) string {
+			locks, err := AuthLocks()
+			if err != nil {
+				return "Could not list lockouts: " + err.Error()
+			}
+
+			if len(locks) == 0 {
+				return "No lockouts."
+			}
+
+			b := &strings.Builder{}
+			b.WriteString("Lockouts:")
+			for _, r := range locks {
+				fmt.Fprintf(b, "\n%s %s: %d failures, %s left", r.Kind, r.ID, r.Fails, time.Until(r.Until).Round(time.Second))
+			}
+
+			return b.String()
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "unlock",
+		Perm:  "cmd.unlock",
+		Help:  "Clear the authentication failures of a network address or account.",
+		Usage: "unlock <addr | name | sudo | totp | reset> <id>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 2 {
+				return "Usage: unlock <addr | name | sudo | totp | reset> <id>"
+			}
+
+			switch args[0] {
+			case LockAddr, LockName, LockSudo, LockTOTP, LockResetCode:
+			default:
+				return "Invalid kind " + args[0] + "."
+			}
+
+			if err := ClearAuthLock(args[0], args[1]); err != nil {
+				return "Could not clear lockout: " + err.Error()
+			}
+
+			cc.Log("<-", "unlock", args[0], args[1])
+			return "Lockout cleared."
+		},
+	})
+}
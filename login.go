@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/HimbeerserverDE/mt"
+)
+
+// finishLogin completes the initialization of the ClientConn
+// unless it has to fill in a formspec first, i.e. to set a new password
+// or for two-factor authentication. In that case the ClientConn stays
+// in limbo: It isn't connected to any server and can't send chat messages
+// or commands. finishLogin is called again once the formspec is completed.
+// The join handlers only run once the login is complete.
+func (cc *ClientConn) finishLogin() {
+	if cc.requirePasswdChange() || cc.requireTOTP() {
+		cc.limbo.Store(true)
+		return
+	}
+
+	cc.limbo.Store(false)
+	handleJoin(cc)
+
+	close(cc.initCh)
+}
+
+// loggedIn reports whether the ClientConn has completed its login,
+// including any password change or two-factor authentication.
+func (cc *ClientConn) loggedIn() bool {
+	select {
+	case <-cc.initCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// loginCmd reports whether a command may be processed
+// before the login is complete. Anything else could be used
+// to interact with the proxy without passing every login step.
+func loginCmd(cmd mt.Cmd) bool {
+	switch cmd.(type) {
+	case *mt.ToSrvNil, *mt.ToSrvInit, *mt.ToSrvFirstSRP,
+		*mt.ToSrvSRPBytesA, *mt.ToSrvSRPBytesM, *mt.ToSrvInit2,
+		*mt.ToSrvReqMedia, *mt.ToSrvCltReady, *mt.ToSrvCltInfo:
+		return true
+	default:
+		return false
+	}
+}
+
+// limboTimeout kicks the ClientConn with the specified message
+// if step isn't closed within the specified number of seconds.
+func (cc *ClientConn) limboTimeout(step <-chan struct{}, seconds int, msg string) {
+	select {
+	case <-cc.Closed():
+	case <-step:
+	case <-time.After(time.Duration(seconds) * time.Second):
+		cc.Log("<-", "limbo timeout")
+		cc.Kick(msg)
+	}
+}
+
+// limboForm reports whether the ClientConn may submit a formspec
+// while in limbo.
+func limboForm(formname string) bool {
+	return formname == passwdFormname || formname == totpFormname
+}
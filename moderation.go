@@ -1,11 +1,16 @@
 package proxy
 
 import (
+	"log"
 	"net"
+	"time"
 
 	"github.com/HimbeerserverDE/mt"
 )
 
+// banCleanInterval is the interval at which expired bans are deleted.
+const banCleanInterval = time.Hour
+
 // Kick sends mt.ToCltKick with the specified custom reason
 // and closes the ClientConn.
 func (cc *ClientConn) Kick(reason string) {
@@ -26,7 +31,89 @@ func (cc *ClientConn) Kick(reason string) {
 // Ban disconnects the ClientConn and prevents the underlying
 // network address from connecting again.
 func (cc *ClientConn) Ban() error {
-	cc.Kick("Banned by proxy.")
-	ip := cc.RemoteAddr().(*net.UDPAddr).IP.String()
-	return DefaultAuth().Ban(ip, cc.name)
+	return cc.BanFor(0, "", "")
+}
+
+// BanFor disconnects the ClientConn and prevents the underlying
+// network address from connecting again for the specified duration.
+// A duration of zero makes the ban permanent. The reason is shown
+// to the player and the issuer is usually the name of the moderator.
+// The AuthBackend must implement BanInfoBackend to store the details,
+// otherwise they are discarded and the ban is permanent.
+func (cc *ClientConn) BanFor(d time.Duration, reason, issuer string) error {
+	b := Ban{
+		Addr:    cc.RemoteAddr().(*net.UDPAddr).IP.String(),
+		Name:    cc.name,
+		Reason:  reason,
+		Issuer:  issuer,
+		Created: time.Now(),
+	}
+
+	if d > 0 {
+		b.Expiry = b.Created.Add(d)
+	}
+
+	cc.Kick(b.Message())
+
+	if bib, ok := DefaultAuth().(BanInfoBackend); ok {
+		return bib.AddBan(b)
+	}
+
+	return DefaultAuth().Ban(b.Addr, b.Name)
+}
+
+// banEntry returns the ban entry that prevents a network address
+// or username from connecting, including range and pattern bans.
+// Error cases count as banned.
+func banEntry(addr, name string) (Ban, bool) {
+	if bib, ok := DefaultAuth().(BanInfoBackend); ok {
+		b, banned, err := bib.BanEntry(addr, name)
+		if err != nil || banned {
+			return b, true
+		}
+	} else if DefaultAuth().Banned(addr, name) {
+		return Ban{Addr: addr, Name: name}, true
+	}
+
+	m, err := currentBanMatcher()
+	if err != nil {
+		return Ban{Addr: addr, Name: name}, true
+	}
+
+	return m.match(addr, name)
+}
+
+// cleanBans periodically deletes expired bans
+// if the AuthBackend implements BanInfoBackend and BanLister.
+func cleanBans() {
+	for {
+		time.Sleep(banCleanInterval)
+
+		if _, ok := DefaultAuth().(BanInfoBackend); !ok {
+			return
+		}
+
+		bl, ok := DefaultAuth().(BanLister)
+		if !ok {
+			return
+		}
+
+		bans, err := bl.Bans()
+		if err != nil {
+			log.Print("clean bans: ", err)
+			continue
+		}
+
+		for _, b := range bans {
+			if !b.Expired() {
+				continue
+			}
+
+			if err := DefaultAuth().Unban(b.Addr); err != nil {
+				log.Print("clean bans: ", err)
+			}
+		}
+
+		invalidateBanMatcher()
+	}
 }
@@ -0,0 +1,458 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HimbeerserverDE/mt"
+)
+
+const passwdFormname = "mt_multiserver_proxy:passwd"
+
+var ErrPasswdResetNotSupported = errors.New("auth backend does not support password resets")
+
+// A PasswdReset requires a user to set a new password on their next login.
+// If it has a Code, the old password isn't needed: The user chooses
+// a new password when logging in and then has to enter the one-time
+// reset code. Otherwise the user logs in as usual and has to reconnect
+// and choose a new password before being connected to a server.
+type PasswdReset struct {
+	Name string
+	// Code is the SHA-256 hash of the reset code.
+	Code    []byte
+	Issuer  string
+	Created time.Time
+	Expiry  time.Time
+}
+
+// Expired reports whether the PasswdReset has expired.
+// PasswdResets without an Expiry never expire.
+func (r PasswdReset) Expired() bool {
+	return !r.Expiry.IsZero() && time.Now().After(r.Expiry)
+}
+
+// A PasswdResetBackend is an AuthBackend that stores PasswdResets.
+// Password resets are only available if the active AuthBackend
+// implements this interface. All bundled backends do.
+type PasswdResetBackend interface {
+	// PasswdReset returns the PasswdReset of a user
+	// and whether it exists.
+	PasswdReset(name string) (PasswdReset, bool, error)
+	// SetPasswdReset adds or replaces the PasswdReset of an existing user.
+	SetPasswdReset(r PasswdReset) error
+	// DeletePasswdReset deletes the PasswdReset of a user.
+	// Deleting a PasswdReset that doesn't exist is not an error.
+	DeletePasswdReset(name string) error
+}
+
+// ForcePasswdChange requires a user to change their password
+// on their next login. The issuer is usually the name of the moderator.
+func ForcePasswdChange(name, issuer string) error {
+	prb, ok := DefaultAuth().(PasswdResetBackend)
+	if !ok {
+		return ErrPasswdResetNotSupported
+	}
+
+	return prb.SetPasswdReset(PasswdReset{
+		Name:    name,
+		Issuer:  issuer,
+		Created: time.Now(),
+	})
+}
+
+// NewPasswdResetCode returns a one-time code that allows a user
+// to set a new password without knowing the old one.
+// The code expires according to the PasswdPolicy config.
+// Only its hash is stored, so it can't be retrieved later.
+// The issuer is usually the name of the moderator.
+func NewPasswdResetCode(name, issuer string) (string, error) {
+	prb, ok := DefaultAuth().(PasswdResetBackend)
+	if !ok {
+		return "", ErrPasswdResetNotSupported
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := totpEncoding.EncodeToString(b)[:10]
+	code = code[:5] + "-" + code[5:]
+
+	r := PasswdReset{
+		Name:    name,
+		Code:    hashResetCode(code),
+		Issuer:  issuer,
+		Created: time.Now(),
+	}
+
+	if expiry := Conf().PasswdPolicy.ResetCodeExpiry; expiry > 0 {
+		r.Expiry = r.Created.Add(time.Duration(expiry) * time.Second)
+	}
+
+	if err := prb.SetPasswdReset(r); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// CancelPasswdReset deletes the pending PasswdReset of a user.
+func CancelPasswdReset(name string) error {
+	prb, ok := DefaultAuth().(PasswdResetBackend)
+	if !ok {
+		return ErrPasswdResetNotSupported
+	}
+
+	return prb.DeletePasswdReset(name)
+}
+
+// hashResetCode returns the hash of a reset code.
+// Case, spaces and dashes are ignored.
+func hashResetCode(code string) []byte {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer(" ", "", "-", "").Replace(code)
+
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}
+
+// checkPasswdReset looks up the PasswdReset of the ClientConn
+// and whether its password has expired according to the PasswdPolicy
+// config. It must be called before the password of the ClientConn
+// is read because that updates its Timestamp.
+// It reports whether the FirstSRP authentication method
+// has to be used, i.e. if the ClientConn is logging in
+// using a reset code or has a passwdTicket.
+func (cc *ClientConn) checkPasswdReset() bool {
+	if maxAge := Conf().PasswdPolicy.MaxAge; maxAge > 0 {
+		ts, err := DefaultAuth().Timestamp(cc.Name())
+		if err == nil && time.Since(ts) > time.Duration(maxAge)*time.Second {
+			cc.Log("<-", "password expired")
+			cc.passwd.expired = true
+		}
+	}
+
+	if prb, ok := DefaultAuth().(PasswdResetBackend); ok {
+		r, ok, err := prb.PasswdReset(cc.Name())
+		if err != nil {
+			cc.Log("<-", "get password reset:", err)
+		} else if ok && r.Expired() {
+			if err := prb.DeletePasswdReset(cc.Name()); err != nil {
+				cc.Log("<-", "delete password reset:", err)
+			}
+		} else if ok {
+			cc.passwd.reset = &r
+		}
+	}
+
+	if cc.resettingPasswd() {
+		return true
+	}
+
+	if cc.mustChangePasswd() && hasPasswdTicket(cc.Name(), cc.RemoteAddr().(*net.UDPAddr).IP.String()) {
+		cc.Log("<-", "allow password change")
+		cc.passwd.change = true
+		return true
+	}
+
+	return false
+}
+
+// resettingPasswd reports whether the ClientConn is logging in
+// using a reset code.
+func (cc *ClientConn) resettingPasswd() bool {
+	return cc.passwd.reset != nil && len(cc.passwd.reset.Code) > 0
+}
+
+// mustChangePasswd reports whether the ClientConn has to change
+// its password after logging in with the current one.
+func (cc *ClientConn) mustChangePasswd() bool {
+	return cc.passwd.expired || (cc.passwd.reset != nil && !cc.resettingPasswd())
+}
+
+// requirePasswdReconnect is called after the ClientConn has logged in
+// with its current password if it has to change it. The proxy never
+// sees passwords, so the client has to reconnect and choose
+// a new password as if it was registering. This is only allowed
+// because it has proven to know the current password.
+func (cc *ClientConn) requirePasswdReconnect() {
+	ip := cc.RemoteAddr().(*net.UDPAddr).IP.String()
+	timeout := time.Duration(Conf().PasswdPolicy.Timeout) * time.Second
+
+	issuePasswdTicket(cc.Name(), ip, timeout)
+
+	var reason string
+	if cc.passwd.reset != nil {
+		reason = "Your password has been reset."
+	} else {
+		reason = "Your password has expired."
+	}
+
+	cc.Log("<-", "require password change")
+	cc.Kick(fmt.Sprintf("%s Please reconnect within %s using a new password.", reason, timeout))
+}
+
+// A passwdTicket allows a client to choose a new password
+// using the FirstSRP authentication method when it reconnects
+// from the same network address before the expiry.
+// Tickets are only kept in memory.
+type passwdTicket struct {
+	addr   string
+	expiry time.Time
+}
+
+var (
+	passwdTickets   = make(map[string]passwdTicket)
+	passwdTicketsMu sync.Mutex
+)
+
+func issuePasswdTicket(name, addr string, d time.Duration) {
+	passwdTicketsMu.Lock()
+	defer passwdTicketsMu.Unlock()
+
+	for n, t := range passwdTickets {
+		if time.Now().After(t.expiry) {
+			delete(passwdTickets, n)
+		}
+	}
+
+	passwdTickets[name] = passwdTicket{
+		addr:   addr,
+		expiry: time.Now().Add(d),
+	}
+}
+
+func hasPasswdTicket(name, addr string) bool {
+	passwdTicketsMu.Lock()
+	defer passwdTicketsMu.Unlock()
+
+	t, ok := passwdTickets[name]
+	return ok && t.addr == addr && time.Now().Before(t.expiry)
+}
+
+func deletePasswdTicket(name string) {
+	passwdTicketsMu.Lock()
+	defer passwdTicketsMu.Unlock()
+
+	delete(passwdTickets, name)
+}
+
+// passwdChanged deletes the pending PasswdReset of the ClientConn
+// after it has changed its password.
+func (cc *ClientConn) passwdChanged() {
+	cc.passwd.expired = false
+	cc.passwd.change = false
+
+	deletePasswdTicket(cc.Name())
+
+	if cc.passwd.reset == nil {
+		return
+	}
+
+	cc.passwd.reset = nil
+	if err := CancelPasswdReset(cc.Name()); err != nil {
+		cc.Log("<-", "delete password reset:", err)
+	}
+}
+
+// requirePasswdChange asks the ClientConn for its reset code
+// if necessary. It reports whether this is the case.
+func (cc *ClientConn) requirePasswdChange() bool {
+	if cc.passwd.done || !cc.resettingPasswd() {
+		return false
+	}
+
+	cc.Log("<-", "require reset code")
+
+	cc.passwd.step = make(chan struct{})
+	go cc.limboTimeout(cc.passwd.step, Conf().PasswdPolicy.Timeout, "Password reset timed out.")
+
+	cc.showPasswdForm("")
+	return true
+}
+
+// showPasswdForm shows the formspec asking for the reset code.
+func (cc *ClientConn) showPasswdForm(errMsg string) {
+	b := &strings.Builder{}
+
+	b.WriteString("formspec_version[4]size[10,4]")
+	b.WriteString("label[0.5,0.6;Enter the reset code you received from the staff.]")
+
+	if errMsg != "" {
+		fmt.Fprintf(b, "label[0.5,1.3;%s]", FormspecEscape(Colorize(errMsg, "#F00")))
+	}
+
+	b.WriteString("field[0.5,2.4;4,0.8;code;Reset code;]")
+	b.WriteString("field_close_on_enter[code;false]")
+	b.WriteString("button[5,2.4;4.5,0.8;submit;Reset password]")
+
+	cc.ShowFormspec(passwdFormname, b.String())
+}
+
+func handlePasswdFields(cc *ClientConn, fields []mt.Field) {
+	if cc.passwd.step == nil || cc.passwd.done {
+		return
+	}
+
+	values := make(map[string]string)
+	for _, field := range fields {
+		values[field.Name] = field.Value
+	}
+
+	_, submit := values["submit"]
+	_, enter := values["key_enter_field"]
+	if !submit && !enter {
+		cc.showPasswdForm("")
+		return
+	}
+
+	if !cc.submitResetCode(values["code"]) {
+		return
+	}
+
+	cc.ShowFormspec(passwdFormname, "")
+
+	cc.passwd.done = true
+	close(cc.passwd.step)
+
+	cc.finishLogin()
+}
+
+// submitResetCode sets the password the ClientConn chose
+// while logging in if the reset code is valid.
+// Otherwise the ClientConn is kicked.
+// It reports whether the password has been set.
+func (cc *ClientConn) submitResetCode(code string) bool {
+	ip := cc.RemoteAddr().(*net.UDPAddr).IP.String()
+
+	if subtle.ConstantTimeCompare(hashResetCode(code), cc.passwd.reset.Code) != 1 {
+		if err := recordResetCodeFail(ip, cc.Name()); err != nil {
+			cc.Log("<-", "record reset code fail:", err)
+		}
+
+		cc.Log("<-", "invalid reset code")
+		cc.Kick("Invalid reset code.")
+		return false
+	}
+
+	if err := DefaultAuth().SetPasswd(cc.Name(), cc.passwd.salt, cc.passwd.verifier); err != nil {
+		cc.Log("<-", "set password fail:", err)
+		cc.Kick("Could not reset your password. Please try again later.")
+		return false
+	}
+
+	if err := clearFails(cc.Name(), false); err != nil {
+		cc.Log("<-", "clear auth fails:", err)
+	}
+
+	if err := ClearAuthLock(LockResetCode, cc.Name()); err != nil && !errors.Is(err, ErrFailsNotSupported) {
+		cc.Log("<-", "clear reset code fails:", err)
+	}
+
+	cc.passwd.salt, cc.passwd.verifier = nil, nil
+	cc.passwdChanged()
+
+	cc.Log("->", "reset password")
+	cc.SendChatMsg("Password reset successful.")
+	return true
+}
+
+// recordResetCodeFail counts an invalid reset code.
+// It is tracked separately from other login failures of the account
+// so that attackers can't lock its owner out by guessing codes.
+func recordResetCodeFail(addr, name string) error {
+	fr, ok := DefaultAuth().(FailRecorder)
+	if !ok {
+		return nil
+	}
+
+	lockoutMu.Lock()
+	defer lockoutMu.Unlock()
+
+	conf := Conf().Lockout
+	return errors.Join(bumpFail(fr, LockAddr, addr, conf.AddrFails), bumpFail(fr, LockResetCode, name, conf.ResetFails))
+}
+
+func init() {
+	RegisterOnPlayerReceiveFields(passwdFormname, handlePasswdFields)
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "forcepasswd",
+		Perm:  "cmd.forcepasswd",
+		Help:  "Require a player to change their password on their next login.",
+		Usage: "forcepasswd <name>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 1 {
+				return "Usage: forcepasswd <name>"
+			}
+
+			if !DefaultAuth().Exists(args[0]) {
+				return "Could not force password change: " + ErrNoSuchUser.Error()
+			}
+
+			if err := ForcePasswdChange(args[0], cc.Name()); err != nil {
+				return "Could not force password change: " + err.Error()
+			}
+
+			cc.Log("<-", "force password change", args[0])
+			return "Password change required on next login."
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "resetcode",
+		Perm:  "cmd.resetcode",
+		Help:  "Create a one-time code allowing a player to set a new password without knowing the old one.",
+		Usage: "resetcode <name>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 1 {
+				return "Usage: resetcode <name>"
+			}
+
+			if !DefaultAuth().Exists(args[0]) {
+				return "Could not create reset code: " + ErrNoSuchUser.Error()
+			}
+
+			code, err := NewPasswdResetCode(args[0], cc.Name())
+			if err != nil {
+				return "Could not create reset code: " + err.Error()
+			}
+
+			cc.Log("<-", "create reset code", args[0])
+
+			msg := "Reset code for " + args[0] + ": " + code
+			if expiry := Conf().PasswdPolicy.ResetCodeExpiry; expiry > 0 {
+				msg += fmt.Sprintf(" (valid for %s)", time.Duration(expiry)*time.Second)
+			}
+
+			return msg
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "cancelreset",
+		Perm:  "cmd.cancelreset",
+		Help:  "Cancel a pending password reset or reset code.",
+		Usage: "cancelreset <name>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 1 {
+				return "Usage: cancelreset <name>"
+			}
+
+			if err := CancelPasswdReset(args[0]); err != nil {
+				return "Could not cancel password reset: " + err.Error()
+			}
+
+			cc.Log("<-", "cancel password reset", args[0])
+			return "Password reset cancelled."
+		},
+	})
+}
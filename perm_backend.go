@@ -0,0 +1,568 @@
+package proxy
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of permission holders.
+const (
+	PermUser  = "user"  // Permissions granted to a single user.
+	PermGroup = "group" // Permissions granted to all members of a group.
+
+	// PermMember is the kind of temporary group memberships.
+	PermMember = "member"
+)
+
+var permIface PermissionBackend
+
+var (
+	ErrPermBackendExists = errors.New("permission backend already set")
+	ErrNoPermBackend     = errors.New("no permission backend")
+	ErrInvalidPermKind   = errors.New("invalid permission kind")
+	ErrInvalidPerm       = errors.New("invalid permission or group name")
+)
+
+// A PermissionBackend stores permissions and group memberships
+// that can be edited at runtime. They complement the Groups
+// and UserGroups config options. Changes take effect immediately.
+// All methods are safe for concurrent use.
+type PermissionBackend interface {
+	// UserGroups returns the groups the user with the specified name
+	// has been added to.
+	UserGroups(name string) ([]string, error)
+	// AddUserGroup adds a user to a group.
+	// Adding a user to a group twice is not an error.
+	AddUserGroup(name, group string) error
+	// RemoveUserGroup removes a user from a group.
+	// Removing a user from a group they're not in is not an error.
+	RemoveUserGroup(name, group string) error
+	// Perms returns the permissions granted to a user or group.
+	// The kind is either PermUser or PermGroup.
+	Perms(kind, id string) ([]string, error)
+	// Grant grants a permission to a user or group.
+	// Granting a permission twice is not an error.
+	Grant(kind, id, perm string) error
+	// Revoke revokes a permission from a user or group.
+	// Revoking a permission that hasn't been granted is not an error.
+	Revoke(kind, id, perm string) error
+}
+
+// DefaultPermBackend returns the active permission backend.
+// It is nil before the proxy is initialized.
+func DefaultPermBackend() PermissionBackend {
+	return permIface
+}
+
+func setPermBackend(pb PermissionBackend) error {
+	if permIface != nil {
+		return ErrPermBackendExists
+	}
+
+	permIface = pb
+	return nil
+}
+
+// GrantPerm grants a permission to a user or group at runtime.
+// Granting a permission that has been granted temporarily
+// makes it permanent.
+func GrantPerm(kind, id, perm string) error {
+	return grantPerm(kind, id, perm, "")
+}
+
+// RevokePerm revokes a permission that has been granted
+// using GrantPerm or GrantTempPerm.
+// Permissions set in the config can't be revoked.
+func RevokePerm(kind, id, perm string) error {
+	return revokePerm(kind, id, perm, "")
+}
+
+// AddUserGroup adds a user to a permission group at runtime.
+// Adding a user to a group they have been added to temporarily
+// makes the membership permanent.
+func AddUserGroup(name, group string) error {
+	return addUserGroup(name, group, "")
+}
+
+// RemoveUserGroup removes a user from a permission group
+// they have been added to using AddUserGroup or AddTempUserGroup.
+// Groups set in the config can't be removed.
+func RemoveUserGroup(name, group string) error {
+	return removeUserGroup(name, group, "")
+}
+
+func grantPerm(kind, id, perm, issuer string) error {
+	if err := checkPermArgs(kind, id, perm); err != nil {
+		return err
+	}
+
+	permWriteMu.Lock()
+	defer permWriteMu.Unlock()
+
+	err := DefaultPermBackend().Grant(kind, id, perm)
+	invalidatePermCache()
+	if err != nil {
+		return err
+	}
+
+	auditPerm("grant", issuer, kind, id, perm, time.Time{})
+	go SyncPrivs()
+
+	return forgetTempGrant(kind, id, perm)
+}
+
+func revokePerm(kind, id, perm, issuer string) error {
+	if err := checkPermArgs(kind, id, perm); err != nil {
+		return err
+	}
+
+	permWriteMu.Lock()
+	defer permWriteMu.Unlock()
+
+	err := DefaultPermBackend().Revoke(kind, id, perm)
+	invalidatePermCache()
+	if err != nil {
+		return err
+	}
+
+	auditPerm("revoke", issuer, kind, id, perm, time.Time{})
+	go SyncPrivs()
+
+	return forgetTempGrant(kind, id, perm)
+}
+
+func addUserGroup(name, group, issuer string) error {
+	if err := checkPermArgs(PermUser, name, group); err != nil {
+		return err
+	}
+
+	permWriteMu.Lock()
+	defer permWriteMu.Unlock()
+
+	err := DefaultPermBackend().AddUserGroup(name, group)
+	invalidatePermCache()
+	if err != nil {
+		return err
+	}
+
+	auditPerm("add", issuer, PermMember, name, group, time.Time{})
+	go SyncPrivs()
+
+	return forgetTempGrant(PermMember, name, group)
+}
+
+func removeUserGroup(name, group, issuer string) error {
+	if err := checkPermArgs(PermUser, name, group); err != nil {
+		return err
+	}
+
+	permWriteMu.Lock()
+	defer permWriteMu.Unlock()
+
+	err := DefaultPermBackend().RemoveUserGroup(name, group)
+	invalidatePermCache()
+	if err != nil {
+		return err
+	}
+
+	auditPerm("remove", issuer, PermMember, name, group, time.Time{})
+	go SyncPrivs()
+
+	return forgetTempGrant(PermMember, name, group)
+}
+
+// moveUserPerms moves the permissions, group memberships
+// and temporary grants of a user to a new name.
+// If the new name is empty they are deleted instead.
+// Permissions and groups assigned by the config are left alone.
+func moveUserPerms(name, newName string) error {
+	pb := DefaultPermBackend()
+	if pb == nil {
+		return nil
+	}
+
+	permWriteMu.Lock()
+	defer permWriteMu.Unlock()
+
+	defer invalidatePermCache()
+
+	if tgb, ok := pb.(TempGrantBackend); ok {
+		tgs, err := tgb.TempGrants()
+		if err != nil {
+			return err
+		}
+
+		for _, tg := range tgs {
+			if tg.Kind == PermGroup || tg.ID != name {
+				continue
+			}
+
+			if newName != "" {
+				moved := tg
+				moved.ID = newName
+				if err := tgb.SetTempGrant(moved); err != nil {
+					return err
+				}
+
+				tempGrantsMu.Lock()
+				tempGrants[moved.key()] = moved
+				tempGrantsMu.Unlock()
+			}
+
+			if err := tgb.DeleteTempGrant(tg.Kind, tg.ID, tg.Perm); err != nil {
+				return err
+			}
+
+			tempGrantsMu.Lock()
+			delete(tempGrants, tg.key())
+			tempGrantsMu.Unlock()
+		}
+	}
+
+	perms, err := pb.Perms(PermUser, name)
+	if err != nil {
+		return err
+	}
+
+	for _, perm := range perms {
+		if newName != "" {
+			if err := pb.Grant(PermUser, newName, perm); err != nil {
+				return err
+			}
+		}
+
+		if err := pb.Revoke(PermUser, name, perm); err != nil {
+			return err
+		}
+	}
+
+	groups, err := pb.UserGroups(name)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if newName != "" {
+			if err := pb.AddUserGroup(newName, group); err != nil {
+				return err
+			}
+		}
+
+		if err := pb.RemoveUserGroup(name, group); err != nil {
+			return err
+		}
+	}
+
+	go SyncPrivs()
+	return nil
+}
+
+func checkPermArgs(kind, id, perm string) error {
+	if DefaultPermBackend() == nil {
+		return ErrNoPermBackend
+	}
+
+	if kind != PermUser && kind != PermGroup {
+		return ErrInvalidPermKind
+	}
+
+	if !validPermName(id) || !validPermName(perm) {
+		return ErrInvalidPerm
+	}
+
+	return nil
+}
+
+func validPermName(s string) bool {
+	return strings.TrimPrefix(s, "-") != "" && !strings.ContainsAny(s, " \t\r\n")
+}
+
+// checkGrant returns why a player may not grant or revoke a raw permission
+// to or from a user or group. It returns an empty string if they may.
+// Players can't grant permissions to themselves, otherwise they could
+// keep permissions of groups they are removed from later.
+// Deny entries can only be granted to users or groups
+// whose permissions the player all has.
+func checkGrant(issuer, kind, id, perm string, revoke bool) string {
+	if !revoke && kind == PermUser && strings.EqualFold(id, issuer) {
+		return "You can't grant permissions to yourself."
+	}
+
+	if !canGrantPerm(issuer, perm) {
+		if revoke {
+			return "You can't revoke permissions you don't have."
+		}
+
+		return "You can't grant permissions you don't have."
+	}
+
+	if strings.HasPrefix(perm, "-") && !revoke {
+		var perms []string
+		if kind == PermUser {
+			perms = PlayerPerms(id)
+		} else {
+			perms = InheritedGroupPerms(id)
+		}
+
+		for _, perm := range grantedPerms(perms) {
+			if !canGrantPerm(issuer, perm) {
+				return "You can only grant deny entries to users or groups whose permissions you all have."
+			}
+		}
+	}
+
+	return ""
+}
+
+// checkGroupGrant returns why a player may not add a user to a group
+// or remove them from it. It returns an empty string if they may.
+// Players need all permissions of the group, including inherited ones.
+func checkGroupGrant(issuer, name, group string, remove bool) string {
+	if !remove && strings.EqualFold(name, issuer) {
+		return "You can't add yourself to groups."
+	}
+
+	for _, perm := range grantedPerms(InheritedGroupPerms(group)) {
+		if !canGrantPerm(issuer, perm) {
+			if remove {
+				return "You can't revoke permissions you don't have."
+			}
+
+			return "You can't grant permissions you don't have."
+		}
+	}
+
+	return ""
+}
+
+// canGrantPerm reports whether a player has everything a raw permission
+// grants network-wide. Wildcards are checked against the deny entries
+// of the player, so "*" can't be granted by players who are denied
+// any permission.
+func canGrantPerm(name, raw string) bool {
+	pattern := strings.TrimPrefix(raw, "-")
+	if !ExplainPerm(name, "", pattern).Granted {
+		return false
+	}
+
+	scope, perm, scoped := parseScope(pattern)
+	for _, entry := range PlayerPerms(name) {
+		deny, ok := strings.CutPrefix(entry, "-")
+		if !ok {
+			continue
+		}
+
+		denyScope, denyPerm, denyScoped := parseScope(deny)
+
+		overlap, ok := permOverlap(perm, denyPerm)
+		if !ok {
+			continue
+		}
+
+		if scoped {
+			overlap = scope + "/" + overlap
+		} else if denyScoped {
+			overlap = denyScope + "/" + overlap
+		}
+
+		if !ExplainPerm(name, "", overlap).Granted {
+			return false
+		}
+	}
+
+	return true
+}
+
+// permOverlap returns the most general permission matched
+// by both of the specified raw permissions without deny prefix
+// and whether there is one.
+func permOverlap(a, b string) (string, bool) {
+	prefixA, wildA := strings.CutSuffix(a, "*")
+	prefixB, wildB := strings.CutSuffix(b, "*")
+
+	switch {
+	case !wildA && !wildB:
+		return a, a == b
+	case !wildA:
+		return a, strings.HasPrefix(a, prefixB)
+	case !wildB:
+		return b, strings.HasPrefix(b, prefixA)
+	case strings.HasPrefix(prefixA, prefixB):
+		return a, true
+	case strings.HasPrefix(prefixB, prefixA):
+		return b, true
+	default:
+		return "", false
+	}
+}
+
+// grantedPerms returns the raw permissions that aren't deny entries.
+func grantedPerms(perms []string) []string {
+	var granted []string
+	for _, perm := range perms {
+		if !strings.HasPrefix(perm, "-") {
+			granted = append(granted, perm)
+		}
+	}
+
+	return granted
+}
+
+// queryStrings returns the first column of all rows
+// returned by a query. It is used by the SQL permission backends.
+func queryStrings(db *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+
+		out = append(out, s)
+	}
+
+	return out, rows.Err()
+}
+
+func init() {
+	registerCoreChatCmd(ChatCmd{
+		Name:  "grant",
+		Perm:  "cmd.grant",
+		Help:  "Grant a permission you have to a user or group.",
+		Usage: "grant <user | group> <name> <permission>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 3 {
+				return "Usage: grant <user | group> <name> <permission>"
+			}
+
+			if msg := checkGrant(cc.Name(), args[0], args[1], args[2], false); msg != "" {
+				return msg
+			}
+
+			if err := grantPerm(args[0], args[1], args[2], cc.Name()); err != nil {
+				return "Could not grant permission: " + err.Error()
+			}
+
+			cc.Log("<-", "grant", args[0], args[1], args[2])
+			return "Permission granted."
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "revoke",
+		Perm:  "cmd.revoke",
+		Help:  "Revoke a permission you have from a user or group.",
+		Usage: "revoke <user | group> <name> <permission>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 3 {
+				return "Usage: revoke <user | group> <name> <permission>"
+			}
+
+			if msg := checkGrant(cc.Name(), args[0], args[1], args[2], true); msg != "" {
+				return msg
+			}
+
+			if err := revokePerm(args[0], args[1], args[2], cc.Name()); err != nil {
+				return "Could not revoke permission: " + err.Error()
+			}
+
+			cc.Log("<-", "revoke", args[0], args[1], args[2])
+			return "Permission revoked."
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "addgroup",
+		Perm:  "cmd.addgroup",
+		Help:  "Add a user to a permission group whose permissions you have.",
+		Usage: "addgroup <name> <group>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 2 {
+				return "Usage: addgroup <name> <group>"
+			}
+
+			if msg := checkGroupGrant(cc.Name(), args[0], args[1], false); msg != "" {
+				return msg
+			}
+
+			if err := addUserGroup(args[0], args[1], cc.Name()); err != nil {
+				return "Could not add user to group: " + err.Error()
+			}
+
+			cc.Log("<-", "add", args[0], "to group", args[1])
+			return "User added to group."
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "rmgroup",
+		Perm:  "cmd.rmgroup",
+		Help:  "Remove a user from a permission group whose permissions you have.",
+		Usage: "rmgroup <name> <group>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 2 {
+				return "Usage: rmgroup <name> <group>"
+			}
+
+			if msg := checkGroupGrant(cc.Name(), args[0], args[1], true); msg != "" {
+				return msg
+			}
+
+			if err := removeUserGroup(args[0], args[1], cc.Name()); err != nil {
+				return "Could not remove user from group: " + err.Error()
+			}
+
+			cc.Log("<-", "remove", args[0], "from group", args[1])
+			return "User removed from group."
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "perms",
+		Perm:  "cmd.perms",
+		Help:  "Show the permission groups and permissions of a player or yourself.",
+		Usage: "perms [name]",
+		Handler: func(cc *ClientConn, args ...string) string {
+			name := cc.Name()
+			if len(args) > 0 {
+				name = args[0]
+			}
+
+			perms := PlayerPerms(name)
+			sort.Strings(perms)
+
+			return fmt.Sprintf("Groups of %s: %s\nPermissions: %s", name, strings.Join(PlayerGroups(name), ", "), strings.Join(perms, ", "))
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "explainperm",
+		Perm:  "cmd.explainperm",
+		Help:  "Explain why a player has or doesn't have a permission on a server. Defaults to the current server of the player.",
+		Usage: "explainperm <name> <permission> [server]",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) < 2 || len(args) > 3 {
+				return "Usage: explainperm <name> <permission> [server]"
+			}
+
+			var srv string
+			if len(args) == 3 {
+				srv = args[2]
+			} else if clt := Find(args[0]); clt != nil {
+				srv = clt.ServerName()
+			}
+
+			return ExplainPerm(args[0], srv, args[1]).String()
+		},
+	})
+}
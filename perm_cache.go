@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// permCacheTTL is the time for which results of the permission backend
+// are cached. Changes made through this proxy invalidate the cache
+// immediately. Changes made by other proxies sharing the backend
+// take effect after at most this time.
+const permCacheTTL = 30 * time.Second
+
+type permCacheKey struct {
+	kind, id string
+}
+
+type permCacheEntry struct {
+	perms   []string
+	fetched time.Time
+}
+
+var (
+	permCache    = make(map[permCacheKey]permCacheEntry)
+	permCacheGen uint64
+	permCacheMu  sync.Mutex
+)
+
+// cachedPerms returns the permissions of a user or group
+// or, if the kind is PermMember, the groups of a user
+// as returned by the permission backend.
+// Errors aren't cached.
+func cachedPerms(pb PermissionBackend, kind, id string) ([]string, error) {
+	key := permCacheKey{kind, id}
+
+	permCacheMu.Lock()
+	entry, ok := permCache[key]
+	gen := permCacheGen
+	permCacheMu.Unlock()
+
+	if ok && time.Since(entry.fetched) < permCacheTTL {
+		return entry.perms, nil
+	}
+
+	fetched := time.Now()
+
+	var perms []string
+	var err error
+	if kind == PermMember {
+		perms, err = pb.UserGroups(id)
+	} else {
+		perms, err = pb.Perms(kind, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	permCacheMu.Lock()
+	defer permCacheMu.Unlock()
+
+	// The result may be outdated if the cache
+	// has been invalidated in the meantime.
+	if gen == permCacheGen {
+		permCache[key] = permCacheEntry{perms: perms, fetched: fetched}
+	}
+
+	return perms, nil
+}
+
+// invalidatePermCache discards all cached results
+// of the permission backend. It must be called
+// whenever permissions or group memberships are changed.
+func invalidatePermCache() {
+	permCacheMu.Lock()
+	defer permCacheMu.Unlock()
+
+	clear(permCache)
+	permCacheGen++
+}
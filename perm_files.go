@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PermFiles stores permissions in the perms directory.
+// It contains the subdirectories user and group holding a file
+// for each user or group that lists its permissions on separate lines.
+// The member subdirectory holds a file for each user
+// that lists the groups it has been added to.
+// Temporary grants are listed in the temp file, one per line.
+type PermFiles struct{}
+
+const permMember = "member"
+
+var permFilesMu sync.Mutex
+
+// UserGroups returns the groups a user has been added to.
+func (p PermFiles) UserGroups(name string) ([]string, error) {
+	return p.readLines(permMember, name)
+}
+
+// AddUserGroup adds a user to a group.
+func (p PermFiles) AddUserGroup(name, group string) error {
+	return p.addLine(permMember, name, group)
+}
+
+// RemoveUserGroup removes a user from a group.
+func (p PermFiles) RemoveUserGroup(name, group string) error {
+	return p.removeLine(permMember, name, group)
+}
+
+// Perms returns the permissions granted to a user or group.
+func (p PermFiles) Perms(kind, id string) ([]string, error) {
+	if kind != PermUser && kind != PermGroup {
+		return nil, ErrInvalidPermKind
+	}
+
+	return p.readLines(kind, id)
+}
+
+// Grant grants a permission to a user or group.
+func (p PermFiles) Grant(kind, id, perm string) error {
+	if kind != PermUser && kind != PermGroup {
+		return ErrInvalidPermKind
+	}
+
+	return p.addLine(kind, id, perm)
+}
+
+// Revoke revokes a permission from a user or group.
+func (p PermFiles) Revoke(kind, id, perm string) error {
+	if kind != PermUser && kind != PermGroup {
+		return ErrInvalidPermKind
+	}
+
+	return p.removeLine(kind, id, perm)
+}
+
+// TempGrants returns all temporary grants.
+func (p PermFiles) TempGrants() ([]TempGrant, error) {
+	permFilesMu.Lock()
+	defer permFilesMu.Unlock()
+
+	return p.tempGrants()
+}
+
+// SetTempGrant adds or replaces a temporary grant.
+func (p PermFiles) SetTempGrant(tg TempGrant) error {
+	permFilesMu.Lock()
+	defer permFilesMu.Unlock()
+
+	tgs, err := p.tempGrants()
+	if err != nil {
+		return err
+	}
+
+	var kept []TempGrant
+	for _, old := range tgs {
+		if old.key() != tg.key() {
+			kept = append(kept, old)
+		}
+	}
+
+	return p.writeTempGrants(append(kept, tg))
+}
+
+// DeleteTempGrant deletes a temporary grant.
+func (p PermFiles) DeleteTempGrant(kind, id, perm string) error {
+	permFilesMu.Lock()
+	defer permFilesMu.Unlock()
+
+	tgs, err := p.tempGrants()
+	if err != nil {
+		return err
+	}
+
+	key := TempGrant{Kind: kind, ID: id, Perm: perm}
+
+	var kept []TempGrant
+	for _, tg := range tgs {
+		if tg.key() != key {
+			kept = append(kept, tg)
+		}
+	}
+
+	return p.writeTempGrants(kept)
+}
+
+// tempGrants parses the temp file. Each line consists of the kind,
+// the ID, the permission, the Unix creation and expiry times
+// and the issuer separated by spaces.
+// The caller must hold permFilesMu.
+func (p PermFiles) tempGrants() ([]TempGrant, error) {
+	data, err := os.ReadFile(Path("perms/temp"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var tgs []TempGrant
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) != 6 {
+			continue
+		}
+
+		created, _ := strconv.ParseInt(fields[3], 10, 64)
+		expiry, _ := strconv.ParseInt(fields[4], 10, 64)
+
+		tgs = append(tgs, TempGrant{
+			Kind:    fields[0],
+			ID:      fields[1],
+			Perm:    fields[2],
+			Issuer:  fields[5],
+			Created: timeOrZero(created),
+			Expiry:  timeOrZero(expiry),
+		})
+	}
+
+	return tgs, nil
+}
+
+// writeTempGrants replaces the temp file, deleting it if there are
+// no temporary grants. The caller must hold permFilesMu.
+func (p PermFiles) writeTempGrants(tgs []TempGrant) error {
+	if len(tgs) == 0 {
+		if err := os.Remove(Path("perms/temp")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	var b strings.Builder
+	for _, tg := range tgs {
+		fmt.Fprintf(&b, "%s %s %s %d %d %s\n", tg.Kind, tg.ID, tg.Perm, unixOrZero(tg.Created), unixOrZero(tg.Expiry), oneLine(tg.Issuer))
+	}
+
+	os.Mkdir(Path("perms"), 0700)
+	return os.WriteFile(Path("perms/temp"), []byte(b.String()), 0600)
+}
+
+func (p PermFiles) readLines(kind, id string) ([]string, error) {
+	permFilesMu.Lock()
+	defer permFilesMu.Unlock()
+
+	return p.lines(kind, id)
+}
+
+func (p PermFiles) addLine(kind, id, line string) error {
+	permFilesMu.Lock()
+	defer permFilesMu.Unlock()
+
+	lines, err := p.lines(kind, id)
+	if err != nil {
+		return err
+	}
+
+	if containsStr(lines, line) {
+		return nil
+	}
+
+	return p.writeLines(kind, id, append(lines, line))
+}
+
+func (p PermFiles) removeLine(kind, id, line string) error {
+	permFilesMu.Lock()
+	defer permFilesMu.Unlock()
+
+	lines, err := p.lines(kind, id)
+	if err != nil {
+		return err
+	}
+
+	var kept []string
+	for _, l := range lines {
+		if l != line {
+			kept = append(kept, l)
+		}
+	}
+
+	return p.writeLines(kind, id, kept)
+}
+
+// lines returns the lines of a file. The caller must hold permFilesMu.
+func (p PermFiles) lines(kind, id string) ([]string, error) {
+	data, err := os.ReadFile(p.path(kind, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, nil
+}
+
+// writeLines replaces the lines of a file, deleting it if there are none.
+// The caller must hold permFilesMu.
+func (p PermFiles) writeLines(kind, id string, lines []string) error {
+	if len(lines) == 0 {
+		if err := os.Remove(p.path(kind, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	os.Mkdir(Path("perms"), 0700)
+	os.Mkdir(Path("perms/", kind), 0700)
+
+	return os.WriteFile(p.path(kind, id), []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+func (p PermFiles) path(kind, id string) string {
+	return Path("perms/", kind, "/", url.PathEscape(id))
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+// A handle to a PostgreSQL permission database.
+type PermPostgreSQL struct {
+	db *sql.DB
+}
+
+// NewPermPostgreSQL opens the PostgreSQL permission database
+// at the specified connection string.
+func NewPermPostgreSQL(conn string) (*PermPostgreSQL, error) {
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the connection is working.
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Initialize the database if necessary.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS public.user_groups (name text NOT NULL, grp text NOT NULL, PRIMARY KEY (name, grp));"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS public.perms (kind text NOT NULL, id text NOT NULL, perm text NOT NULL, PRIMARY KEY (kind, id, perm));"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS public.temp_grants (kind text NOT NULL, id text NOT NULL, perm text NOT NULL, issuer text NOT NULL, created bigint NOT NULL, expiry bigint NOT NULL, PRIMARY KEY (kind, id, perm));"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PermPostgreSQL{db}, nil
+}
+
+// Close closes the underlying PostgreSQL database handle.
+func (p *PermPostgreSQL) Close() error {
+	return p.db.Close()
+}
+
+// UserGroups returns the groups a user has been added to.
+func (p *PermPostgreSQL) UserGroups(name string) ([]string, error) {
+	return queryStrings(p.db, "SELECT grp FROM user_groups WHERE name = $1 ORDER BY grp;", name)
+}
+
+// AddUserGroup adds a user to a group.
+func (p *PermPostgreSQL) AddUserGroup(name, group string) error {
+	_, err := p.db.Exec("INSERT INTO user_groups (name, grp) VALUES ($1, $2) ON CONFLICT DO NOTHING;", name, group)
+	return err
+}
+
+// RemoveUserGroup removes a user from a group.
+func (p *PermPostgreSQL) RemoveUserGroup(name, group string) error {
+	_, err := p.db.Exec("DELETE FROM user_groups WHERE name = $1 AND grp = $2;", name, group)
+	return err
+}
+
+// Perms returns the permissions granted to a user or group.
+func (p *PermPostgreSQL) Perms(kind, id string) ([]string, error) {
+	return queryStrings(p.db, "SELECT perm FROM perms WHERE kind = $1 AND id = $2 ORDER BY perm;", kind, id)
+}
+
+// Grant grants a permission to a user or group.
+func (p *PermPostgreSQL) Grant(kind, id, perm string) error {
+	if kind != PermUser && kind != PermGroup {
+		return ErrInvalidPermKind
+	}
+
+	_, err := p.db.Exec("INSERT INTO perms (kind, id, perm) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;", kind, id, perm)
+	return err
+}
+
+// Revoke revokes a permission from a user or group.
+func (p *PermPostgreSQL) Revoke(kind, id, perm string) error {
+	_, err := p.db.Exec("DELETE FROM perms WHERE kind = $1 AND id = $2 AND perm = $3;", kind, id, perm)
+	return err
+}
+
+// TempGrants returns all temporary grants.
+func (p *PermPostgreSQL) TempGrants() ([]TempGrant, error) {
+	rows, err := p.db.Query("SELECT kind, id, perm, issuer, created, expiry FROM temp_grants;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tgs []TempGrant
+	for rows.Next() {
+		var tg TempGrant
+		var created, expiry int64
+		if err := rows.Scan(&tg.Kind, &tg.ID, &tg.Perm, &tg.Issuer, &created, &expiry); err != nil {
+			return nil, err
+		}
+
+		tg.Created = timeOrZero(created)
+		tg.Expiry = timeOrZero(expiry)
+
+		tgs = append(tgs, tg)
+	}
+
+	return tgs, rows.Err()
+}
+
+// SetTempGrant adds or replaces a temporary grant.
+func (p *PermPostgreSQL) SetTempGrant(tg TempGrant) error {
+	_, err := p.db.Exec("INSERT INTO temp_grants (kind, id, perm, issuer, created, expiry) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (kind, id, perm) DO UPDATE SET issuer = EXCLUDED.issuer, created = EXCLUDED.created, expiry = EXCLUDED.expiry;", tg.Kind, tg.ID, tg.Perm, tg.Issuer, unixOrZero(tg.Created), unixOrZero(tg.Expiry))
+	return err
+}
+
+// DeleteTempGrant deletes a temporary grant.
+func (p *PermPostgreSQL) DeleteTempGrant(kind, id, perm string) error {
+	_, err := p.db.Exec("DELETE FROM temp_grants WHERE kind = $1 AND id = $2 AND perm = $3;", kind, id, perm)
+	return err
+}
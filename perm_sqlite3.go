@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// A handle to a SQLite3 permission database.
+type PermSQLite3 struct {
+	db *sql.DB
+}
+
+// NewPermSQLite3 opens the SQLite3 permission database at perms.sqlite.
+func NewPermSQLite3() (*PermSQLite3, error) {
+	db, err := sql.Open("sqlite3", Path("perms.sqlite"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize the database if necessary.
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS user_groups (name VARCHAR(32), grp TEXT, PRIMARY KEY (name, grp));"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS perms (kind VARCHAR(8), id TEXT, perm TEXT, PRIMARY KEY (kind, id, perm));"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS temp_grants (kind VARCHAR(8), id TEXT, perm TEXT, issuer VARCHAR(32), created INTEGER, expiry INTEGER, PRIMARY KEY (kind, id, perm));"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PermSQLite3{db}, nil
+}
+
+// Close closes the underlying SQLite3 database handle.
+func (p *PermSQLite3) Close() error {
+	return p.db.Close()
+}
+
+// UserGroups returns the groups a user has been added to.
+func (p *PermSQLite3) UserGroups(name string) ([]string, error) {
+	return queryStrings(p.db, "SELECT grp FROM user_groups WHERE name = ? ORDER BY grp;", name)
+}
+
+// AddUserGroup adds a user to a group.
+func (p *PermSQLite3) AddUserGroup(name, group string) error {
+	_, err := p.db.Exec("INSERT OR IGNORE INTO user_groups (name, grp) VALUES (?, ?);", name, group)
+	return err
+}
+
+// RemoveUserGroup removes a user from a group.
+func (p *PermSQLite3) RemoveUserGroup(name, group string) error {
+	_, err := p.db.Exec("DELETE FROM user_groups WHERE name = ? AND grp = ?;", name, group)
+	return err
+}
+
+// Perms returns the permissions granted to a user or group.
+func (p *PermSQLite3) Perms(kind, id string) ([]string, error) {
+	return queryStrings(p.db, "SELECT perm FROM perms WHERE kind = ? AND id = ? ORDER BY perm;", kind, id)
+}
+
+// Grant grants a permission to a user or group.
+func (p *PermSQLite3) Grant(kind, id, perm string) error {
+	if kind != PermUser && kind != PermGroup {
+		return ErrInvalidPermKind
+	}
+
+	_, err := p.db.Exec("INSERT OR IGNORE INTO perms (kind, id, perm) VALUES (?, ?, ?);", kind, id, perm)
+	return err
+}
+
+// Revoke revokes a permission from a user or group.
+func (p *PermSQLite3) Revoke(kind, id, perm string) error {
+	_, err := p.db.Exec("DELETE FROM perms WHERE kind = ? AND id = ? AND perm = ?;", kind, id, perm)
+	return err
+}
+
+// TempGrants returns all temporary grants.
+func (p *PermSQLite3) TempGrants() ([]TempGrant, error) {
+	rows, err := p.db.Query("SELECT kind, id, perm, issuer, created, expiry FROM temp_grants;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tgs []TempGrant
+	for rows.Next() {
+		var tg TempGrant
+		var created, expiry int64
+		if err := rows.Scan(&tg.Kind, &tg.ID, &tg.Perm, &tg.Issuer, &created, &expiry); err != nil {
+			return nil, err
+		}
+
+		tg.Created = timeOrZero(created)
+		tg.Expiry = timeOrZero(expiry)
+
+		tgs = append(tgs, tg)
+	}
+
+	return tgs, rows.Err()
+}
+
+// SetTempGrant adds or replaces a temporary grant.
+func (p *PermSQLite3) SetTempGrant(tg TempGrant) error {
+	_, err := p.db.Exec("REPLACE INTO temp_grants (kind, id, perm, issuer, created, expiry) VALUES (?, ?, ?, ?, ?, ?);", tg.Kind, tg.ID, tg.Perm, tg.Issuer, unixOrZero(tg.Created), unixOrZero(tg.Expiry))
+	return err
+}
+
+// DeleteTempGrant deletes a temporary grant.
+func (p *PermSQLite3) DeleteTempGrant(kind, id, perm string) error {
+	_, err := p.db.Exec("DELETE FROM temp_grants WHERE kind = ? AND id = ? AND perm = ?;", kind, id, perm)
+	return err
+}
@@ -0,0 +1,495 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempGrantInterval is the interval at which temporary grants
+// are reloaded from the permission backend and expired ones are revoked.
+// Expired grants stop applying immediately regardless.
+const tempGrantInterval = 10 * time.Second
+
+var (
+	ErrTempGrantNotSupported = errors.New("permission backend doesn't support temporary grants")
+	ErrInvalidDuration       = errors.New("duration must be positive")
+	ErrPermanentGrant        = errors.New("already granted permanently")
+)
+
+// A TempGrant is a permission or group membership that expires.
+type TempGrant struct {
+	// Kind is PermUser or PermGroup for permissions
+	// or PermMember for group memberships.
+	Kind string
+	// ID is the name of the user or group.
+	ID string
+	// Perm is the permission or, for group memberships, the group.
+	Perm    string
+	Issuer  string
+	Created time.Time
+	Expiry  time.Time
+}
+
+// Expired reports whether the TempGrant has expired.
+func (tg TempGrant) Expired() bool {
+	return !time.Now().Before(tg.Expiry)
+}
+
+// String returns a human readable description of the TempGrant.
+func (tg TempGrant) String() string {
+	expiry := tg.Expiry.Format(time.DateTime)
+	if tg.Kind == PermMember {
+		return fmt.Sprintf("%s in group %s until %s", tg.ID, tg.Perm, expiry)
+	}
+
+	return fmt.Sprintf("%s to %s %s until %s", tg.Perm, tg.Kind, tg.ID, expiry)
+}
+
+func (tg TempGrant) key() TempGrant {
+	return TempGrant{Kind: tg.Kind, ID: tg.ID, Perm: tg.Perm}
+}
+
+// A TempGrantBackend is a PermissionBackend that can store
+// the expiry of temporary grants. The grants themselves
+// are stored using the regular PermissionBackend methods.
+type TempGrantBackend interface {
+	PermissionBackend
+
+	// TempGrants returns all temporary grants, including expired ones.
+	TempGrants() ([]TempGrant, error)
+	// SetTempGrant adds or replaces a temporary grant.
+	SetTempGrant(tg TempGrant) error
+	// DeleteTempGrant deletes a temporary grant,
+	// making it permanent if it hasn't been revoked.
+	// Deleting a temporary grant that doesn't exist is not an error.
+	DeleteTempGrant(kind, id, perm string) error
+}
+
+var (
+	tempGrants   = make(map[TempGrant]TempGrant)
+	tempGrantsMu sync.RWMutex
+)
+
+// permWriteMu serializes runtime permission changes
+// so that expiring a temporary grant can't undo a grant
+// that replaces it concurrently.
+var permWriteMu sync.Mutex
+
+// GrantTempPerm grants a permission to a user or group
+// for the specified duration. Granting a permission that has been
+// granted temporarily before replaces the expiry.
+// The issuer is usually the name of the moderator.
+// The active permission backend must implement TempGrantBackend.
+func GrantTempPerm(kind, id, perm string, d time.Duration, issuer string) error {
+	if err := checkPermArgs(kind, id, perm); err != nil {
+		return err
+	}
+
+	return grantTemp(TempGrant{Kind: kind, ID: id, Perm: perm}, d, issuer)
+}
+
+// AddTempUserGroup adds a user to a permission group
+// for the specified duration. Otherwise it behaves like GrantTempPerm.
+func AddTempUserGroup(name, group string, d time.Duration, issuer string) error {
+	if err := checkPermArgs(PermUser, name, group); err != nil {
+		return err
+	}
+
+	return grantTemp(TempGrant{Kind: PermMember, ID: name, Perm: group}, d, issuer)
+}
+
+// TempGrants returns all temporary grants that haven't been revoked yet
+// ordered by expiry.
+func TempGrants() []TempGrant {
+	tempGrantsMu.RLock()
+	defer tempGrantsMu.RUnlock()
+
+	var tgs []TempGrant
+	for _, tg := range tempGrants {
+		tgs = append(tgs, tg)
+	}
+
+	sort.Slice(tgs, func(i, j int) bool {
+		return tgs[i].Expiry.Before(tgs[j].Expiry)
+	})
+
+	return tgs
+}
+
+func grantTemp(tg TempGrant, d time.Duration, issuer string) error {
+	tgb, ok := DefaultPermBackend().(TempGrantBackend)
+	if !ok {
+		return ErrTempGrantNotSupported
+	}
+
+	if d <= 0 {
+		return ErrInvalidDuration
+	}
+
+	permWriteMu.Lock()
+	defer permWriteMu.Unlock()
+
+	var granted []string
+	var err error
+	if tg.Kind == PermMember {
+		granted, err = tgb.UserGroups(tg.ID)
+	} else {
+		granted, err = tgb.Perms(tg.Kind, tg.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, extend := tempGrant(tg.Kind, tg.ID, tg.Perm)
+	if containsStr(granted, tg.Perm) && !extend {
+		return ErrPermanentGrant
+	}
+
+	tg.Issuer = issuer
+	tg.Created = time.Now()
+	tg.Expiry = tg.Created.Add(d)
+
+	defer invalidatePermCache()
+
+	// Grant first so that a failure doesn't leave a temporary grant
+	// record behind that would revoke an unrelated grant on expiry.
+	if tg.Kind == PermMember {
+		err = tgb.AddUserGroup(tg.ID, tg.Perm)
+	} else {
+		err = tgb.Grant(tg.Kind, tg.ID, tg.Perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tgb.SetTempGrant(tg); err != nil {
+		// An extended grant keeps its old record and expiry.
+		if !extend {
+			var rbErr error
+			if tg.Kind == PermMember {
+				rbErr = tgb.RemoveUserGroup(tg.ID, tg.Perm)
+			} else {
+				rbErr = tgb.Revoke(tg.Kind, tg.ID, tg.Perm)
+			}
+			if rbErr != nil {
+				log.Print("roll back temporary grant ", tg, ": ", rbErr)
+			}
+		}
+
+		return err
+	}
+
+	tempGrantsMu.Lock()
+	tempGrants[tg.key()] = tg
+	tempGrantsMu.Unlock()
+
+	auditPerm("grant temporarily", issuer, tg.Kind, tg.ID, tg.Perm, tg.Expiry)
+	go SyncPrivs()
+
+	return nil
+}
+
+// tempGrant returns the temporary grant of a permission
+// or group membership and whether it exists.
+func tempGrant(kind, id, perm string) (TempGrant, bool) {
+	tempGrantsMu.RLock()
+	defer tempGrantsMu.RUnlock()
+
+	tg, ok := tempGrants[TempGrant{Kind: kind, ID: id, Perm: perm}]
+	return tg, ok
+}
+
+// tempExpired reports whether a permission or group membership
+// returned by the permission backend has expired
+// but hasn't been revoked yet.
+func tempExpired(kind, id, perm string) bool {
+	tg, ok := tempGrant(kind, id, perm)
+	return ok && tg.Expired()
+}
+
+// dropExpired removes the expired temporary grants from a list
+// of permissions or groups returned by the permission backend.
+func dropExpired(kind, id string, perms []string) []string {
+	var kept []string
+	for _, perm := range perms {
+		if !tempExpired(kind, id, perm) {
+			kept = append(kept, perm)
+		}
+	}
+
+	return kept
+}
+
+// forgetTempGrant deletes the temporary grant of a permission
+// or group membership that has been granted permanently or revoked.
+// The permission backend is always asked to delete it
+// because it may have been granted by another proxy.
+func forgetTempGrant(kind, id, perm string) error {
+	if tgb, ok := DefaultPermBackend().(TempGrantBackend); ok {
+		if err := tgb.DeleteTempGrant(kind, id, perm); err != nil {
+			return err
+		}
+	}
+
+	tempGrantsMu.Lock()
+	defer tempGrantsMu.Unlock()
+
+	delete(tempGrants, TempGrant{Kind: kind, ID: id, Perm: perm})
+	return nil
+}
+
+// loadTempGrants loads the temporary grants from the permission backend
+// and starts reloading them periodically, revoking them when they expire.
+// Reloading picks up grants made by other proxies sharing the backend.
+func loadTempGrants() error {
+	tgb, ok := DefaultPermBackend().(TempGrantBackend)
+	if !ok {
+		return nil
+	}
+
+	if err := refreshTempGrants(tgb); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			expireTempGrants(tgb)
+			time.Sleep(tempGrantInterval)
+
+			if err := refreshTempGrants(tgb); err != nil {
+				log.Print("reload temporary grants: ", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// refreshTempGrants replaces the known temporary grants
+// with those stored by the permission backend.
+func refreshTempGrants(tgb TempGrantBackend) error {
+	permWriteMu.Lock()
+	defer permWriteMu.Unlock()
+
+	tgs, err := tgb.TempGrants()
+	if err != nil {
+		return err
+	}
+
+	m := make(map[TempGrant]TempGrant, len(tgs))
+	for _, tg := range tgs {
+		m[tg.key()] = tg
+	}
+
+	tempGrantsMu.Lock()
+	defer tempGrantsMu.Unlock()
+
+	tempGrants = m
+	return nil
+}
+
+// expireTempGrants revokes all expired temporary grants
+// and notifies the affected players that are online.
+func expireTempGrants(tgb TempGrantBackend) {
+	for _, tg := range TempGrants() {
+		if !tg.Expired() {
+			continue
+		}
+
+		expired, err := expireTempGrant(tgb, tg)
+		if err != nil {
+			log.Print("expire temporary grant of ", tg, ": ", err)
+			continue
+		}
+
+		if !expired {
+			continue
+		}
+
+		auditPerm("expire", "", tg.Kind, tg.ID, tg.Perm, time.Time{})
+		go SyncPrivs()
+
+		switch tg.Kind {
+		case PermUser:
+			if cc := Find(tg.ID); cc != nil {
+				cc.SendChatMsg("Your temporary permission " + tg.Perm + " has expired.")
+			}
+		case PermMember:
+			if cc := Find(tg.ID); cc != nil {
+				cc.SendChatMsg("Your temporary membership in group " + tg.Perm + " has expired.")
+			}
+		case PermGroup:
+			for cc := range Clts() {
+				if containsStr(PlayerGroups(cc.Name()), tg.ID) {
+					cc.SendChatMsg("The temporary permission " + tg.Perm + " of your group " + tg.ID + " has expired.")
+				}
+			}
+		}
+	}
+}
+
+// expireTempGrant revokes an expired temporary grant
+// unless it has been replaced or made permanent in the meantime.
+// It reports whether the grant has been revoked.
+func expireTempGrant(tgb TempGrantBackend, tg TempGrant) (bool, error) {
+	permWriteMu.Lock()
+	defer permWriteMu.Unlock()
+
+	// Other proxies sharing the backend may have
+	// changed the grant since it was loaded.
+	tgs, err := tgb.TempGrants()
+	if err != nil {
+		return false, err
+	}
+
+	current := false
+	for _, other := range tgs {
+		if other.key() == tg.key() {
+			current = other.Expiry.Equal(tg.Expiry)
+			break
+		}
+	}
+
+	if !current {
+		return false, nil
+	}
+
+	if tg.Kind == PermMember {
+		err = tgb.RemoveUserGroup(tg.ID, tg.Perm)
+	} else {
+		err = tgb.Revoke(tg.Kind, tg.ID, tg.Perm)
+	}
+	invalidatePermCache()
+	if err != nil {
+		return false, err
+	}
+
+	if err := tgb.DeleteTempGrant(tg.Kind, tg.ID, tg.Perm); err != nil {
+		return false, err
+	}
+
+	tempGrantsMu.Lock()
+	defer tempGrantsMu.Unlock()
+
+	if cur, ok := tempGrants[tg.key()]; ok && cur.Expiry.Equal(tg.Expiry) {
+		delete(tempGrants, tg.key())
+	}
+
+	return true, nil
+}
+
+var auditMu sync.Mutex
+
+// auditPerm appends a permission change to perms_audit.log
+// in the proxy directory and logs it. The issuer is empty
+// for changes made by the proxy itself or by plugins.
+func auditPerm(action, issuer, kind, id, perm string, expiry time.Time) {
+	if issuer == "" {
+		issuer = "proxy"
+	}
+
+	msg := fmt.Sprintf("%s %s %s %s by %s", action, kind, id, perm, issuer)
+	if !expiry.IsZero() {
+		msg += " until " + expiry.Format(time.RFC3339)
+	}
+
+	log.Print("permissions: ", msg)
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, err := os.OpenFile(Path("perms_audit.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Print("audit log: ", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, time.Now().Format(time.RFC3339), msg); err != nil {
+		log.Print("audit log: ", err)
+	}
+}
+
+func init() {
+	registerCoreChatCmd(ChatCmd{
+		Name:  "tempgrant",
+		Perm:  "cmd.tempgrant",
+		Help:  "Grant a permission you have to a user or group for a duration such as 2h30m.",
+		Usage: "tempgrant <user | group> <name> <permission> <duration>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 4 {
+				return "Usage: tempgrant <user | group> <name> <permission> <duration>"
+			}
+
+			d, err := time.ParseDuration(args[3])
+			if err != nil {
+				return "Invalid duration."
+			}
+
+			if msg := checkGrant(cc.Name(), args[0], args[1], args[2], false); msg != "" {
+				return msg
+			}
+
+			if err := GrantTempPerm(args[0], args[1], args[2], d, cc.Name()); err != nil {
+				return "Could not grant permission: " + err.Error()
+			}
+
+			cc.Log("<-", "grant", args[0], args[1], args[2], "for", d)
+			return "Permission granted temporarily."
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "tempgroup",
+		Perm:  "cmd.tempgroup",
+		Help:  "Add a user to a permission group whose permissions you have for a duration such as 168h.",
+		Usage: "tempgroup <name> <group> <duration>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 3 {
+				return "Usage: tempgroup <name> <group> <duration>"
+			}
+
+			d, err := time.ParseDuration(args[2])
+			if err != nil {
+				return "Invalid duration."
+			}
+
+			if msg := checkGroupGrant(cc.Name(), args[0], args[1], false); msg != "" {
+				return msg
+			}
+
+			if err := AddTempUserGroup(args[0], args[1], d, cc.Name()); err != nil {
+				return "Could not add user to group: " + err.Error()
+			}
+
+			cc.Log("<-", "add", args[0], "to group", args[1], "for", d)
+			return "User added to group temporarily."
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "tempgrants",
+		Perm:  "cmd.tempgrants",
+		Help:  "List all temporary permissions and group memberships.",
+		Usage: "tempgrants",
+		Handler: func(cc *ClientConn, args ...string) string {
+			tgs := TempGrants()
+			if len(tgs) == 0 {
+				return "There are no temporary grants."
+			}
+
+			lines := make([]string, 0, len(tgs))
+			for _, tg := range tgs {
+				lines = append(lines, fmt.Sprintf("%s (by %s)", tg, tg.Issuer))
+			}
+
+			return strings.Join(lines, "\n")
+		},
+	})
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errTestStore = errors.New("store failed")
+
+// failingTempPerms is a TempGrantBackend that can't store temporary grants.
+type failingTempPerms struct {
+	*testPerms
+}
+
+func (p failingTempPerms) SetTempGrant(tg TempGrant) error {
+	return errTestStore
+}
+
+func TestGrantTempRollback(t *testing.T) {
+	pb := failingTempPerms{newTestPerms()}
+	useTestBackends(t, nil, pb)
+
+	tg := TempGrant{Kind: PermUser, ID: "alice", Perm: "fly"}
+	if err := grantTemp(tg, time.Hour, "bob"); err != errTestStore {
+		t.Fatalf("grantTemp = %v, want %v", err, errTestStore)
+	}
+
+	if perms, _ := pb.Perms(PermUser, "alice"); len(perms) != 0 {
+		t.Errorf("perms = %q, want none", perms)
+	}
+
+	tg = TempGrant{Kind: PermMember, ID: "alice", Perm: "mod"}
+	if err := grantTemp(tg, time.Hour, "bob"); err != errTestStore {
+		t.Fatalf("grantTemp = %v, want %v", err, errTestStore)
+	}
+
+	if groups, _ := pb.UserGroups("alice"); len(groups) != 0 {
+		t.Errorf("groups = %q, want none", groups)
+	}
+
+	if tgs := TempGrants(); len(tgs) != 0 {
+		t.Errorf("temporary grants = %v, want none", tgs)
+	}
+
+	// An existing temporary grant keeps its permission.
+	tg = TempGrant{Kind: PermUser, ID: "alice", Perm: "fast", Expiry: time.Now().Add(time.Hour)}
+	pb.Grant(tg.Kind, tg.ID, tg.Perm)
+	pb.testPerms.SetTempGrant(tg)
+	if err := refreshTempGrants(pb); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := grantTemp(tg, 2*time.Hour, "bob"); err != errTestStore {
+		t.Fatalf("grantTemp = %v, want %v", err, errTestStore)
+	}
+
+	if perms, _ := pb.Perms(PermUser, "alice"); !reflect.DeepEqual(perms, []string{"fast"}) {
+		t.Errorf("perms after failed extension = %q, want [fast]", perms)
+	}
+}
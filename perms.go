@@ -1,6 +1,82 @@
 package proxy
 
-import "strings"
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Prefixes of permission scopes.
+const (
+	ServerScope = "server:" // Permissions only valid on a single server.
+	GroupScope  = "group:"  // Permissions only valid on a server group.
+)
+
+// A PermDecision describes why a permission is granted or denied.
+// It is returned by ExplainPerm.
+type PermDecision struct {
+	// Perm is the permission that was checked.
+	Perm string
+	// Server is the server the permission was checked on.
+	// It is empty if the permission was checked network-wide.
+	Server string
+	// Granted is true if the permission is granted.
+	Granted bool
+	// Entry is the raw permission that decided the outcome.
+	// It is empty if no raw permission matched.
+	Entry string
+	// Source is PermUser if the entry was granted to the player
+	// directly or PermGroup if it belongs to a group.
+	Source string
+	// Path is the chain of groups leading from one of the player's
+	// groups to the group the entry belongs to. It is empty
+	// if Source is PermUser.
+	Path []string
+}
+
+// String returns a human readable explanation of the decision.
+func (pd PermDecision) String() string {
+	outcome := "denied"
+	if pd.Granted {
+		outcome = "granted"
+	}
+
+	perm := pd.Perm
+	if pd.Server != "" {
+		perm += " on " + pd.Server
+	}
+
+	switch {
+	case pd.Perm == "":
+		return "The empty permission is always granted."
+	case pd.Entry == "":
+		return fmt.Sprintf("%s is %s: No matching permission.", perm, outcome)
+	case pd.Source == PermUser:
+		return fmt.Sprintf("%s is %s by %s, which the player has directly.", perm, outcome, pd.Entry)
+	default:
+		return fmt.Sprintf("%s is %s by %s of group %s (%s).", perm, outcome, pd.Entry, pd.Path[len(pd.Path)-1], strings.Join(pd.Path, " > "))
+	}
+}
+
+// A permEntry is a raw permission and where it comes from.
+type permEntry struct {
+	perm   string
+	source string
+	path   []string
+}
+
+// A permScope is the context a permission is checked in.
+type permScope struct {
+	srv    string
+	groups []string
+}
+
+// serverPermScope returns the scope of the specified server.
+// Permissions checked in it can be granted by raw permissions
+// scoped to the server or to one of its groups.
+func serverPermScope(conf *Config, srv string) permScope {
+	return permScope{srv: srv, groups: conf.Servers[srv].Groups}
+}
 
 // Perms returns the raw permissions of the ClientConn.
 func (cc *ClientConn) Perms() []string {
@@ -8,16 +84,98 @@ func (cc *ClientConn) Perms() []string {
 		return []string{}
 	}
 
-	grp, ok := Conf().UserGroups[cc.Name()]
-	if !ok {
-		grp = "default"
+	return PlayerPerms(cc.Name())
+}
+
+// PlayerPerms returns the raw permissions of a player
+// who doesn't need to be connected. They consist of the permissions
+// of the player's groups including inherited ones and those granted
+// to the player directly. Deny entries are included.
+func PlayerPerms(name string) []string {
+	conf := Conf()
+
+	perms := []string{}
+	for _, level := range permLevels(&conf, name) {
+		for _, entry := range level {
+			perms = append(perms, entry.perm)
+		}
+	}
+
+	return perms
+}
+
+// PlayerGroups returns the permission groups of a player
+// who doesn't need to be connected. Players whose groups aren't set
+// in the config are in the default group, even if they have been
+// added to other groups at runtime. Parent groups are not included.
+func PlayerGroups(name string) []string {
+	conf := Conf()
+	return playerGroups(&conf, name)
+}
+
+func playerGroups(conf *Config, name string) []string {
+	var groups []string
+	for _, grp := range conf.UserGroups[name] {
+		if !containsStr(groups, grp) {
+			groups = append(groups, grp)
+		}
 	}
 
-	if perms, ok := Conf().Groups[grp]; ok {
-		return perms
+	if len(groups) == 0 {
+		groups = []string{"default"}
 	}
 
-	return []string{}
+	if pb := DefaultPermBackend(); pb != nil {
+		more, err := cachedPerms(pb, PermMember, name)
+		if err != nil {
+			log.Print("get groups of user ", name, ": ", err)
+		}
+
+		for _, grp := range dropExpired(PermMember, name, more) {
+			if !containsStr(groups, grp) {
+				groups = append(groups, grp)
+			}
+		}
+	}
+
+	return groups
+}
+
+// GroupPerms returns the raw permissions of a group.
+// Permissions inherited from parent groups are not included.
+func GroupPerms(group string) []string {
+	conf := Conf()
+	return groupPerms(&conf, group)
+}
+
+func groupPerms(conf *Config, group string) []string {
+	perms := append([]string{}, conf.Groups[group]...)
+
+	if pb := DefaultPermBackend(); pb != nil {
+		more, err := cachedPerms(pb, PermGroup, group)
+		if err != nil {
+			log.Print("get permissions of group ", group, ": ", err)
+		}
+
+		perms = append(perms, dropExpired(PermGroup, group, more)...)
+	}
+
+	return perms
+}
+
+// InheritedGroupPerms returns the raw permissions of a group
+// and all of its ancestors.
+func InheritedGroupPerms(group string) []string {
+	conf := Conf()
+
+	perms := []string{}
+	for _, level := range groupLevels(&conf, []string{group}) {
+		for _, entry := range level {
+			perms = append(perms, entry.perm)
+		}
+	}
+
+	return perms
 }
 
 // HasPerms returns true if the ClientConn has all
@@ -25,30 +183,243 @@ func (cc *ClientConn) Perms() []string {
 // This method matches wildcards, but they may only be used
 // at the end of a raw permission. Asterisks in other places
 // will be treated as regular characters.
+// Raw permissions starting with a "-" deny a permission.
+// Permissions are checked on the current server of the ClientConn.
+// See ExplainPerm for details.
 func (cc *ClientConn) HasPerms(want ...string) bool {
-	has := map[string]struct{}{
-		"": struct{}{},
+	conf := Conf()
+
+	var levels [][]permEntry
+	if cc.Name() != "" {
+		levels = permLevels(&conf, cc.Name())
+	}
+
+	srv := cc.ServerName()
+	for _, perm := range want {
+		if !decidePerm(&conf, levels, srv, perm).Granted {
+			return false
+		}
 	}
 
-	for _, perm := range cc.Perms() {
-		if strings.HasSuffix(perm, "*") {
-			perm = perm[:len(perm)-1]
+	return true
+}
+
+// ExplainPerm reports whether a player who doesn't need to be connected
+// has a permission on the specified server and why.
+// If the server name is empty, only network-wide permissions apply.
+//
+// Raw permissions can be scoped to a server or a server group
+// by prefixing them with "server:<name>/" or "group:<name>/",
+// e.g. "server:creative/cmd.give". Scoped raw permissions only apply
+// on the server or on the servers of the group, respectively.
+// The permission to check may be scoped as well, in which case
+// the server argument is ignored and the permission is checked
+// on the server or group it is scoped to.
+//
+// The raw permissions granted to the player directly are checked first,
+// followed by those of the player's groups, their parent groups
+// and so on. The first of these levels that contains a raw permission
+// matching the permission decides. If it contains a matching deny entry
+// the permission is denied, otherwise it is granted.
+// This means deny entries override wildcards of the same level
+// and everything inherited, but can be overridden by entries
+// closer to the player. Permissions without any matching entry
+// are denied, except for the empty permission which is always granted.
+// Within a level raw permissions scoped to the server take precedence
+// over those scoped to one of its groups, which in turn take precedence
+// over network-wide ones.
+func ExplainPerm(name, srv, perm string) PermDecision {
+	conf := Conf()
+	return decidePerm(&conf, permLevels(&conf, name), srv, perm)
+}
+
+// decidePerm checks a permission against the permission levels
+// of a player. Server groups are looked up in the config snapshot
+// the levels were built from.
+func decidePerm(conf *Config, levels [][]permEntry, srv, perm string) PermDecision {
+	if perm == "" {
+		return PermDecision{Granted: true}
+	}
+
+	pd := PermDecision{Perm: perm, Server: srv}
+
+	scope := serverPermScope(conf, srv)
+	if name, rest, ok := parseScope(perm); ok {
+		pd.Server = ""
+		perm = rest
 
-			for _, wperm := range want {
-				if strings.HasPrefix(wperm, perm) {
-					has[wperm] = struct{}{}
+		if strings.HasPrefix(name, ServerScope) {
+			scope = serverPermScope(conf, name[len(ServerScope):])
+		} else {
+			scope = permScope{groups: []string{name[len(GroupScope):]}}
+		}
+	}
+
+	for _, level := range levels {
+		// Indexed by specificity.
+		var grants, denies [3]*permEntry
+		for i, entry := range level {
+			raw, deny := strings.CutPrefix(entry.perm, "-")
+
+			spec := scope.specificity(raw)
+			if spec < 0 {
+				continue
+			}
+
+			if _, rest, ok := parseScope(raw); ok {
+				raw = rest
+			}
+
+			if !matchPerm(raw, perm) {
+				continue
+			}
+
+			if deny && denies[spec] == nil {
+				denies[spec] = &level[i]
+			} else if !deny && grants[spec] == nil {
+				grants[spec] = &level[i]
+			}
+		}
+
+		for spec := len(grants) - 1; spec >= 0; spec-- {
+			entry := denies[spec]
+			if entry == nil {
+				entry = grants[spec]
+			}
+
+			if entry != nil {
+				pd.Granted = entry == grants[spec]
+				pd.Entry = entry.perm
+				pd.Source = entry.source
+				pd.Path = entry.path
+
+				return pd
+			}
+		}
+	}
+
+	return pd
+}
+
+// specificity returns 2 if a raw permission without deny prefix
+// is scoped to the server, 1 if it is scoped to one of its groups
+// and 0 if it isn't scoped. If the raw permission doesn't apply
+// to the scope it returns -1.
+func (ps permScope) specificity(raw string) int {
+	name, _, ok := parseScope(raw)
+	if !ok {
+		return 0
+	}
+
+	if srv, ok := strings.CutPrefix(name, ServerScope); ok {
+		if srv != "" && srv == ps.srv {
+			return 2
+		}
+
+		return -1
+	}
+
+	if containsStr(ps.groups, name[len(GroupScope):]) {
+		return 1
+	}
+
+	return -1
+}
+
+// parseScope splits a scoped permission into its scope
+// including the scope prefix and the permission itself.
+// It returns false if the permission isn't scoped.
+func parseScope(perm string) (name, rest string, ok bool) {
+	if !strings.HasPrefix(perm, ServerScope) && !strings.HasPrefix(perm, GroupScope) {
+		return "", perm, false
+	}
+
+	return strings.Cut(perm, "/")
+}
+
+// matchPerm reports whether a raw permission without deny prefix
+// matches a permission.
+func matchPerm(raw, perm string) bool {
+	if prefix, ok := strings.CutSuffix(raw, "*"); ok {
+		return strings.HasPrefix(perm, prefix)
+	}
+
+	return raw == perm
+}
+
+// permLevels returns the raw permissions of a player ordered
+// by their distance to the player. The first level contains
+// the permissions granted to the player directly, the second one
+// those of the player's groups and so on.
+// All config lookups use the specified snapshot so that a single
+// permission check doesn't copy the config more than once.
+func permLevels(conf *Config, name string) [][]permEntry {
+	var user []permEntry
+	if pb := DefaultPermBackend(); pb != nil {
+		perms, err := cachedPerms(pb, PermUser, name)
+		if err != nil {
+			log.Print("get permissions of user ", name, ": ", err)
+		}
+
+		for _, perm := range dropExpired(PermUser, name, perms) {
+			user = append(user, permEntry{perm: perm, source: PermUser})
+		}
+	}
+
+	return append([][]permEntry{user}, groupLevels(conf, playerGroups(conf, name))...)
+}
+
+// groupLevels returns the raw permissions of the specified groups
+// and their ancestors ordered by inheritance depth.
+// Every group is only visited once, even if the inheritance graph
+// contains cycles.
+func groupLevels(conf *Config, groups []string) [][]permEntry {
+	visited := make(map[string]struct{})
+	var paths [][]string
+	for _, grp := range groups {
+		if _, ok := visited[grp]; !ok {
+			visited[grp] = struct{}{}
+			paths = append(paths, []string{grp})
+		}
+	}
+
+	var levels [][]permEntry
+	for len(paths) > 0 {
+		var level []permEntry
+		var next [][]string
+		for _, path := range paths {
+			grp := path[len(path)-1]
+			for _, perm := range groupPerms(conf, grp) {
+				level = append(level, permEntry{
+					perm:   perm,
+					source: PermGroup,
+					path:   path,
+				})
+			}
+
+			for _, parent := range conf.GroupParents[grp] {
+				if _, ok := visited[parent]; ok {
+					continue
 				}
+
+				visited[parent] = struct{}{}
+				next = append(next, append(append([]string{}, path...), parent))
 			}
-		} else {
-			has[perm] = struct{}{}
 		}
+
+		levels = append(levels, level)
+		paths = next
 	}
 
-	for _, perm := range want {
-		if _, ok := has[perm]; !ok {
-			return false
+	return levels
+}
+
+func containsStr(s []string, v string) bool {
+	for _, elem := range s {
+		if elem == v {
+			return true
 		}
 	}
 
-	return true
+	return false
 }
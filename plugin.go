@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"plugin"
 	"strings"
 	"sync"
@@ -109,7 +110,7 @@ func openPlugins() {
 			}
 
 			log.Println("load auto plugin", pl.Name())
-		} else if !pl.IsDir() {
+		} else if !pl.IsDir() && filepath.Ext(pl.Name()) != ".lua" {
 			_, err := plugin.Open(path + "/" + pl.Name())
 			if err != nil {
 				log.Print(err)
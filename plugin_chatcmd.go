@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"log"
 	"sync"
 )
 
@@ -14,6 +15,7 @@ type ChatCmd struct {
 }
 
 var chatCmds map[string]ChatCmd
+var coreChatCmds = make(map[string]struct{})
 var chatCmdsMu sync.RWMutex
 var chatCmdsOnce sync.Once
 
@@ -40,18 +42,59 @@ func ChatCmdExists(name string) bool {
 
 // RegisterChatCmd adds a new ChatCmd. It returns true on success
 // and false if a command with the same name already exists.
+// Failures are logged. Builtin commands are registered
+// before plugins are loaded and always take precedence.
 func RegisterChatCmd(cmd ChatCmd) bool {
 	initChatCmds()
 
-	if ChatCmdExists(cmd.Name) {
+	chatCmdsMu.Lock()
+	defer chatCmdsMu.Unlock()
+
+	if _, ok := chatCmds[cmd.Name]; ok {
+		if _, ok := coreChatCmds[cmd.Name]; ok {
+			log.Printf("chat command %q is builtin, not registering it again", cmd.Name)
+		} else {
+			log.Printf("chat command %q already exists, not registering it again", cmd.Name)
+		}
+
 		return false
 	}
 
+	chatCmds[cmd.Name] = cmd
+	return true
+}
+
+// registerCoreChatCmd adds a builtin ChatCmd.
+// It panics if a command with the same name already exists.
+func registerCoreChatCmd(cmd ChatCmd) {
+	if !RegisterChatCmd(cmd) {
+		panic("duplicate builtin chat command " + cmd.Name)
+	}
+
 	chatCmdsMu.Lock()
 	defer chatCmdsMu.Unlock()
 
-	chatCmds[cmd.Name] = cmd
-	return true
+	coreChatCmds[cmd.Name] = struct{}{}
+}
+
+// setChatCmdInfo replaces the permission, help and usage
+// of an existing ChatCmd.
+func setChatCmdInfo(name, perm, help, usage string) {
+	initChatCmds()
+
+	chatCmdsMu.Lock()
+	defer chatCmdsMu.Unlock()
+
+	cmd, ok := chatCmds[name]
+	if !ok {
+		return
+	}
+
+	cmd.Perm = perm
+	cmd.Help = help
+	cmd.Usage = usage
+
+	chatCmds[name] = cmd
 }
 
 func initChatCmds() {
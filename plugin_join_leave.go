@@ -16,6 +16,7 @@ var (
 
 // RegisterOnJoin registers a handler that is called
 // when a client finishes connecting to the proxy (TOSERVER_CLIENT_READY packet)
+// and has passed any password change or two-factor authentication
 // but before it is connected to an upstream server.
 // If any handler returns a non-empty string, the client is kicked
 // with that message.
@@ -31,7 +32,7 @@ func RegisterOnJoin(handler func(*ClientConn) string) {
 }
 
 // RegisterOnLeave registers a handler that is called
-// when a client disconnects for any reason after reaching the ready stage.
+// when a client disconnects for any reason after the join handlers have run.
 // Handlers are run sequentially.
 func RegisterOnLeave(handler func(*ClientConn)) {
 	initOnLeave()
@@ -143,6 +143,12 @@ func RegisterOnSrvModChanMsg(handler func(*ClientConn, string, string, string) b
 	onSrvModChanMsg = append(onSrvModChanMsg, handler)
 }
 
+// reservedModChan reports whether a modchannel is used by the proxy
+// to communicate with upstream servers. Clients cannot use it.
+func reservedModChan(channel string) bool {
+	return channel == addrModChan || channel == privsModChan
+}
+
 func cltLeaveModChan(cc *ClientConn, channel string) {
 	modChanSubscriberMu.Lock()
 	defer modChanSubscriberMu.Unlock()
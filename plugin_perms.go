@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrEmptyPermBackendName = errors.New("permission backend name is empty")
+	ErrNilPermBackend       = errors.New("permission backend is nil")
+	ErrBuiltinPermBackend   = errors.New("permission backend name collision with builtin")
+)
+
+var (
+	permBackends     map[string]PermissionBackend
+	permBackendsMu   sync.Mutex
+	permBackendsOnce sync.Once
+)
+
+// PermBackend returns a permission backend by name
+// or false if it doesn't exist.
+func PermBackend(name string) (PermissionBackend, bool) {
+	permBackendsMu.Lock()
+	defer permBackendsMu.Unlock()
+
+	pb, ok := permBackends[name]
+	return pb, ok
+}
+
+// RegisterPermBackend registers a new permission backend implementation.
+// The name must be unique, non-empty and must not collide
+// with a builtin permission backend.
+// The permission backend must be non-nil.
+// Registered backends can be enabled by specifying their name
+// in the PermBackend config option.
+// Backend-specific configuration is handled by the calling plugin's
+// configuration mechanism at initialization time.
+// Backends must be registered at initialization time
+// (before the init functions return).
+// Backends registered after initialization time will not be available
+// to the user.
+func RegisterPermBackend(name string, pb PermissionBackend) error {
+	initPermBackends()
+
+	if name == "" {
+		return ErrEmptyPermBackendName
+	}
+	if pb == nil {
+		return ErrNilPermBackend
+	}
+
+	if name == "files" || name == "sqlite3" || name == "postgresql" {
+		return ErrBuiltinPermBackend
+	}
+
+	if _, ok := PermBackend(name); ok {
+		return fmt.Errorf("duplicate permission backend %s", name)
+	}
+
+	permBackendsMu.Lock()
+	defer permBackendsMu.Unlock()
+
+	permBackends[name] = pb
+	return nil
+}
+
+func initPermBackends() {
+	permBackendsOnce.Do(func() {
+		permBackendsMu.Lock()
+		defer permBackendsMu.Unlock()
+
+		permBackends = make(map[string]PermissionBackend)
+	})
+}
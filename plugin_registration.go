@@ -0,0 +1,49 @@
+package proxy
+
+import "sync"
+
+var (
+	onRegistration     []func(*ClientConn) string
+	onRegistrationMu   sync.Mutex
+	onRegistrationOnce sync.Once
+)
+
+// RegisterOnRegistration registers a handler that is called
+// when a client tries to register a new account, after the builtin
+// registration policy has accepted it.
+// If any handler returns a non-empty string, the registration is denied
+// and the client is kicked with that message.
+// Handlers are run sequentially and block the client's
+// packet handling procedure.
+func RegisterOnRegistration(handler func(*ClientConn) string) {
+	initOnRegistration()
+
+	onRegistrationMu.Lock()
+	defer onRegistrationMu.Unlock()
+
+	onRegistration = append(onRegistration, handler)
+}
+
+func handleRegistration(cc *ClientConn) string {
+	initOnRegistration()
+
+	onRegistrationMu.Lock()
+	defer onRegistrationMu.Unlock()
+
+	for _, handler := range onRegistration {
+		if msg := handler(cc); msg != "" {
+			return msg
+		}
+	}
+
+	return ""
+}
+
+func initOnRegistration() {
+	onRegistrationOnce.Do(func() {
+		onRegistrationMu.Lock()
+		defer onRegistrationMu.Unlock()
+
+		onRegistration = make([]func(*ClientConn) string, 0)
+	})
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HimbeerserverDE/mt"
+)
+
+// privsModChan is the modchannel the privileges a client should have
+// are sent to its upstream server on. Clients cannot use it.
+const privsModChan = "mt_multiserver_proxy:privs"
+
+// privsMsg returns the sealed modchannel message that tells
+// the upstream server which of the privileges managed by the proxy
+// a client should have.
+// The payload has the format `<granted> <managed>`.
+// The privilege lists are comma separated and may be empty.
+func privsMsg(srv Server, name string, granted, managed []string, t time.Time) (string, error) {
+	privs := fmt.Sprintf("%s %s", strings.Join(granted, ","), strings.Join(managed, ","))
+	return sealMsg(srv.Secret, privsModChan, name, privs, t)
+}
+
+// SyncPrivs sends the privileges of all connected players
+// to their upstream servers if they have changed.
+// It is called automatically when permissions are changed at runtime.
+// Plugins only need to call it if permissions change in other ways,
+// e.g. if a custom permission backend is edited externally.
+func SyncPrivs() {
+	for cc := range Clts() {
+		if sc := cc.server(); sc != nil {
+			sc.syncPrivs()
+		}
+	}
+}
+
+// syncPrivs sends the privileges of the client to the upstream server
+// if privilege synchronization is enabled for the server
+// and they have changed since they were last sent.
+func (sc *ServerConn) syncPrivs() {
+	select {
+	case <-sc.Init():
+	default:
+		return
+	}
+
+	clt := sc.client()
+	if clt == nil {
+		return
+	}
+
+	conf := Conf()
+
+	srv, ok := conf.Servers[sc.name]
+	if !ok || len(srv.Privs) == 0 {
+		return
+	}
+
+	if srv.Secret == "" {
+		sc.Log("->", "can't sync privileges without secret")
+		return
+	}
+
+	levels := permLevels(&conf, clt.Name())
+
+	var granted, managed []string
+	for perm, privs := range srv.Privs {
+		has := decidePerm(&conf, levels, sc.name, perm).Granted
+		for _, priv := range privs {
+			if !containsStr(managed, priv) {
+				managed = append(managed, priv)
+			}
+
+			if has && !containsStr(granted, priv) {
+				granted = append(granted, priv)
+			}
+		}
+	}
+
+	sort.Strings(granted)
+	sort.Strings(managed)
+
+	state := strings.Join(granted, ",") + " " + strings.Join(managed, ",")
+
+	sc.privsMu.Lock()
+	defer sc.privsMu.Unlock()
+
+	if state == sc.privs {
+		return
+	}
+
+	msg, err := privsMsg(srv, clt.Name(), granted, managed, time.Now())
+	if err != nil {
+		sc.Log("->", "sync privileges:", err)
+		return
+	}
+
+	sc.privs = state
+
+	sc.SendCmd(&mt.ToSrvJoinModChan{Channel: privsModChan})
+	sc.SendCmd(&mt.ToSrvMsgModChan{
+		Channel: privsModChan,
+		Msg:     msg,
+	})
+	sc.SendCmd(&mt.ToSrvLeaveModChan{Channel: privsModChan})
+
+	sc.Log("->", "sync privileges", strings.Join(granted, ", "))
+}
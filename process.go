@@ -28,6 +28,19 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 		srv.Send(pkt)
 	}
 
+	if cc.limbo.Load() {
+		if cmd, ok := pkt.Cmd.(*mt.ToSrvInvFields); ok && limboForm(cmd.Formname) {
+			handleOnPlayerReceiveFields(cc, cmd)
+		}
+
+		return
+	}
+
+	if !cc.loggedIn() && !loginCmd(pkt.Cmd) {
+		cc.Log("->", "drop", fmt.Sprintf("%T", pkt.Cmd), "before login")
+		return
+	}
+
 	switch cmd := pkt.Cmd.(type) {
 	case *mt.ToSrvNil:
 		return
@@ -38,6 +51,12 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 		}
 
 		cc.setState(csInit)
+		if !allowInit(cc.RemoteAddr().(*net.UDPAddr).IP) {
+			cc.Log("<-", "init rate limit exceeded")
+			cc.Kick("Too many connection attempts. Please try again later.")
+			return
+		}
+
 		if cmd.SerializeVer != serializeVer {
 			cc.Log("<-", "unsupported serializeVer", cmd.SerializeVer, "expect", serializeVer)
 			ack, _ := cc.SendCmd(&mt.ToCltKick{Reason: mt.UnsupportedVer})
@@ -82,6 +101,15 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 
 		playersMu.Lock()
 		_, ok := players[cc.Name()]
+		if !ok && Conf().FoldNameCase {
+			for name := range players {
+				if strings.EqualFold(name, cc.Name()) {
+					ok = true
+					break
+				}
+			}
+		}
+
 		if ok {
 			cc.Log("<-", "already connected")
 			ack, _ := cc.SendCmd(&mt.ToCltKick{Reason: mt.AlreadyConnected})
@@ -145,16 +173,44 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 		}
 
 		ip := cc.RemoteAddr().(*net.UDPAddr).IP.String()
-		if DefaultAuth().Banned(ip, cc.Name()) {
+		if b, banned := banEntry(ip, cc.Name()); banned {
 			cc.Log("<-", "banned")
-			cc.Kick("Banned by proxy.")
+			cc.Kick(b.Message())
+			return
+		}
+
+		if until, err := lockedUntil(ip, cc.Name(), false); err != nil {
+			cc.Log("<-", "lockout check fail:", err)
+		} else if !until.IsZero() {
+			cc.Log("<-", "locked out until", until)
+			cc.Kick(lockoutMsg(until))
 			return
 		}
 
 		// reply
 		if DefaultAuth().Exists(cc.Name()) {
 			cc.auth.method = mt.SRP
+
+			// Reset codes allow the client to choose a new password
+			// without knowing the old one. Clients that have to change
+			// their password choose a new one after reconnecting.
+			if cc.checkPasswdReset() {
+				if until, err := kindLockedUntil(LockResetCode, cc.Name()); err != nil {
+					cc.Log("<-", "reset code lockout check fail:", err)
+				} else if !until.IsZero() {
+					cc.Log("<-", "reset code locked out until", until)
+					cc.Kick(lockoutMsg(until))
+					return
+				}
+
+				cc.auth.method = mt.FirstSRP
+			}
 		} else {
+			if msg := checkRegistration(cc, ip); msg != "" {
+				cc.Kick(msg)
+				return
+			}
+
 			cc.auth.method = mt.FirstSRP
 		}
 
@@ -199,27 +255,54 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 				return
 			}
 
-			if err := DefaultAuth().SetPasswd(cc.Name(), cmd.Salt, cmd.Verifier); err != nil {
-				cc.Log("<-", "set password fail")
-				ack, _ := cc.SendCmd(&mt.ToCltKick{Reason: mt.SrvErr})
+			if cc.resettingPasswd() {
+				// The password is only changed
+				// once the client has entered the reset code.
+				cc.passwd.salt, cc.passwd.verifier = cmd.Salt, cmd.Verifier
+				cc.Log("->", "await reset code")
+			} else if cc.passwd.change {
+				if err := DefaultAuth().SetPasswd(cc.Name(), cmd.Salt, cmd.Verifier); err != nil {
+					cc.Log("<-", "change password fail")
+					ack, _ := cc.SendCmd(&mt.ToCltKick{Reason: mt.SrvErr})
+
+					select {
+					case <-cc.Closed():
+					case <-ack:
+						cc.Close()
+					}
 
-				select {
-				case <-cc.Closed():
-				case <-ack:
-					cc.Close()
+					return
 				}
 
-				return
+				cc.passwdChanged()
+				cc.Log("->", "change password")
+			} else {
+				if err := DefaultAuth().SetPasswd(cc.Name(), cmd.Salt, cmd.Verifier); err != nil {
+					cc.Log("<-", "set password fail")
+					ack, _ := cc.SendCmd(&mt.ToCltKick{Reason: mt.SrvErr})
+
+					select {
+					case <-cc.Closed():
+					case <-ack:
+						cc.Close()
+					}
+
+					return
+				}
+
+				recordRegistration(cc.RemoteAddr().(*net.UDPAddr).IP.String())
+				indexName(cc.Name())
+
+				cc.Log("->", "set password")
+				cc.new = true
 			}
 
-			cc.Log("->", "set password")
 			cc.SendCmd(&mt.ToCltAcceptAuth{
 				PlayerPos:       mt.Pos{0, 5, 0},
 				MapSeed:         0,
 				SendInterval:    Conf().SendInterval,
 				SudoAuthMethods: mt.SRP,
 			})
-			cc.new = true
 		} else {
 			if cc.state() < csSudo {
 				cc.Log("->", "unauthorized sudo action")
@@ -233,6 +316,8 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 				return
 			}
 
+			cc.passwdChanged()
+
 			cc.Log("->", "change password")
 			cc.SendChatMsg("Password change successful.")
 		}
@@ -268,6 +353,21 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 			return
 		}
 
+		ip := cc.RemoteAddr().(*net.UDPAddr).IP.String()
+		if until, err := lockedUntil(ip, cc.Name(), wantSudo); err != nil {
+			cc.Log("<-", "lockout check fail:", err)
+		} else if !until.IsZero() {
+			cc.Log("<-", "locked out until", until)
+			if wantSudo {
+				cc.SendChatMsg(lockoutMsg(until))
+				cc.SendCmd(&mt.ToCltDenySudoMode{})
+				return
+			}
+
+			cc.Kick(lockoutMsg(until))
+			return
+		}
+
 		cc.auth.method = mt.SRP
 
 		salt, verifier, err := DefaultAuth().Passwd(cc.Name())
@@ -332,8 +432,14 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 			return
 		}
 
+		ip := cc.RemoteAddr().(*net.UDPAddr).IP.String()
+
 		M := srp.ClientProof([]byte(cc.Name()), cc.auth.salt, cc.auth.srpA, cc.auth.srpB, cc.auth.srpK)
 		if subtle.ConstantTimeCompare(cmd.M, M) == 1 {
+			if err := clearFails(cc.Name(), wantSudo); err != nil {
+				cc.Log("<-", "clear auth fails:", err)
+			}
+
 			cc.auth = struct {
 				method                       mt.AuthMethods
 				salt, srpA, srpB, srpM, srpK []byte
@@ -342,6 +448,8 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 			if wantSudo {
 				cc.setState(csSudo)
 				cc.SendCmd(&mt.ToCltAcceptSudoMode{})
+			} else if cc.mustChangePasswd() {
+				cc.requirePasswdReconnect()
 			} else {
 				cc.SendCmd(&mt.ToCltAcceptAuth{
 					PlayerPos:       mt.Pos{0, 5, 0},
@@ -351,7 +459,6 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 				})
 			}
 		} else {
-			ip := cc.RemoteAddr().(*net.UDPAddr).IP.String()
 			if err := DefaultAuth().RecordFail(ip, cc.Name(), wantSudo); err != nil {
 				cc.Log("<-", "record auth fail:", err)
 			}
@@ -449,10 +556,37 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 	case *mt.ToSrvReqMedia:
 		cc.sendMedia(cmd.Filenames)
 		return
+	case *mt.ToSrvHaveMedia:
+		// Acknowledgements of injected media pools
+		// must not reach the upstream server.
+		cc.mu.Lock()
+		tokens := make([]uint32, 0, len(cmd.Tokens))
+		for _, token := range cmd.Tokens {
+			if _, ok := cc.pushTokens[token]; ok {
+				delete(cc.pushTokens, token)
+				continue
+			}
+
+			tokens = append(tokens, token)
+		}
+		cc.mu.Unlock()
+
+		if len(tokens) == 0 {
+			return
+		}
+
+		cmd.Tokens = tokens
 	case *mt.ToSrvCltReady:
+		if cc.state() != csInit {
+			cc.Log("->", "duplicate clt ready")
+			return
+		}
+
 		// Don't leak media memory, regardless of whether the client
 		// requested anything.
+		cc.mu.Lock()
 		cc.media = nil
+		cc.mu.Unlock()
 
 		cc.major = cmd.Major
 		cc.minor = cmd.Minor
@@ -462,8 +596,9 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 		cc.formspecVer = cmd.Formspec
 
 		cc.setState(csActive)
-		handleJoin(cc)
-		close(cc.initCh)
+		close(cc.readyCh)
+
+		cc.finishLogin()
 
 		return
 	case *mt.ToSrvInteract:
@@ -523,14 +658,28 @@ func (cc *ClientConn) process(pkt mt.Pkt) {
 			return
 		}
 	case *mt.ToSrvJoinModChan:
+		if reservedModChan(cmd.Channel) {
+			cc.Log("->", "deny reserved modchannel", cmd.Channel)
+			return
+		}
+
 		modChanSubscriberMu.Lock()
 		defer modChanSubscriberMu.Unlock()
 
 		subs, _ := modChanSubscribers[cmd.Channel]
 		modChanSubscribers[cmd.Channel] = append(subs, cc)
 	case *mt.ToSrvLeaveModChan:
+		if reservedModChan(cmd.Channel) {
+			return
+		}
+
 		cltLeaveModChan(cc, cmd.Channel)
 	case *mt.ToSrvMsgModChan:
+		if reservedModChan(cmd.Channel) {
+			cc.Log("->", "deny reserved modchannel", cmd.Channel)
+			return
+		}
+
 		if handleCltModChanMsg(cc, cmd) {
 			return
 		}
@@ -582,7 +731,12 @@ func (sc *ServerConn) process(pkt mt.Pkt) {
 		case mt.FirstSRP:
 			id := strings.ToLower(clt.Name())
 
-			salt, verifier, err := srp.NewClient([]byte(id), []byte{})
+			// There is no old password to migrate.
+			if sc.newPasswd != nil {
+				sc.passwd, sc.newPasswd = sc.newPasswd, nil
+			}
+
+			salt, verifier, err := srp.NewClient([]byte(id), sc.passwd)
 			if err != nil {
 				sc.Log("->", err)
 				return
@@ -591,7 +745,7 @@ func (sc *ServerConn) process(pkt mt.Pkt) {
 			sc.SendCmd(&mt.ToSrvFirstSRP{
 				Salt:        salt,
 				Verifier:    verifier,
-				EmptyPasswd: true,
+				EmptyPasswd: len(sc.passwd) == 0,
 			})
 		default:
 			sc.Log("<->", "invalid auth method")
@@ -608,7 +762,7 @@ func (sc *ServerConn) process(pkt mt.Pkt) {
 		id := strings.ToLower(clt.Name())
 
 		var err error
-		sc.auth.srpK, err = srp.CompleteHandshake(sc.auth.srpA, sc.auth.a, []byte(id), []byte{}, cmd.Salt, cmd.B)
+		sc.auth.srpK, err = srp.CompleteHandshake(sc.auth.srpA, sc.auth.a, []byte(id), sc.passwd, cmd.Salt, cmd.B)
 		if err != nil {
 			sc.Log("->", err)
 			return
@@ -628,6 +782,14 @@ func (sc *ServerConn) process(pkt mt.Pkt) {
 	case *mt.ToCltKick:
 		sc.Log("<-", "deny access", cmd)
 
+		if cmd.Reason == mt.WrongPasswd && canMigratePasswd(Conf().Servers[sc.name], sc.passwd) {
+			if err := sc.retryEmptyPasswd(); err != nil {
+				sc.Log("<->", "retry with empty password:", err)
+			} else {
+				return
+			}
+		}
+
 		if cmd.Reason == mt.Shutdown || cmd.Reason == mt.Crash || cmd.Reason == mt.SrvErr || cmd.Reason == mt.TooManyClts || cmd.Reason == mt.UnsupportedVer {
 			clt.SendChatMsg("A kick occured, switching to fallback server. Reason:", cmd)
 
@@ -664,6 +826,11 @@ func (sc *ServerConn) process(pkt mt.Pkt) {
 	case *mt.ToCltAcceptSudoMode:
 		sc.Log("<-", "accept sudo")
 		sc.setState(csSudo)
+
+		if sc.newPasswd != nil {
+			sc.migratePasswd()
+		}
+
 		return
 	case *mt.ToCltAnnounceMedia:
 		sc.SendCmd(&mt.ToSrvReqMedia{})
@@ -681,6 +848,13 @@ func (sc *ServerConn) process(pkt mt.Pkt) {
 		sc.setState(csActive)
 		close(sc.initCh)
 
+		sc.forwardAddr()
+		sc.syncPrivs()
+
+		if sc.newPasswd != nil {
+			sc.enterSudo()
+		}
+
 		return
 	case *mt.ToCltMedia:
 		tokens := make([]uint32, 0, len(cmd.Files))
@@ -942,10 +1116,18 @@ func (sc *ServerConn) process(pkt mt.Pkt) {
 			sc.prependInv(cmd.Changed[k].Inv)
 		}
 	case *mt.ToCltModChanMsg:
+		if reservedModChan(cmd.Channel) {
+			return
+		}
+
 		if handleSrvModChanMsg(clt, cmd) {
 			return
 		}
 	case *mt.ToCltModChanSig:
+		if reservedModChan(cmd.Channel) {
+			return
+		}
+
 		reportStatus := func(ch chan bool, status bool) {
 			ch <- status
 			delete(sc.modChanJoinChs[cmd.Channel], ch)
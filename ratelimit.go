@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errRejectLogged is returned instead of the reason a connection
+// was rejected if it has already been logged recently.
+var errRejectLogged = errors.New("connection rejection already logged")
+
+var (
+	connLimiter   = newRateLimiter()
+	initLimiter   = newRateLimiter()
+	rejectLimiter = newRateLimiter()
+
+	// preAuthClts is the number of clients that haven't completed
+	// the handshake yet.
+	preAuthClts atomic.Int32
+)
+
+// A rateLimiter counts events per key in fixed time windows.
+type rateLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+	cleaned time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	n     int
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{windows: make(map[string]*rateWindow)}
+}
+
+// allow records an event for each key and reports whether
+// none of them exceeded its limit within the interval.
+// Keys with a limit of zero or less are not limited.
+func (rl *rateLimiter) allow(interval time.Duration, keys map[string]int) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.cleaned) > interval {
+		for key, w := range rl.windows {
+			if now.Sub(w.start) > interval {
+				delete(rl.windows, key)
+			}
+		}
+
+		rl.cleaned = now
+	}
+
+	ok := true
+	for key, limit := range keys {
+		if limit <= 0 {
+			continue
+		}
+
+		w, exists := rl.windows[key]
+		if !exists || now.Sub(w.start) > interval {
+			w = &rateWindow{start: now}
+			rl.windows[key] = w
+		}
+
+		w.n++
+		if w.n > limit {
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// subnet returns the subnet an IP address is considered to be part of
+// for rate limiting purposes.
+func subnet(ip net.IP, v4Prefix, v6Prefix int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{
+			IP:   ip4.Mask(net.CIDRMask(v4Prefix, 32)),
+			Mask: net.CIDRMask(v4Prefix, 32),
+		}).String()
+	}
+
+	return (&net.IPNet{
+		IP:   ip.Mask(net.CIDRMask(v6Prefix, 128)),
+		Mask: net.CIDRMask(v6Prefix, 128),
+	}).String()
+}
+
+// allowConn reports whether a new connection from the IP address
+// is within the configured rate limits.
+func allowConn(ip net.IP) bool {
+	rl := Conf().RateLimit
+	return connLimiter.allow(time.Duration(rl.Interval)*time.Second, map[string]int{
+		ip.String():                              rl.ConnsPerIP,
+		subnet(ip, rl.IPv4Prefix, rl.IPv6Prefix): rl.ConnsPerSubnet,
+	})
+}
+
+// allowInit reports whether an init attempt from the IP address
+// is within the configured rate limits.
+func allowInit(ip net.IP) bool {
+	rl := Conf().RateLimit
+	return initLimiter.allow(time.Duration(rl.Interval)*time.Second, map[string]int{
+		ip.String():                              rl.InitsPerIP,
+		subnet(ip, rl.IPv4Prefix, rl.IPv6Prefix): rl.InitsPerSubnet,
+	})
+}
+
+// rejectErr returns an error describing why a connection
+// from the address was rejected or errRejectLogged
+// if this has already happened within the rate limit interval.
+func rejectErr(addr net.Addr, reason string) error {
+	ip := addr.(*net.UDPAddr).IP.String()
+
+	interval := time.Duration(Conf().RateLimit.Interval) * time.Second
+	if !rejectLimiter.allow(interval, map[string]int{ip + " " + reason: 1}) {
+		return errRejectLogged
+	}
+
+	return fmt.Errorf("%s: %s", addr, reason)
+}
@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nameIndexTTL is the maximum age of the index of existing names
+// that is used to detect similar names.
+const nameIndexTTL = time.Hour
+
+var (
+	registrations   = make(map[string][]time.Time)
+	registrationsMu sync.Mutex
+)
+
+var (
+	nameIndexCache *nameIndex
+	nameIndexMu    sync.Mutex
+)
+
+// confusables replaces characters that look alike
+// with a common representative.
+var confusables = strings.NewReplacer(
+	"rn", "m",
+	"vv", "w",
+	"0", "o",
+	"1", "l",
+	"i", "l",
+	"3", "e",
+	"4", "a",
+	"5", "s",
+	"7", "t",
+	"8", "b",
+	"-", "_",
+)
+
+// nameSkeleton returns a representation of a name that is equal
+// for names that can be confused with each other.
+func nameSkeleton(name string) string {
+	return confusables.Replace(strings.ToLower(name))
+}
+
+// A nameIndex maps the skeletons and the lowercase forms
+// of existing names to the names.
+type nameIndex struct {
+	built     time.Time
+	skeletons map[string][]string
+	folded    map[string][]string
+}
+
+func (ni *nameIndex) add(name string) {
+	skel := nameSkeleton(name)
+	ni.skeletons[skel] = append(ni.skeletons[skel], name)
+
+	folded := strings.ToLower(name)
+	ni.folded[folded] = append(ni.folded[folded], name)
+}
+
+// currentNameIndex returns the cached nameIndex, rebuilding it
+// if it is too old. It requires the active AuthBackend
+// to implement UserLister. The caller must hold nameIndexMu.
+func currentNameIndex() (*nameIndex, error) {
+	if nameIndexCache == nil || time.Since(nameIndexCache.built) > nameIndexTTL {
+		names, err := ListUsers("", 0, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		ni := &nameIndex{
+			built:     time.Now(),
+			skeletons: make(map[string][]string),
+			folded:    make(map[string][]string),
+		}
+
+		for _, name := range names {
+			ni.add(name)
+		}
+
+		nameIndexCache = ni
+	}
+
+	return nameIndexCache, nil
+}
+
+// similarNames returns the existing names that can be confused
+// with the specified name.
+func similarNames(name string) ([]string, error) {
+	nameIndexMu.Lock()
+	defer nameIndexMu.Unlock()
+
+	ni, err := currentNameIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return otherNames(ni.skeletons[nameSkeleton(name)], name), nil
+}
+
+// caseDuplicates returns the existing names that only differ
+// from the specified name in case.
+// The AuthBackend is queried directly instead of using the cached
+// nameIndex because other proxies sharing the database
+// may have registered such names in the meantime.
+func caseDuplicates(name string) ([]string, error) {
+	if fnf, ok := DefaultAuth().(FoldedNameFinder); ok {
+		names, err := fnf.FoldedNames(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return otherNames(names, name), nil
+	}
+
+	names, err := ListUsers("", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var dups []string
+	for _, existing := range names {
+		if existing != name && strings.EqualFold(existing, name) {
+			dups = append(dups, existing)
+		}
+	}
+
+	return dups, nil
+}
+
+// NameCollisions returns all groups of existing names
+// that only differ in case, indexed by their lowercase form.
+// It requires the active AuthBackend to implement UserLister.
+func NameCollisions() (map[string][]string, error) {
+	nameIndexMu.Lock()
+	defer nameIndexMu.Unlock()
+
+	ni, err := currentNameIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	collisions := make(map[string][]string)
+	for folded, names := range ni.folded {
+		if len(names) > 1 {
+			collisions[folded] = append([]string{}, names...)
+		}
+	}
+
+	return collisions, nil
+}
+
+func otherNames(names []string, name string) []string {
+	var others []string
+	for _, existing := range names {
+		if existing != name {
+			others = append(others, existing)
+		}
+	}
+
+	return others
+}
+
+// indexName adds a newly registered name to the index
+// if it has been built.
+func indexName(name string) {
+	nameIndexMu.Lock()
+	defer nameIndexMu.Unlock()
+
+	if nameIndexCache != nil {
+		nameIndexCache.add(name)
+	}
+}
+
+func invalidateNameIndex() {
+	nameIndexMu.Lock()
+	defer nameIndexMu.Unlock()
+
+	nameIndexCache = nil
+}
+
+// compileNamePatterns compiles the name patterns of the registration policy.
+// Patterns are case-insensitive globs unless they are prefixed
+// with BanRegexPrefix.
+func compileNamePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expr := "(?i)^" + globToRegexp(pattern) + "$"
+		if strings.HasPrefix(pattern, BanRegexPrefix) {
+			expr = strings.TrimPrefix(pattern, BanRegexPrefix)
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern %s: %w", pattern, err)
+		}
+
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+// registrationsToday returns the number of accounts that have been
+// registered from a network address in the last 24 hours.
+func registrationsToday(addr string) int {
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+
+	return len(pruneRegistrations(addr))
+}
+
+func recordRegistration(addr string) {
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+
+	registrations[addr] = append(pruneRegistrations(addr), time.Now())
+}
+
+// pruneRegistrations deletes registration times older than a day.
+// The caller must hold registrationsMu.
+func pruneRegistrations(addr string) []time.Time {
+	var recent []time.Time
+	for _, t := range registrations[addr] {
+		if time.Since(t) < 24*time.Hour {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) == 0 {
+		delete(registrations, addr)
+	} else {
+		registrations[addr] = recent
+	}
+
+	return recent
+}
+
+// checkRegistration applies the registration policy
+// to a client that tries to register a new account.
+// It returns the kick message if the registration is denied.
+func checkRegistration(cc *ClientConn, addr string) string {
+	conf := Conf().Registration
+
+	if conf.Disable {
+		cc.Log("<-", "registration disabled")
+		return "Registrations are disabled."
+	}
+
+	if conf.MaxPerAddr > 0 && registrationsToday(addr) >= conf.MaxPerAddr {
+		cc.Log("<-", "too many registrations")
+		return "Too many accounts have been registered from your network address today."
+	}
+
+	if len(conf.allow) > 0 {
+		var allowed bool
+		for _, re := range conf.allow {
+			if re.MatchString(cc.Name()) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			cc.Log("<-", "name not allowed")
+			return "This name is not allowed."
+		}
+	}
+
+	for i, re := range conf.block {
+		if re.MatchString(cc.Name()) {
+			cc.Log("<-", "name blocked by", conf.Block[i])
+			return "This name is not allowed."
+		}
+	}
+
+	if Conf().FoldNameCase {
+		dups, err := caseDuplicates(cc.Name())
+		if err != nil {
+			cc.Log("<-", "case duplicate check fail:", err)
+			return "Registration is currently unavailable. Please try again later."
+		} else if len(dups) > 0 {
+			cc.Log("<-", "name is case duplicate of", strings.Join(dups, ", "))
+			return "Your name is a case-insensitive duplicate of " + dups[0] + "."
+		}
+	}
+
+	if conf.RejectSimilar {
+		similar, err := similarNames(cc.Name())
+		if err != nil {
+			cc.Log("<-", "similar name check fail:", err)
+			return "Registration is currently unavailable. Please try again later."
+		} else if len(similar) > 0 {
+			cc.Log("<-", "name similar to", strings.Join(similar, ", "))
+			return "This name is too similar to an existing one. Please choose a different name."
+		}
+	}
+
+	if msg := handleRegistration(cc); msg != "" {
+		cc.Log("<-", "registration denied by plugin")
+		return msg
+	}
+
+	return ""
+}
+
+func init() {
+	registerCoreChatCmd(ChatCmd{
+		Name:  "namecollisions",
+		Perm:  "cmd.namecollisions",
+		Help:  "List existing accounts whose names only differ in case.",
+		Usage: "namecollisions",
+		Handler: func(cc *ClientConn, args ...string) string {
+			collisions, err := NameCollisions()
+			if err != nil {
+				return "Could not list name collisions: " + err.Error()
+			}
+
+			if len(collisions) == 0 {
+				return "No name collisions."
+			}
+
+			folded := make([]string, 0, len(collisions))
+			for name := range collisions {
+				folded = append(folded, name)
+			}
+			sort.Strings(folded)
+
+			b := &strings.Builder{}
+			b.WriteString("Name collisions:")
+			for _, name := range folded {
+				b.WriteString("\n" + strings.Join(collisions[name], ", "))
+			}
+
+			return b.String()
+		},
+	})
+}
@@ -0,0 +1,610 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// rpcCallTimeout is the maximum duration the proxy waits
+	// for an RPC plugin to respond to a call.
+	rpcCallTimeout = 5 * time.Second
+	// rpcReadyTimeout is the maximum duration the proxy waits
+	// for all RPC plugins to finish registering their hooks on startup.
+	rpcReadyTimeout = 10 * time.Second
+	// rpcMinBackoff and rpcMaxBackoff limit the delay
+	// before an RPC plugin that exited is restarted.
+	rpcMinBackoff = time.Second
+	rpcMaxBackoff = time.Minute
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+var (
+	ErrRPCPluginUnavailable = errors.New("rpc plugin unavailable")
+	ErrRPCTimeout           = errors.New("rpc plugin didn't respond in time")
+	ErrRPCInvalidToken      = errors.New("rpc plugin sent an invalid token")
+)
+
+var (
+	rpcPlugins    []*rpcPlugin
+	rpcPluginsDir string
+	rpcPluginsMu  sync.Mutex
+)
+
+// An rpcMessage is a JSON-RPC 2.0 request, notification or response.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// An rpcError is a JSON-RPC 2.0 error object.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// An rpcConn is a connection to an RPC plugin.
+// Both sides can send requests and notifications.
+type rpcConn struct {
+	net.Conn
+
+	enc   *json.Encoder
+	encMu sync.Mutex
+
+	pending   map[uint64]chan *rpcMessage
+	nextID    uint64
+	pendingMu sync.Mutex
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRPCConn(c net.Conn) *rpcConn {
+	return &rpcConn{
+		Conn:    c,
+		enc:     json.NewEncoder(c),
+		pending: make(map[uint64]chan *rpcMessage),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Close closes the connection, failing all pending calls.
+func (rc *rpcConn) Close() error {
+	rc.closeOnce.Do(func() {
+		close(rc.closed)
+	})
+
+	return rc.Conn.Close()
+}
+
+func (rc *rpcConn) send(msg *rpcMessage) error {
+	msg.JSONRPC = "2.0"
+
+	rc.encMu.Lock()
+	defer rc.encMu.Unlock()
+
+	return rc.enc.Encode(msg)
+}
+
+// call sends a request and decodes the result into the value
+// pointed to by result unless it is nil.
+func (rc *rpcConn) call(method string, params, result any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *rpcMessage, 1)
+
+	rc.pendingMu.Lock()
+	rc.nextID++
+	id := rc.nextID
+	rc.pending[id] = ch
+	rc.pendingMu.Unlock()
+
+	defer func() {
+		rc.pendingMu.Lock()
+		defer rc.pendingMu.Unlock()
+
+		delete(rc.pending, id)
+	}()
+
+	msg := &rpcMessage{
+		ID:     json.RawMessage(strconv.FormatUint(id, 10)),
+		Method: method,
+		Params: data,
+	}
+
+	if err := rc.send(msg); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+
+		if result != nil {
+			return json.Unmarshal(resp.Result, result)
+		}
+
+		return nil
+	case <-rc.closed:
+		return ErrRPCPluginUnavailable
+	case <-time.After(rpcCallTimeout):
+		return ErrRPCTimeout
+	}
+}
+
+// notify sends a notification, i.e. a request without a response.
+func (rc *rpcConn) notify(method string, params any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	return rc.send(&rpcMessage{Method: method, Params: data})
+}
+
+// deliver passes a response to the pending call it belongs to.
+// The call is forgotten before the response is passed on,
+// so duplicate responses are dropped instead of blocking.
+func (rc *rpcConn) deliver(msg *rpcMessage) {
+	id, err := strconv.ParseUint(string(msg.ID), 10, 64)
+	if err != nil {
+		return
+	}
+
+	rc.pendingMu.Lock()
+	ch, ok := rc.pending[id]
+	delete(rc.pending, id)
+	rc.pendingMu.Unlock()
+
+	if ok {
+		// The channel is buffered and only ever receives one response.
+		ch <- msg
+	}
+}
+
+// An rpcPlugin is an external plugin process that is supervised
+// by the proxy and communicates with it over a Unix socket.
+type rpcPlugin struct {
+	name string
+	argv []string
+	sock string
+	ln   net.Listener
+
+	conn   *rpcConn
+	connMu sync.RWMutex
+
+	proc    *os.Process
+	stopped bool
+	procMu  sync.Mutex
+
+	// token is the handshake token of the running process.
+	// It is cleared once it has been used so that only
+	// the first connection of the process is accepted.
+	token   string
+	tokenMu sync.Mutex
+
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// hooks contains the hooks that have been registered with the proxy.
+	// They stay registered when the plugin is restarted.
+	hooks   map[string]struct{}
+	hooksMu sync.Mutex
+}
+
+// call calls a method of the plugin. It fails immediately
+// if the plugin isn't connected.
+func (p *rpcPlugin) call(method string, params, result any) error {
+	p.connMu.RLock()
+	rc := p.conn
+	p.connMu.RUnlock()
+
+	if rc == nil {
+		return ErrRPCPluginUnavailable
+	}
+
+	return rc.call(method, params, result)
+}
+
+// notify sends a notification to the plugin if it is connected.
+func (p *rpcPlugin) notify(method string, params any) error {
+	p.connMu.RLock()
+	rc := p.conn
+	p.connMu.RUnlock()
+
+	if rc == nil {
+		return ErrRPCPluginUnavailable
+	}
+
+	return rc.notify(method, params)
+}
+
+// hook reports whether a hook hasn't been registered yet
+// and marks it as registered.
+func (p *rpcPlugin) hook(key string) bool {
+	p.hooksMu.Lock()
+	defer p.hooksMu.Unlock()
+
+	if _, ok := p.hooks[key]; ok {
+		return false
+	}
+
+	p.hooks[key] = struct{}{}
+	return true
+}
+
+func (p *rpcPlugin) unhook(key string) {
+	p.hooksMu.Lock()
+	defer p.hooksMu.Unlock()
+
+	delete(p.hooks, key)
+}
+
+// accept accepts connections to the socket of the plugin
+// until the listener is closed.
+func (p *rpcPlugin) accept() {
+	for {
+		c, err := p.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Print("rpc plugin ", p.name, ": ", err)
+			continue
+		}
+
+		go p.handshake(c)
+	}
+}
+
+// handshake reads the token from a new connection and starts
+// serving it if it is the first connection of the running process.
+// Other connections are closed.
+func (p *rpcPlugin) handshake(c net.Conn) {
+	if err := p.checkToken(c); err != nil {
+		log.Print("rpc plugin ", p.name, ": reject connection: ", err)
+		c.Close()
+		return
+	}
+
+	rc := newRPCConn(c)
+
+	p.connMu.Lock()
+	old := p.conn
+	p.conn = rc
+	p.connMu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	log.Println("rpc plugin", p.name, "connected")
+	p.serve(rc)
+}
+
+// checkToken reads the first line sent on a connection
+// and consumes the token of the plugin if it matches.
+// The line is read byte by byte so that no messages
+// following it are lost.
+func (p *rpcPlugin) checkToken(c net.Conn) error {
+	c.SetReadDeadline(time.Now().Add(rpcCallTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := c.Read(b); err != nil {
+			return err
+		}
+
+		if b[0] == '\n' {
+			break
+		}
+
+		if len(line) >= 128 {
+			return ErrRPCInvalidToken
+		}
+
+		line = append(line, b[0])
+	}
+
+	p.tokenMu.Lock()
+	defer p.tokenMu.Unlock()
+
+	if p.token == "" || subtle.ConstantTimeCompare(line, []byte(p.token)) != 1 {
+		return ErrRPCInvalidToken
+	}
+
+	p.token = ""
+	return nil
+}
+
+// newToken generates the handshake token of a new plugin process.
+func (p *rpcPlugin) newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(b)
+
+	p.tokenMu.Lock()
+	defer p.tokenMu.Unlock()
+
+	p.token = token
+	return token, nil
+}
+
+// serve handles the messages received on a connection until it is closed.
+func (p *rpcPlugin) serve(rc *rpcConn) {
+	defer p.disconnect(rc)
+
+	dec := json.NewDecoder(rc)
+	for {
+		msg := &rpcMessage{}
+		if err := dec.Decode(msg); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Print("rpc plugin ", p.name, ": ", err)
+			rc.send(&rpcMessage{
+				ID:    json.RawMessage("null"),
+				Error: &rpcError{Code: rpcParseError, Message: err.Error()},
+			})
+			return
+		}
+
+		if msg.Method == "" {
+			rc.deliver(msg)
+			continue
+		}
+
+		go p.handle(rc, msg)
+	}
+}
+
+// handle handles a request or notification sent by the plugin.
+func (p *rpcPlugin) handle(rc *rpcConn, msg *rpcMessage) {
+	var result any
+	var err error
+
+	if method, ok := rpcMethods[msg.Method]; ok {
+		result, err = method(p, msg.Params)
+	} else {
+		err = &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + msg.Method}
+	}
+
+	if msg.ID == nil {
+		if err != nil {
+			log.Print("rpc plugin ", p.name, ": ", msg.Method, ": ", err)
+		}
+
+		return
+	}
+
+	resp := &rpcMessage{ID: msg.ID}
+	if err != nil {
+		rpcErr, ok := err.(*rpcError)
+		if !ok {
+			rpcErr = &rpcError{Code: rpcInternalError, Message: err.Error()}
+		}
+
+		resp.Error = rpcErr
+	} else if resp.Result, err = json.Marshal(result); err != nil {
+		resp.Result = nil
+		resp.Error = &rpcError{Code: rpcInternalError, Message: err.Error()}
+	}
+
+	if err := rc.send(resp); err != nil {
+		log.Print("rpc plugin ", p.name, ": ", err)
+	}
+}
+
+// disconnect closes a connection and forgets it if it is
+// the current connection of the plugin.
+func (p *rpcPlugin) disconnect(rc *rpcConn) {
+	p.connMu.Lock()
+	if p.conn == rc {
+		p.conn = nil
+	}
+	p.connMu.Unlock()
+
+	rc.Close()
+}
+
+// supervise runs the plugin process and restarts it
+// with an exponential backoff whenever it exits
+// until the plugin is stopped.
+func (p *rpcPlugin) supervise() {
+	backoff := rpcMinBackoff
+	for {
+		start := time.Now()
+		if err := p.run(); err != nil {
+			log.Print("rpc plugin ", p.name, ": ", err)
+		} else {
+			log.Println("rpc plugin", p.name, "exited")
+		}
+
+		// The token of the exited process must not be usable
+		// by anything else.
+		p.tokenMu.Lock()
+		p.token = ""
+		p.tokenMu.Unlock()
+
+		p.connMu.RLock()
+		rc := p.conn
+		p.connMu.RUnlock()
+
+		if rc != nil {
+			p.disconnect(rc)
+		}
+
+		p.procMu.Lock()
+		stopped := p.stopped
+		p.procMu.Unlock()
+
+		if stopped {
+			return
+		}
+
+		if time.Since(start) > rpcMaxBackoff {
+			backoff = rpcMinBackoff
+		}
+
+		log.Println("restart rpc plugin", p.name, "in", backoff)
+		time.Sleep(backoff)
+
+		backoff = min(backoff*2, rpcMaxBackoff)
+	}
+}
+
+// run starts the plugin process and waits for it to exit.
+func (p *rpcPlugin) run() error {
+	token, err := p.newToken()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(p.argv[0], p.argv[1:]...)
+	cmd.Dir = Path()
+	cmd.Env = append(os.Environ(), "MT_PROXY_SOCKET="+p.sock, "MT_PROXY_PLUGIN="+p.name, "MT_PROXY_TOKEN="+token)
+	cmd.Stdout = logWriter
+	cmd.Stderr = logWriter
+
+	p.procMu.Lock()
+	if p.stopped {
+		p.procMu.Unlock()
+		return nil
+	}
+
+	if err := cmd.Start(); err != nil {
+		p.procMu.Unlock()
+		return err
+	}
+
+	p.proc = cmd.Process
+	p.procMu.Unlock()
+
+	log.Println("start rpc plugin", p.name)
+	return cmd.Wait()
+}
+
+// stop terminates the plugin process and prevents it from restarting.
+func (p *rpcPlugin) stop() {
+	p.procMu.Lock()
+	defer p.procMu.Unlock()
+
+	p.stopped = true
+	p.ln.Close()
+
+	if p.proc != nil {
+		p.proc.Signal(syscall.SIGTERM)
+	}
+}
+
+// startRPCPlugins starts all RPC plugins and waits for them
+// to register their hooks so that auth backends and server selectors
+// can be used. Plugins that don't finish in time are started anyway.
+func startRPCPlugins() {
+	rpcPluginsMu.Lock()
+	defer rpcPluginsMu.Unlock()
+
+	conf := Conf().RPCPlugins
+	if len(conf) == 0 {
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "mt-multiserver-proxy-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	rpcPluginsDir = dir
+
+	for name, argv := range conf {
+		if len(argv) == 0 {
+			log.Print("rpc plugin ", name, ": no command")
+			continue
+		}
+
+		sock := filepath.Join(dir, fmt.Sprintf("%d.sock", len(rpcPlugins)))
+
+		ln, err := net.Listen("unix", sock)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		p := &rpcPlugin{
+			name:  name,
+			argv:  argv,
+			sock:  sock,
+			ln:    ln,
+			ready: make(chan struct{}),
+			hooks: make(map[string]struct{}),
+		}
+
+		rpcPlugins = append(rpcPlugins, p)
+
+		go p.accept()
+		go p.supervise()
+	}
+
+	deadline := time.Now().Add(rpcReadyTimeout)
+	for _, p := range rpcPlugins {
+		select {
+		case <-p.ready:
+			log.Println("load rpc plugin", p.name)
+		case <-time.After(time.Until(deadline)):
+			log.Print("rpc plugin ", p.name, " not ready in time")
+		}
+	}
+}
+
+// stopRPCPlugins terminates all RPC plugins.
+func stopRPCPlugins() {
+	rpcPluginsMu.Lock()
+	defer rpcPluginsMu.Unlock()
+
+	for _, p := range rpcPlugins {
+		p.stop()
+	}
+
+	if rpcPluginsDir != "" {
+		os.RemoveAll(rpcPluginsDir)
+	}
+}
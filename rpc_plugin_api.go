@@ -0,0 +1,562 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/HimbeerserverDE/mt"
+)
+
+var ErrPlayerNotOnline = errors.New("player not online")
+
+// rpcMethods contains the methods RPC plugins can call.
+var rpcMethods map[string]func(*rpcPlugin, json.RawMessage) (any, error)
+
+// Parameters of RPC methods. The same types are used for calls
+// made by the proxy.
+type (
+	rpcPlayerParams struct {
+		Player string `json:"player"`
+	}
+
+	rpcChatCmdParams struct {
+		Name  string `json:"name"`
+		Perm  string `json:"perm,omitempty"`
+		Help  string `json:"help,omitempty"`
+		Usage string `json:"usage,omitempty"`
+		// Player and Args are only used by chat_cmd calls.
+		Player string   `json:"player,omitempty"`
+		Args   []string `json:"args,omitempty"`
+	}
+
+	rpcMsgParams struct {
+		Player  string `json:"player,omitempty"`
+		Channel string `json:"channel,omitempty"`
+		Sender  string `json:"sender,omitempty"`
+		Msg     string `json:"msg"`
+	}
+
+	rpcInteractParams struct {
+		Player   string      `json:"player,omitempty"`
+		Type     Interaction `json:"type"`
+		ItemSlot uint16      `json:"item_slot,omitempty"`
+		Pointed  *rpcPointed `json:"pointed,omitempty"`
+	}
+
+	rpcPointed struct {
+		Type  string    `json:"type"`
+		Under *[3]int16 `json:"under,omitempty"`
+		Above *[3]int16 `json:"above,omitempty"`
+		ID    mt.AOID   `json:"id,omitempty"`
+	}
+
+	rpcFormParams struct {
+		Player   string     `json:"player"`
+		Formname string     `json:"formname"`
+		Formspec string     `json:"formspec,omitempty"`
+		Fields   []rpcField `json:"fields,omitempty"`
+	}
+
+	rpcField struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	rpcNameParams struct {
+		Name   string `json:"name"`
+		Player string `json:"player,omitempty"`
+	}
+
+	rpcHopParams struct {
+		Player string `json:"player"`
+		Server string `json:"server"`
+	}
+
+	rpcPermsParams struct {
+		Player string   `json:"player"`
+		Perms  []string `json:"perms"`
+	}
+
+	rpcAuthParams struct {
+		Name     string `json:"name,omitempty"`
+		Addr     string `json:"addr,omitempty"`
+		ID       string `json:"id,omitempty"`
+		Srv      string `json:"srv,omitempty"`
+		Salt     []byte `json:"salt,omitempty"`
+		Verifier []byte `json:"verifier,omitempty"`
+		Sudo     bool   `json:"sudo,omitempty"`
+		Users    []User `json:"users,omitempty"`
+		Bans     []Ban  `json:"bans,omitempty"`
+	}
+)
+
+// decodeParams decodes the parameters of a request.
+func decodeParams(raw json.RawMessage, v any) error {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+
+	return nil
+}
+
+// rpcMethod wraps a typed method handler.
+func rpcMethod[T any](handler func(*rpcPlugin, T) (any, error)) func(*rpcPlugin, json.RawMessage) (any, error) {
+	return func(p *rpcPlugin, raw json.RawMessage) (any, error) {
+		var params T
+		if err := decodeParams(raw, &params); err != nil {
+			return nil, err
+		}
+
+		return handler(p, params)
+	}
+}
+
+// findPlayer returns the ClientConn of an online player.
+func findPlayer(name string) (*ClientConn, error) {
+	cc := Find(name)
+	if cc == nil {
+		return nil, ErrPlayerNotOnline
+	}
+
+	return cc, nil
+}
+
+// rpcHook registers a hook with the proxy unless it has already been
+// registered by an earlier instance of the plugin.
+func rpcHook(key string, register func(*rpcPlugin) error) func(*rpcPlugin, json.RawMessage) (any, error) {
+	return func(p *rpcPlugin, raw json.RawMessage) (any, error) {
+		if !p.hook(key) {
+			return nil, nil
+		}
+
+		if err := register(p); err != nil {
+			p.unhook(key)
+			return nil, err
+		}
+
+		return nil, nil
+	}
+}
+
+func init() {
+	rpcMethods = map[string]func(*rpcPlugin, json.RawMessage) (any, error){
+		"ready": func(p *rpcPlugin, _ json.RawMessage) (any, error) {
+			p.readyOnce.Do(func() {
+				close(p.ready)
+			})
+
+			return nil, nil
+		},
+
+		"register_chat_cmd": rpcMethod(func(p *rpcPlugin, params rpcChatCmdParams) (any, error) {
+			key := "chat_cmd:" + params.Name
+			return rpcHook(key, func(p *rpcPlugin) error {
+				ok := RegisterChatCmd(ChatCmd{
+					Name:  params.Name,
+					Perm:  params.Perm,
+					Help:  params.Help,
+					Usage: params.Usage,
+					Handler: func(cc *ClientConn, args ...string) string {
+						call := rpcChatCmdParams{
+							Name:   params.Name,
+							Player: cc.Name(),
+							Args:   append([]string{}, args...),
+						}
+
+						var result string
+						if err := p.call("chat_cmd", call, &result); err != nil {
+							cc.Log("<-", "rpc plugin", p.name+":", err)
+							return "Command unavailable: " + err.Error()
+						}
+
+						return result
+					},
+				})
+
+				if !ok {
+					return fmt.Errorf("duplicate chat command %s", params.Name)
+				}
+
+				return nil
+			})(p, nil)
+		}),
+
+		"register_on_chat_msg": rpcHook("chat_msg", func(p *rpcPlugin) error {
+			RegisterOnChatMsg(func(cc *ClientConn, msg string) string {
+				result := msg
+				if err := p.call("chat_msg", rpcMsgParams{Player: cc.Name(), Msg: msg}, &result); err != nil {
+					return msg
+				}
+
+				return result
+			})
+
+			return nil
+		}),
+
+		"register_on_join": rpcHook("join", func(p *rpcPlugin) error {
+			RegisterOnJoin(func(cc *ClientConn) string {
+				var kick string
+				p.call("join", rpcPlayerParams{Player: cc.Name()}, &kick)
+				return kick
+			})
+
+			return nil
+		}),
+
+		"register_on_leave": rpcHook("leave", func(p *rpcPlugin) error {
+			RegisterOnLeave(func(cc *ClientConn) {
+				p.notify("leave", rpcPlayerParams{Player: cc.Name()})
+			})
+
+			return nil
+		}),
+
+		"register_interaction_handler": rpcMethod(func(p *rpcPlugin, params rpcInteractParams) (any, error) {
+			key := fmt.Sprint("interact:", params.Type)
+			return rpcHook(key, func(p *rpcPlugin) error {
+				RegisterInteractionHandler(InteractionHandler{
+					Type: params.Type,
+					Handler: func(cc *ClientConn, cmd *mt.ToSrvInteract) bool {
+						call := rpcInteractParams{
+							Player:   cc.Name(),
+							Type:     Interaction(cmd.Action),
+							ItemSlot: cmd.ItemSlot,
+						}
+
+						switch pt := cmd.Pointed.(type) {
+						case *mt.PointedNode:
+							call.Pointed = &rpcPointed{Type: "node", Under: &pt.Under, Above: &pt.Above}
+						case *mt.PointedAO:
+							call.Pointed = &rpcPointed{Type: "ao", ID: pt.ID}
+						}
+
+						var drop bool
+						p.call("interact", call, &drop)
+						return drop
+					},
+				})
+
+				return nil
+			})(p, nil)
+		}),
+
+		"register_on_inv_action": rpcHook("inv_action", func(p *rpcPlugin) error {
+			RegisterOnInvAction(func(cc *ClientConn, action string) string {
+				result := action
+				if err := p.call("inv_action", rpcMsgParams{Player: cc.Name(), Msg: action}, &result); err != nil {
+					return action
+				}
+
+				return result
+			})
+
+			return nil
+		}),
+
+		"register_on_player_receive_fields": rpcMethod(func(p *rpcPlugin, params rpcFormParams) (any, error) {
+			return rpcHook("fields:"+params.Formname, func(p *rpcPlugin) error {
+				RegisterOnPlayerReceiveFields(params.Formname, func(cc *ClientConn, fields []mt.Field) {
+					call := rpcFormParams{
+						Player:   cc.Name(),
+						Formname: params.Formname,
+					}
+
+					for _, field := range fields {
+						call.Fields = append(call.Fields, rpcField{Name: field.Name, Value: field.Value})
+					}
+
+					p.notify("fields", call)
+				})
+
+				return nil
+			})(p, nil)
+		}),
+
+		"register_on_clt_modchan_msg": rpcHook("clt_modchan_msg", func(p *rpcPlugin) error {
+			RegisterOnCltModChanMsg(func(channel string, cc *ClientConn, msg string) bool {
+				var drop bool
+				p.call("clt_modchan_msg", rpcMsgParams{Player: cc.Name(), Channel: channel, Msg: msg}, &drop)
+				return drop
+			})
+
+			return nil
+		}),
+
+		"register_on_srv_modchan_msg": rpcHook("srv_modchan_msg", func(p *rpcPlugin) error {
+			RegisterOnSrvModChanMsg(func(cc *ClientConn, channel, sender, msg string) bool {
+				var drop bool
+				p.call("srv_modchan_msg", rpcMsgParams{Player: cc.Name(), Channel: channel, Sender: sender, Msg: msg}, &drop)
+				return drop
+			})
+
+			return nil
+		}),
+
+		"register_srv_selector": rpcMethod(func(p *rpcPlugin, params rpcNameParams) (any, error) {
+			return rpcHook("srv_selector:"+params.Name, func(p *rpcPlugin) error {
+				return RegisterSrvSelector(params.Name, func(cc *ClientConn) (string, Server) {
+					var name string
+					if err := p.call("select_server", rpcNameParams{Name: params.Name, Player: cc.Name()}, &name); err != nil {
+						cc.Log("<-", "rpc plugin", p.name+":", err)
+						return "", Server{}
+					}
+
+					srv, ok := Conf().Servers[name]
+					if !ok {
+						return "", Server{}
+					}
+
+					return name, srv
+				})
+			})(p, nil)
+		}),
+
+		"register_auth_backend": rpcMethod(func(p *rpcPlugin, params rpcNameParams) (any, error) {
+			return rpcHook("auth_backend:"+params.Name, func(p *rpcPlugin) error {
+				return RegisterAuthBackend(params.Name, rpcAuth{p})
+			})(p, nil)
+		}),
+
+		"players": func(*rpcPlugin, json.RawMessage) (any, error) {
+			names := []string{}
+			for name := range Players() {
+				names = append(names, name)
+			}
+
+			sort.Strings(names)
+			return names, nil
+		},
+
+		"send_chat_msg": rpcMethod(func(p *rpcPlugin, params rpcMsgParams) (any, error) {
+			cc, err := findPlayer(params.Player)
+			if err != nil {
+				return nil, err
+			}
+
+			cc.SendChatMsg(params.Msg)
+			return nil, nil
+		}),
+
+		"kick": rpcMethod(func(p *rpcPlugin, params rpcMsgParams) (any, error) {
+			cc, err := findPlayer(params.Player)
+			if err != nil {
+				return nil, err
+			}
+
+			cc.Kick(params.Msg)
+			return nil, nil
+		}),
+
+		"hop": rpcMethod(func(p *rpcPlugin, params rpcHopParams) (any, error) {
+			cc, err := findPlayer(params.Player)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, cc.Hop(params.Server)
+		}),
+
+		"server_name": rpcMethod(func(p *rpcPlugin, params rpcPlayerParams) (any, error) {
+			cc, err := findPlayer(params.Player)
+			if err != nil {
+				return nil, err
+			}
+
+			return cc.ServerName(), nil
+		}),
+
+		"has_perms": rpcMethod(func(p *rpcPlugin, params rpcPermsParams) (any, error) {
+			if cc := Find(params.Player); cc != nil {
+				return cc.HasPerms(params.Perms...), nil
+			}
+
+			for _, perm := range params.Perms {
+				if !ExplainPerm(params.Player, "", perm).Granted {
+					return false, nil
+				}
+			}
+
+			return true, nil
+		}),
+
+		"show_formspec": rpcMethod(func(p *rpcPlugin, params rpcFormParams) (any, error) {
+			cc, err := findPlayer(params.Player)
+			if err != nil {
+				return nil, err
+			}
+
+			cc.ShowFormspec(params.Formname, params.Formspec)
+			return nil, nil
+		}),
+
+		"join_modchan": rpcMethod(func(p *rpcPlugin, params rpcMsgParams) (any, error) {
+			cc, err := findPlayer(params.Player)
+			if err != nil {
+				return nil, err
+			}
+
+			select {
+			case ok := <-cc.JoinModChan(params.Channel):
+				return ok, nil
+			case <-time.After(rpcCallTimeout):
+				return false, nil
+			}
+		}),
+
+		"leave_modchan": rpcMethod(func(p *rpcPlugin, params rpcMsgParams) (any, error) {
+			cc, err := findPlayer(params.Player)
+			if err != nil {
+				return nil, err
+			}
+
+			select {
+			case ok := <-cc.LeaveModChan(params.Channel):
+				return ok, nil
+			case <-time.After(rpcCallTimeout):
+				return false, nil
+			}
+		}),
+
+		"send_modchan_msg": rpcMethod(func(p *rpcPlugin, params rpcMsgParams) (any, error) {
+			cc, err := findPlayer(params.Player)
+			if err != nil {
+				return nil, err
+			}
+
+			return cc.SendModChanMsg(params.Channel, params.Msg), nil
+		}),
+
+		"config": func(*rpcPlugin, json.RawMessage) (any, error) {
+			return redactedConf(), nil
+		},
+	}
+}
+
+// redactedConf returns a copy of the configuration
+// without server secrets and database connection strings.
+func redactedConf() Config {
+	conf := Conf()
+
+	conf.AuthPostgresConn = ""
+	conf.PermPostgresConn = ""
+	for name, srv := range conf.Servers {
+		srv.Secret = ""
+		conf.Servers[name] = srv
+	}
+
+	return conf
+}
+
+// rpcAuth is an AuthBackend implemented by an RPC plugin.
+type rpcAuth struct {
+	p *rpcPlugin
+}
+
+// Exists reports whether a user exists. Errors count as existing users
+// so that the proxy never registers a new account while the plugin
+// is unavailable, which would overwrite the password of an existing one.
+// Logins fail instead because the password can't be retrieved.
+func (a rpcAuth) Exists(name string) bool {
+	var exists bool
+	if err := a.p.call("auth.exists", rpcAuthParams{Name: name}, &exists); err != nil {
+		log.Print("rpc plugin ", a.p.name, ": auth.exists: ", err)
+		return true
+	}
+
+	return exists
+}
+
+func (a rpcAuth) Passwd(name string) (salt, verifier []byte, err error) {
+	var result rpcAuthParams
+	if err := a.p.call("auth.passwd", rpcAuthParams{Name: name}, &result); err != nil {
+		return nil, nil, err
+	}
+
+	return result.Salt, result.Verifier, nil
+}
+
+func (a rpcAuth) SetPasswd(name string, salt, verifier []byte) error {
+	return a.p.call("auth.set_passwd", rpcAuthParams{Name: name, Salt: salt, Verifier: verifier}, nil)
+}
+
+func (a rpcAuth) LastSrv(name string) (string, error) {
+	var srv string
+	err := a.p.call("auth.last_srv", rpcAuthParams{Name: name}, &srv)
+	return srv, lastSrvErr(err)
+}
+
+func (a rpcAuth) SetLastSrv(name, srv string) error {
+	err := a.p.call("auth.set_last_srv", rpcAuthParams{Name: name, Srv: srv}, nil)
+	return lastSrvErr(err)
+}
+
+// lastSrvErr returns ErrLastSrvNotSupported
+// if the plugin doesn't implement a last server method.
+func lastSrvErr(err error) error {
+	var rpcErr *rpcError
+	if errors.As(err, &rpcErr) && rpcErr.Code == rpcMethodNotFound {
+		return ErrLastSrvNotSupported
+	}
+
+	return err
+}
+
+func (a rpcAuth) Timestamp(name string) (time.Time, error) {
+	var t time.Time
+	err := a.p.call("auth.timestamp", rpcAuthParams{Name: name}, &t)
+	return t, err
+}
+
+func (a rpcAuth) Import(in []User) error {
+	return a.p.call("auth.import", rpcAuthParams{Users: in}, nil)
+}
+
+func (a rpcAuth) Export() ([]User, error) {
+	var users []User
+	err := a.p.call("auth.export", struct{}{}, &users)
+	return users, err
+}
+
+func (a rpcAuth) Ban(addr, name string) error {
+	return a.p.call("auth.ban", rpcAuthParams{Addr: addr, Name: name}, nil)
+}
+
+func (a rpcAuth) Unban(id string) error {
+	return a.p.call("auth.unban", rpcAuthParams{ID: id}, nil)
+}
+
+// Banned reports whether a network address or name is banned.
+// Errors count as bans so that banned players can't join
+// while the plugin is unavailable.
+func (a rpcAuth) Banned(addr, name string) bool {
+	var banned bool
+	if err := a.p.call("auth.banned", rpcAuthParams{Addr: addr, Name: name}, &banned); err != nil {
+		log.Print("rpc plugin ", a.p.name, ": auth.banned: ", err)
+		return true
+	}
+
+	return banned
+}
+
+func (a rpcAuth) RecordFail(addr, name string, sudo bool) error {
+	return a.p.call("auth.record_fail", rpcAuthParams{Addr: addr, Name: name, Sudo: sudo}, nil)
+}
+
+func (a rpcAuth) ImportBans(in []Ban) error {
+	return a.p.call("auth.import_bans", rpcAuthParams{Bans: in}, nil)
+}
+
+func (a rpcAuth) ExportBans() ([]Ban, error) {
+	var bans []Ban
+	err := a.p.call("auth.export_bans", struct{}{}, &bans)
+	return bans, err
+}
@@ -0,0 +1,346 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rpcTestConn returns a connection to a fake plugin
+// and the plugin's end of it.
+func rpcTestConn(t *testing.T) (*rpcConn, net.Conn) {
+	t.Helper()
+
+	proxyEnd, pluginEnd := net.Pipe()
+	rc := newRPCConn(proxyEnd)
+
+	t.Cleanup(func() {
+		rc.Close()
+		pluginEnd.Close()
+	})
+
+	return rc, pluginEnd
+}
+
+// readRPCMessage reads a single newline-terminated message
+// and checks the JSON-RPC version.
+func readRPCMessage(t *testing.T, r *bufio.Reader) map[string]json.RawMessage {
+	t.Helper()
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		t.Fatalf("invalid message %q: %v", line, err)
+	}
+
+	if got := string(msg["jsonrpc"]); got != `"2.0"` {
+		t.Errorf("jsonrpc = %s, want \"2.0\"", got)
+	}
+
+	return msg
+}
+
+func TestRPCConnCall(t *testing.T) {
+	rc, plugin := rpcTestConn(t)
+
+	// Deliver the responses the way serve does.
+	go func() {
+		dec := json.NewDecoder(rc)
+		for {
+			msg := &rpcMessage{}
+			if err := dec.Decode(msg); err != nil {
+				return
+			}
+
+			rc.deliver(msg)
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		r := bufio.NewReader(plugin)
+		for i := 0; i < 3; i++ {
+			msg := readRPCMessage(t, r)
+
+			var resp string
+			switch method := string(msg["method"]); method {
+			case `"echo"`:
+				resp = `{"jsonrpc":"2.0","id":` + string(msg["id"]) + `,"result":` + string(msg["params"]) + "}\n"
+				// Duplicate responses must not block
+				// delivering responses to other calls.
+				resp += resp
+			case `"fail"`:
+				resp = `{"jsonrpc":"2.0","id":` + string(msg["id"]) + `,"error":{"code":-32603,"message":"failed"}}` + "\n"
+			default:
+				t.Errorf("unexpected method %s", method)
+				return
+			}
+
+			if _, err := plugin.Write([]byte(resp)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for _, want := range []string{"a", "b"} {
+		var got string
+		if err := rc.call("echo", want, &got); err != nil {
+			t.Fatalf("call(echo, %q): %v", want, err)
+		}
+
+		if got != want {
+			t.Errorf("call(echo, %q) = %q", want, got)
+		}
+	}
+
+	err := rc.call("fail", nil, nil)
+
+	var rpcErr *rpcError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != rpcInternalError || rpcErr.Message != "failed" {
+		t.Errorf("call(fail) = %v, want rpc error", err)
+	}
+
+	<-done
+
+	rc.pendingMu.Lock()
+	defer rc.pendingMu.Unlock()
+
+	if len(rc.pending) != 0 {
+		t.Errorf("%d calls still pending", len(rc.pending))
+	}
+}
+
+func TestRPCConnClose(t *testing.T) {
+	rc, plugin := rpcTestConn(t)
+
+	go bufio.NewReader(plugin).ReadBytes('\n')
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rc.call("never", nil, nil)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	rc.Close()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrRPCPluginUnavailable) {
+			t.Errorf("call = %v, want %v", err, ErrRPCPluginUnavailable)
+		}
+	case <-time.After(rpcCallTimeout / 2):
+		t.Fatal("pending call didn't fail when the connection was closed")
+	}
+}
+
+// rpcTestHandshake runs the handshake of a plugin
+// on a new connection and returns the plugin's end of it
+// and a channel that is closed when the connection is closed.
+func rpcTestHandshake(t *testing.T, p *rpcPlugin) (net.Conn, chan struct{}) {
+	t.Helper()
+
+	proxyEnd, pluginEnd := net.Pipe()
+	t.Cleanup(func() {
+		proxyEnd.Close()
+		pluginEnd.Close()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		p.handshake(proxyEnd)
+		close(done)
+	}()
+
+	return pluginEnd, done
+}
+
+func TestRPCPluginServe(t *testing.T) {
+	p := &rpcPlugin{name: "test", hooks: make(map[string]struct{}), token: "secret"}
+	plugin, served := rpcTestHandshake(t, p)
+
+	r := bufio.NewReader(plugin)
+
+	// The token and the first message may arrive together.
+	if _, err := plugin.Write([]byte("secret\n" + `{"jsonrpc":"2.0","id":7,"method":"no_such_method"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := readRPCMessage(t, r)
+	if got := string(msg["id"]); got != "7" {
+		t.Errorf("id = %s, want 7", got)
+	}
+
+	var rpcErr rpcError
+	if err := json.Unmarshal(msg["error"], &rpcErr); err != nil || rpcErr.Code != rpcMethodNotFound {
+		t.Errorf("error = %s, want code %d", msg["error"], rpcMethodNotFound)
+	}
+
+	if _, err := plugin.Write([]byte("{not json\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg = readRPCMessage(t, r)
+	if got := string(msg["id"]); got != "null" {
+		t.Errorf("id = %s, want null", got)
+	}
+
+	if err := json.Unmarshal(msg["error"], &rpcErr); err != nil || rpcErr.Code != rpcParseError {
+		t.Errorf("error = %s, want code %d", msg["error"], rpcParseError)
+	}
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("serve didn't return after a parse error")
+	}
+
+	p.connMu.RLock()
+	defer p.connMu.RUnlock()
+
+	if p.conn != nil {
+		t.Error("connection not forgotten after disconnecting")
+	}
+}
+
+func TestRPCPluginHandshake(t *testing.T) {
+	p := &rpcPlugin{name: "test", hooks: make(map[string]struct{}), token: "secret"}
+
+	rejected := func(token string) {
+		t.Helper()
+
+		plugin, done := rpcTestHandshake(t, p)
+		if _, err := plugin.Write([]byte(token + "\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("connection with token %q not rejected", token)
+		}
+
+		if _, err := plugin.Read(make([]byte, 1)); err == nil {
+			t.Errorf("connection with token %q still open", token)
+		}
+	}
+
+	rejected("wrong")
+
+	plugin, _ := rpcTestHandshake(t, p)
+	if _, err := plugin.Write([]byte("secret\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(plugin)
+	if _, err := plugin.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"no_such_method"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := readRPCMessage(t, r); string(msg["id"]) != "1" {
+		t.Errorf("id = %s, want 1", msg["id"])
+	}
+
+	// The token can only be used once.
+	rejected("secret")
+
+	p.connMu.RLock()
+	defer p.connMu.RUnlock()
+
+	if p.conn == nil {
+		t.Error("first connection replaced by a rejected one")
+	}
+}
+
+func TestRPCPluginSupervise(t *testing.T) {
+	dir := t.TempDir()
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "test.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The plugin records every start and exits immediately
+	// the first time, then keeps running.
+	starts := filepath.Join(dir, "starts")
+	script := `echo "$MT_PROXY_PLUGIN $MT_PROXY_SOCKET $MT_PROXY_TOKEN $$" >> "$1"
+if [ "$(wc -l < "$1")" -ge 2 ]; then exec sleep 60; fi
+exit 1`
+
+	p := &rpcPlugin{
+		name:  "test",
+		argv:  []string{"sh", "-c", script, "sh", starts},
+		sock:  ln.Addr().String(),
+		ln:    ln,
+		ready: make(chan struct{}),
+		hooks: make(map[string]struct{}),
+	}
+
+	supervised := make(chan struct{})
+	go func() {
+		p.supervise()
+		close(supervised)
+	}()
+
+	deadline := time.Now().Add(rpcMinBackoff + 5*time.Second)
+	var lines []string
+	for time.Now().Before(deadline) {
+		data, _ := os.ReadFile(starts)
+		if lines = strings.Fields(strings.TrimSpace(string(data))); len(lines) >= 8 {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if len(lines) < 8 {
+		t.Fatalf("plugin wasn't restarted, starts: %q", lines)
+	}
+
+	if lines[0] != "test" || lines[1] != p.sock {
+		t.Errorf("environment = %q, want %q", lines[:2], []string{"test", p.sock})
+	}
+
+	if len(lines[2]) != 64 || lines[2] == lines[6] {
+		t.Errorf("tokens = %q, want a new token for every start", []string{lines[2], lines[6]})
+	}
+
+	// Wait for the restarted process to be registered before stopping it.
+	for time.Now().Before(deadline) {
+		p.procMu.Lock()
+		started := p.proc != nil && strconv.Itoa(p.proc.Pid) == lines[7]
+		p.procMu.Unlock()
+
+		if started {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	p.stop()
+
+	select {
+	case <-supervised:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervise didn't return after stopping the plugin")
+	}
+
+	data, _ := os.ReadFile(starts)
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Errorf("plugin started %d times, want 2", n)
+	}
+}
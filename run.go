@@ -21,6 +21,8 @@ func Run() {
 func runFunc() {
 	if !Conf().NoPlugins {
 		LoadPlugins()
+		startRPCPlugins()
+		startScripts()
 	}
 
 	authBackendName := Conf().AuthBackend
@@ -51,20 +53,63 @@ func runFunc() {
 		}
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", Conf().BindAddr)
-	if err != nil {
-		log.Fatal(err)
+	permBackendName := Conf().PermBackend
+	switch permBackendName {
+	case "files":
+		setPermBackend(PermFiles{})
+	case "sqlite3":
+		pb, err := NewPermSQLite3()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		setPermBackend(pb)
+	case "postgresql":
+		pb, err := NewPermPostgreSQL(Conf().PermPostgresConn)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		setPermBackend(pb)
+	case "":
+		log.Fatal("invalid permission backend")
+	default:
+		if pb, ok := PermBackend(permBackendName); ok {
+			setPermBackend(pb)
+		} else {
+			log.Fatal("invalid permission backend")
+		}
 	}
 
-	pc, err := net.ListenUDP("udp", addr)
-	if err != nil {
+	if err := loadTempGrants(); err != nil {
 		log.Fatal(err)
 	}
 
-	l := listen(pc)
-	defer l.Close()
+	go cleanBans()
+
+	bindAddrs := Conf().BindAddr
+	if len(bindAddrs) == 0 {
+		log.Fatal("no bind addresses")
+	}
 
-	log.Println("listen", l.Addr())
+	var ls []*listener
+	for _, bindAddr := range bindAddrs {
+		addr, err := net.ResolveUDPAddr("udp", bindAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		pc, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		l := listen(pc)
+		defer l.Close()
+
+		log.Println("listen", l.Addr())
+		ls = append(ls, l)
+	}
 
 	go func() {
 		sig := make(chan os.Signal, 1)
@@ -98,18 +143,33 @@ func runFunc() {
 		}
 
 		wg.Wait()
+		stopRPCPlugins()
+
 		os.Exit(0)
 	}()
 
+	for _, l := range ls {
+		go acceptClients(l)
+	}
+
+	select {}
+}
+
+// acceptClients accepts new clients on a listener
+// until it is closed.
+func acceptClients(l *listener) {
 	for {
 		cc, err := l.accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				log.Print("stop listening")
+				log.Println("stop listening", l.Addr())
 				break
 			}
 
-			log.Print(err)
+			if !errors.Is(err, errRejectLogged) {
+				log.Print(err)
+			}
+
 			continue
 		}
 
@@ -146,8 +206,17 @@ func runFunc() {
 			}
 
 			doConnect := func(srvName string, srv Server) error {
-				if _, ok := cc.denyPools[srv.MediaPool]; ok {
-					return ErrNewMediaPool
+				if !cc.knowsPool(srv) {
+					if !conf.InjectNewPools {
+						return ErrNewMediaPool
+					}
+
+					content, err := cc.fetchPool(srvName, srv)
+					if err != nil {
+						return err
+					}
+
+					cc.injectPool(content)
 				}
 
 				addr, err := net.ResolveUDPAddr("udp", srv.Addr)
@@ -196,6 +265,4 @@ func runFunc() {
 			}
 		}()
 	}
-
-	select {}
 }
@@ -0,0 +1,495 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HimbeerserverDE/mt"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// scriptReloadInterval is the interval at which
+	// the plugins directory is checked for modified scripts.
+	scriptReloadInterval = 2 * time.Second
+
+	// scriptLoadTimeout is the maximum time a script may take to load.
+	scriptLoadTimeout = 5 * time.Second
+
+	// scriptCallTimeout is the maximum time a script callback may take.
+	scriptCallTimeout = time.Second
+)
+
+var (
+	ErrScriptUnloaded = errors.New("script unloaded")
+	ErrScriptLoading  = errors.New("hooks can only be registered while loading")
+)
+
+// A script is a Lua plugin loaded from the plugins directory.
+// Every script runs in its own Lua state.
+// Hooks are only registered while the script is loading
+// and are immutable afterwards.
+type script struct {
+	name    string
+	loading bool
+
+	chatCmds  map[string]scriptCmd
+	onChatMsg []*lua.LFunction
+	onJoin    []*lua.LFunction
+	onLeave   []*lua.LFunction
+	onFields  map[string][]*lua.LFunction
+
+	mu sync.Mutex
+	l  *lua.LState
+}
+
+// A scriptCmd is a chat command registered by a script.
+type scriptCmd struct {
+	fn                *lua.LFunction
+	perm, help, usage string
+}
+
+// A scriptStamp identifies a version of a script file.
+type scriptStamp struct {
+	mod  time.Time
+	size int64
+}
+
+var (
+	scripts       map[string]*script
+	scriptStamps  map[string]scriptStamp
+	scriptsMu     sync.RWMutex
+	scriptsLoadMu sync.Mutex
+	scriptsOnce   sync.Once
+)
+
+var (
+	scriptHooks   = make(map[string]struct{})
+	scriptHooksMu sync.Mutex
+)
+
+// startScripts loads all scripts and starts reloading them
+// whenever they are modified.
+func startScripts() {
+	scriptsOnce.Do(func() {
+		reloadScripts(false)
+
+		go func() {
+			for range time.NewTicker(scriptReloadInterval).C {
+				reloadScripts(false)
+			}
+		}()
+	})
+}
+
+// reloadScripts loads new and modified scripts and unloads deleted ones.
+// If force is true, all scripts are reloaded.
+// A script that fails to load keeps running in its previous version.
+// The errors of all scripts that failed to load are returned.
+func reloadScripts(force bool) []error {
+	scriptsLoadMu.Lock()
+	defer scriptsLoadMu.Unlock()
+
+	scriptsMu.Lock()
+	if scripts == nil {
+		scripts = make(map[string]*script)
+		scriptStamps = make(map[string]scriptStamp)
+	}
+	scriptsMu.Unlock()
+
+	path := Path("plugins")
+
+	dir, err := os.ReadDir(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+
+		dir = nil
+	}
+
+	var errs []error
+	found := make(map[string]struct{})
+	for _, f := range dir {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".lua" {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+
+		name := strings.TrimSuffix(f.Name(), ".lua")
+		found[name] = struct{}{}
+
+		stamp := scriptStamp{mod: info.ModTime(), size: info.Size()}
+
+		scriptsMu.RLock()
+		old, loaded := scripts[name]
+		unchanged := scriptStamps[name] == stamp
+		scriptsMu.RUnlock()
+
+		if unchanged && !force {
+			continue
+		}
+
+		s, err := loadScript(name, filepath.Join(path, f.Name()))
+
+		scriptsMu.Lock()
+		scriptStamps[name] = stamp
+		if err == nil {
+			scripts[name] = s
+		}
+		scriptsMu.Unlock()
+
+		if err != nil {
+			log.Println("load script", name+":", err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		s.updateChatCmds()
+
+		if loaded {
+			old.close()
+			log.Println("reload script", name)
+		} else {
+			log.Println("load script", name)
+		}
+	}
+
+	scriptsMu.Lock()
+	var removed []*script
+	for name, s := range scripts {
+		if _, ok := found[name]; !ok {
+			removed = append(removed, s)
+			delete(scripts, name)
+			delete(scriptStamps, name)
+		}
+	}
+	scriptsMu.Unlock()
+
+	for _, s := range removed {
+		s.close()
+		log.Println("unload script", s.name)
+	}
+
+	return errs
+}
+
+// loadedScripts returns all loaded scripts sorted by name.
+func loadedScripts() []*script {
+	scriptsMu.RLock()
+	defer scriptsMu.RUnlock()
+
+	var ss []*script
+	for _, s := range scripts {
+		ss = append(ss, s)
+	}
+
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].name < ss[j].name
+	})
+
+	return ss
+}
+
+// loadScript runs a script file in a new Lua state.
+func loadScript(name, path string) (*script, error) {
+	s := &script{
+		name:     name,
+		loading:  true,
+		chatCmds: make(map[string]scriptCmd),
+		onFields: make(map[string][]*lua.LFunction),
+		l:        newScriptState(),
+	}
+
+	s.l.SetGlobal("proxy", s.api())
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptLoadTimeout)
+	defer cancel()
+
+	s.l.SetContext(ctx)
+	err := s.l.DoFile(path)
+	s.l.RemoveContext()
+
+	s.loading = false
+
+	if err != nil {
+		s.l.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// newScriptState returns a Lua state with the libraries
+// that are safe to use from scripts.
+// Scripts cannot access files or run commands.
+func newScriptState() *lua.LState {
+	l := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.OsLibName, lua.OpenOs},
+	} {
+		l.Push(l.NewFunction(lib.open))
+		l.Push(lua.LString(lib.name))
+		l.Call(1, 0)
+	}
+
+	for _, name := range []string{"dofile", "loadfile"} {
+		l.SetGlobal(name, lua.LNil)
+	}
+
+	osLib := l.NewTable()
+	for _, name := range []string{"clock", "date", "difftime", "time"} {
+		osLib.RawSetString(name, l.GetField(l.GetGlobal(lua.OsLibName), name))
+	}
+	l.SetGlobal(lua.OsLibName, osLib)
+
+	return l
+}
+
+// close closes the Lua state of the script
+// after any running callback has returned.
+func (s *script) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.l != nil {
+		s.l.Close()
+		s.l = nil
+	}
+}
+
+// call calls a Lua function of the script and returns
+// nret return values.
+func (s *script) call(fn *lua.LFunction, nret int, args ...lua.LValue) ([]lua.LValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.l == nil {
+		return nil, ErrScriptUnloaded
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptCallTimeout)
+	defer cancel()
+
+	s.l.SetContext(ctx)
+	defer s.l.RemoveContext()
+
+	if err := s.l.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    nret,
+		Protect: true,
+	}, args...); err != nil {
+		return nil, err
+	}
+
+	ret := make([]lua.LValue, nret)
+	for i := nret - 1; i >= 0; i-- {
+		ret[i] = s.l.Get(-1)
+		s.l.Pop(1)
+	}
+
+	return ret, nil
+}
+
+// updateChatCmds sets the permission, help and usage
+// of the chat commands of the script to those of its current version.
+// The commands are only registered with the proxy the first time.
+func (s *script) updateChatCmds() {
+	for name, cmd := range s.chatCmds {
+		setChatCmdInfo(name, cmd.perm, cmd.help, cmd.usage)
+	}
+}
+
+// scriptHook registers a hook with the proxy unless it has already
+// been registered by another script or an earlier version of a script.
+// The hooks dispatch to the scripts that are loaded at the time
+// they are called, so reloading a script doesn't register them again.
+func scriptHook(key string, register func() error) error {
+	scriptHooksMu.Lock()
+	defer scriptHooksMu.Unlock()
+
+	if _, ok := scriptHooks[key]; ok {
+		return nil
+	}
+
+	if err := register(); err != nil {
+		return err
+	}
+
+	scriptHooks[key] = struct{}{}
+	return nil
+}
+
+func scriptChatCmd(name, perm, help, usage string) error {
+	return scriptHook("chat_cmd:"+name, func() error {
+		ok := RegisterChatCmd(ChatCmd{
+			Name:  name,
+			Perm:  perm,
+			Help:  help,
+			Usage: usage,
+			Handler: func(cc *ClientConn, args ...string) string {
+				for _, s := range loadedScripts() {
+					cmd, ok := s.chatCmds[name]
+					if !ok {
+						continue
+					}
+
+					largs := []lua.LValue{lua.LString(cc.Name())}
+					for _, arg := range args {
+						largs = append(largs, lua.LString(arg))
+					}
+
+					ret, err := s.call(cmd.fn, 1, largs...)
+					if err != nil {
+						cc.Log("<-", "script", s.name+":", err)
+						return "Command failed."
+					}
+
+					if ret[0] == lua.LNil {
+						return ""
+					}
+
+					return lua.LVAsString(ret[0])
+				}
+
+				return "Command unavailable."
+			},
+		})
+
+		if !ok {
+			return fmt.Errorf("duplicate chat command %s", name)
+		}
+
+		return nil
+	})
+}
+
+func scriptOnChatMsg() error {
+	return scriptHook("chat_msg", func() error {
+		RegisterOnChatMsg(func(cc *ClientConn, msg string) string {
+			for _, s := range loadedScripts() {
+				for _, fn := range s.onChatMsg {
+					if msg == "" {
+						return msg
+					}
+
+					ret, err := s.call(fn, 1, lua.LString(cc.Name()), lua.LString(msg))
+					if err != nil {
+						cc.Log("<-", "script", s.name+":", err)
+						continue
+					}
+
+					if ret[0] != lua.LNil {
+						msg = lua.LVAsString(ret[0])
+					}
+				}
+			}
+
+			return msg
+		})
+
+		return nil
+	})
+}
+
+func scriptOnJoin() error {
+	return scriptHook("join", func() error {
+		RegisterOnJoin(func(cc *ClientConn) string {
+			for _, s := range loadedScripts() {
+				for _, fn := range s.onJoin {
+					ret, err := s.call(fn, 1, lua.LString(cc.Name()))
+					if err != nil {
+						cc.Log("<-", "script", s.name+":", err)
+						continue
+					}
+
+					if kick := lua.LVAsString(ret[0]); kick != "" {
+						return kick
+					}
+				}
+			}
+
+			return ""
+		})
+
+		return nil
+	})
+}
+
+func scriptOnLeave() error {
+	return scriptHook("leave", func() error {
+		RegisterOnLeave(func(cc *ClientConn) {
+			for _, s := range loadedScripts() {
+				for _, fn := range s.onLeave {
+					if _, err := s.call(fn, 0, lua.LString(cc.Name())); err != nil {
+						cc.Log("<-", "script", s.name+":", err)
+					}
+				}
+			}
+		})
+
+		return nil
+	})
+}
+
+func scriptOnFields(formname string) error {
+	return scriptHook("fields:"+formname, func() error {
+		RegisterOnPlayerReceiveFields(formname, func(cc *ClientConn, fields []mt.Field) {
+			for _, s := range loadedScripts() {
+				for _, fn := range s.onFields[formname] {
+					t := new(lua.LTable)
+					for _, field := range fields {
+						t.RawSetString(field.Name, lua.LString(field.Value))
+					}
+
+					if _, err := s.call(fn, 0, lua.LString(cc.Name()), t); err != nil {
+						cc.Log("<-", "script", s.name+":", err)
+					}
+				}
+			}
+		})
+
+		return nil
+	})
+}
+
+func init() {
+	registerCoreChatCmd(ChatCmd{
+		Name:  "reloadscripts",
+		Perm:  "cmd.reloadscripts",
+		Help:  "Reload all Lua scripts.",
+		Usage: "reloadscripts",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 0 {
+				return "Usage: reloadscripts"
+			}
+
+			errs := reloadScripts(true)
+			if len(errs) > 0 {
+				return "Reloaded scripts with errors: " + errors.Join(errs...).Error()
+			}
+
+			return "Reloaded scripts."
+		},
+	})
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// api returns the proxy table that is available to the script.
+func (s *script) api() *lua.LTable {
+	t := s.l.NewTable()
+
+	for name, fn := range map[string]lua.LGFunction{
+		"register_chat_cmd": func(l *lua.LState) int {
+			name := l.CheckString(1)
+			def := l.CheckTable(2)
+
+			fn, ok := def.RawGetString("func").(*lua.LFunction)
+			if !ok {
+				l.ArgError(2, "func is not a function")
+			}
+
+			s.register(l, func() error {
+				for _, other := range loadedScripts() {
+					if _, ok := other.chatCmds[name]; ok && other.name != s.name {
+						return fmt.Errorf("duplicate chat command %s", name)
+					}
+				}
+
+				field := func(key string) string {
+					return lua.LVAsString(def.RawGetString(key))
+				}
+
+				cmd := scriptCmd{
+					fn:    fn,
+					perm:  field("perm"),
+					help:  field("help"),
+					usage: field("usage"),
+				}
+
+				if err := scriptChatCmd(name, cmd.perm, cmd.help, cmd.usage); err != nil {
+					return err
+				}
+
+				s.chatCmds[name] = cmd
+				return nil
+			})
+
+			return 0
+		},
+		"register_on_chat_msg": func(l *lua.LState) int {
+			fn := l.CheckFunction(1)
+			s.register(l, func() error {
+				s.onChatMsg = append(s.onChatMsg, fn)
+				return scriptOnChatMsg()
+			})
+
+			return 0
+		},
+		"register_on_join": func(l *lua.LState) int {
+			fn := l.CheckFunction(1)
+			s.register(l, func() error {
+				s.onJoin = append(s.onJoin, fn)
+				return scriptOnJoin()
+			})
+
+			return 0
+		},
+		"register_on_leave": func(l *lua.LState) int {
+			fn := l.CheckFunction(1)
+			s.register(l, func() error {
+				s.onLeave = append(s.onLeave, fn)
+				return scriptOnLeave()
+			})
+
+			return 0
+		},
+		"register_on_player_receive_fields": func(l *lua.LState) int {
+			formname := l.CheckString(1)
+			fn := l.CheckFunction(2)
+			s.register(l, func() error {
+				s.onFields[formname] = append(s.onFields[formname], fn)
+				return scriptOnFields(formname)
+			})
+
+			return 0
+		},
+		"players": func(l *lua.LState) int {
+			var names []string
+			for name := range Players() {
+				names = append(names, name)
+			}
+
+			sort.Strings(names)
+
+			t := l.NewTable()
+			for _, name := range names {
+				t.Append(lua.LString(name))
+			}
+
+			l.Push(t)
+			return 1
+		},
+		"send_chat_msg": scriptPlayerFunc(func(l *lua.LState, cc *ClientConn) int {
+			cc.SendChatMsg(l.CheckString(2))
+			return 0
+		}),
+		"kick": scriptPlayerFunc(func(l *lua.LState, cc *ClientConn) int {
+			cc.Kick(l.OptString(2, ""))
+			return 0
+		}),
+		"hop": scriptPlayerFunc(func(l *lua.LState, cc *ClientConn) int {
+			srv := l.CheckString(2)
+			go func() {
+				if err := cc.Hop(srv); err != nil {
+					cc.Log("<-", "script", s.name+":", err)
+				}
+			}()
+
+			return 0
+		}),
+		"server_name": scriptPlayerFunc(func(l *lua.LState, cc *ClientConn) int {
+			l.Push(lua.LString(cc.ServerName()))
+			return 1
+		}),
+		"show_formspec": scriptPlayerFunc(func(l *lua.LState, cc *ClientConn) int {
+			cc.ShowFormspec(l.CheckString(2), l.CheckString(3))
+			return 0
+		}),
+		"has_perms": func(l *lua.LState) int {
+			name := l.CheckString(1)
+
+			var perms []string
+			for i := 2; i <= l.GetTop(); i++ {
+				perms = append(perms, l.CheckString(i))
+			}
+
+			if cc := Find(name); cc != nil {
+				l.Push(lua.LBool(cc.HasPerms(perms...)))
+				return 1
+			}
+
+			for _, perm := range perms {
+				if !ExplainPerm(name, "", perm).Granted {
+					l.Push(lua.LFalse)
+					return 1
+				}
+			}
+
+			l.Push(lua.LTrue)
+			return 1
+		},
+		"formspec_escape": func(l *lua.LState) int {
+			l.Push(lua.LString(FormspecEscape(l.CheckString(1))))
+			return 1
+		},
+		"config": func(l *lua.LState) int {
+			b, err := json.Marshal(Conf())
+			if err != nil {
+				l.RaiseError("%v", err)
+			}
+
+			var v any
+			if err := json.Unmarshal(b, &v); err != nil {
+				l.RaiseError("%v", err)
+			}
+
+			l.Push(luaValue(l, v))
+			return 1
+		},
+		"log": func(l *lua.LState) int {
+			var msg []string
+			for i := 1; i <= l.GetTop(); i++ {
+				msg = append(msg, l.ToStringMeta(l.Get(i)).String())
+			}
+
+			log.Println("script", s.name+":", strings.Join(msg, " "))
+			return 0
+		},
+	} {
+		t.RawSetString(name, s.l.NewFunction(fn))
+	}
+
+	return t
+}
+
+// register runs a function that registers a hook
+// and raises a Lua error if it fails or if the script
+// has already finished loading.
+func (s *script) register(l *lua.LState, register func() error) {
+	if !s.loading {
+		l.RaiseError("%v", ErrScriptLoading)
+	}
+
+	if err := register(); err != nil {
+		l.RaiseError("%v", err)
+	}
+}
+
+// scriptPlayerFunc returns a Lua function that takes a player name
+// as its first argument. If the player isn't online,
+// the function returns nil and an error message instead of calling f.
+func scriptPlayerFunc(f func(*lua.LState, *ClientConn) int) lua.LGFunction {
+	return func(l *lua.LState) int {
+		cc, err := findPlayer(l.CheckString(1))
+		if err != nil {
+			l.Push(lua.LNil)
+			l.Push(lua.LString(err.Error()))
+			return 2
+		}
+
+		if n := f(l, cc); n > 0 {
+			return n
+		}
+
+		l.Push(lua.LTrue)
+		return 1
+	}
+}
+
+// luaValue converts a JSON value to a Lua value.
+func luaValue(l *lua.LState, v any) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []any:
+		t := l.CreateTable(len(v), 0)
+		for _, elem := range v {
+			t.Append(luaValue(l, elem))
+		}
+
+		return t
+	case map[string]any:
+		t := l.CreateTable(0, len(v))
+		for key, elem := range v {
+			t.RawSetString(key, luaValue(l, elem))
+		}
+
+		return t
+	default:
+		return lua.LNil
+	}
+}
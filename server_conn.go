@@ -29,6 +29,10 @@ type ServerConn struct {
 		salt, srpA, a, srpK []byte
 	}
 
+	// passwd is the password used to log into the server.
+	// newPasswd is set if it should be changed after logging in.
+	passwd, newPasswd []byte
+
 	mediaPool string
 	dynMedia  map[string]struct {
 		ephemeral bool
@@ -51,6 +55,10 @@ type ServerConn struct {
 	modChanJoinChMu  sync.Mutex
 	modChanLeaveChs  map[string]map[chan bool]struct{}
 	modChanLeaveChMu sync.Mutex
+
+	// privs is the last privilege state sent by syncPrivs.
+	privs   string
+	privsMu sync.Mutex
 }
 
 func (sc *ServerConn) client() *ClientConn {
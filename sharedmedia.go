@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+var (
+	// sharedMedia maps the hash and extension of a media file
+	// to the (prefixed) name of the copy that is announced to clients.
+	sharedMedia = make(map[string]string)
+	// sharedMediaKeys maps the names of shared copies
+	// to their key in sharedMedia.
+	sharedMediaKeys = make(map[string]string)
+	// mediaAliases maps the prefixed names of media files
+	// that have an identical copy to the name of that copy.
+	mediaAliases  = make(map[string]string)
+	sharedMediaMu sync.RWMutex
+)
+
+// isSharable reports whether a media file can be shared across media pools.
+// Only images are shared because other media such as sounds
+// are referenced without their file extension.
+func isSharable(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".png", ".jpg", ".jpeg", ".tga":
+		return true
+	}
+
+	return false
+}
+
+// shareMedia replaces media files that are identical to a file
+// of another media pool with that file, dropping duplicates.
+// The first file with a given content that is ever seen is shared
+// so that clients that are already connected keep working
+// if the media of the network changes. If the content of a shared
+// copy changes, other files stop using it.
+// It expects prefixed file names.
+func shareMedia(media []mediaFile) []mediaFile {
+	sharedMediaMu.Lock()
+	defer sharedMediaMu.Unlock()
+
+	for _, f := range media {
+		if !isSharable(f.name) {
+			continue
+		}
+
+		key := mediaKey(f)
+		if old, ok := sharedMediaKeys[f.name]; ok && old != key {
+			unshareMedia(f.name)
+		}
+	}
+
+	shared := make([]mediaFile, 0, len(media))
+	seen := make(map[string]struct{})
+	for _, f := range media {
+		if isSharable(f.name) {
+			key := mediaKey(f)
+
+			name, ok := sharedMedia[key]
+			if !ok {
+				name = f.name
+				sharedMedia[key] = name
+				sharedMediaKeys[name] = key
+			}
+
+			if name != f.name {
+				mediaAliases[f.name] = name
+				f.name = name
+			} else {
+				delete(mediaAliases, f.name)
+			}
+		}
+
+		if _, ok := seen[f.name]; ok {
+			continue
+		}
+
+		seen[f.name] = struct{}{}
+		shared = append(shared, f)
+	}
+
+	return shared
+}
+
+// mediaKey returns the key of a media file in sharedMedia.
+func mediaKey(f mediaFile) string {
+	return f.base64SHA1 + strings.ToLower(path.Ext(f.name))
+}
+
+// unshareMedia forgets the shared copy with the specified name
+// and all aliases of it. The caller must hold sharedMediaMu.
+func unshareMedia(name string) {
+	delete(sharedMedia, sharedMediaKeys[name])
+	delete(sharedMediaKeys, name)
+
+	for alias, shared := range mediaAliases {
+		if shared == name {
+			delete(mediaAliases, alias)
+		}
+	}
+}
+
+// sharedMediaName returns the name of the shared copy
+// of a prefixed media file or the input if there is none.
+func sharedMediaName(name string) string {
+	sharedMediaMu.RLock()
+	defer sharedMediaMu.RUnlock()
+
+	if shared, ok := mediaAliases[name]; ok {
+		return shared
+	}
+
+	return name
+}
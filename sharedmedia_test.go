@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShareMedia(t *testing.T) {
+	sharedMediaMu.Lock()
+	clear(sharedMedia)
+	clear(sharedMediaKeys)
+	clear(mediaAliases)
+	sharedMediaMu.Unlock()
+
+	names := func(media []mediaFile) []string {
+		var s []string
+		for _, f := range media {
+			s = append(s, f.name)
+		}
+
+		return s
+	}
+
+	media := shareMedia([]mediaFile{
+		{name: "a_x.png", base64SHA1: "old"},
+		{name: "b_x.png", base64SHA1: "old"},
+		{name: "b_y.ogg", base64SHA1: "old"},
+	})
+
+	if got, want := names(media), []string{"a_x.png", "b_y.ogg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first mux: media = %q, want %q", got, want)
+	}
+
+	if got := sharedMediaName("b_x.png"); got != "a_x.png" {
+		t.Errorf("first mux: sharedMediaName(b_x.png) = %q, want a_x.png", got)
+	}
+
+	// The shared copy changes, the other file must not be
+	// replaced with it anymore, even if it comes first.
+	media = shareMedia([]mediaFile{
+		{name: "b_x.png", base64SHA1: "old"},
+		{name: "a_x.png", base64SHA1: "new"},
+	})
+
+	if got, want := names(media), []string{"b_x.png", "a_x.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second mux: media = %q, want %q", got, want)
+	}
+
+	for _, name := range []string{"a_x.png", "b_x.png"} {
+		if got := sharedMediaName(name); got != name {
+			t.Errorf("second mux: sharedMediaName(%s) = %q, want %s", name, got, name)
+		}
+	}
+
+	// Files with the content of the first shared copy
+	// use the new one from now on.
+	media = shareMedia([]mediaFile{
+		{name: "c_x.png", base64SHA1: "old"},
+		{name: "d_x.png", base64SHA1: "new"},
+	})
+
+	if got, want := names(media), []string{"b_x.png", "a_x.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("third mux: media = %q, want %q", got, want)
+	}
+}
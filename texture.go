@@ -0,0 +1,162 @@
+package proxy
+
+import "strings"
+
+// RewriteTexture calls f for every file name referenced by a texture string,
+// including those embedded in texture modifiers such as `[combine`,
+// `[inventorycube`, `[mask`, `[hardlight`, `[overlay` and `[lowpart`, and returns
+// the texture string with the file names replaced by the return values of f.
+// Parentheses and escaping are handled the way the client does.
+// Parts of the texture string that are left unchanged by f
+// keep their original formatting.
+func RewriteTexture(s string, f func(string) string) string {
+	parts := splitTexture(s)
+	for i, part := range parts {
+		parts[i] = rewriteTexturePart(part, f)
+	}
+
+	return strings.Join(parts, "^")
+}
+
+// splitTexture splits a texture string at every caret
+// that is neither escaped nor inside of parentheses.
+func splitTexture(s string) []string {
+	var parts []string
+
+	var start, depth int
+	var escaped bool
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			if depth > 0 {
+				depth--
+			}
+		case s[i] == '^' && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+func rewriteTexturePart(part string, f func(string) string) string {
+	switch {
+	case part == "":
+		return part
+	case strings.HasPrefix(part, "(") && strings.HasSuffix(part, ")"):
+		return "(" + RewriteTexture(part[1:len(part)-1], f) + ")"
+	case strings.HasPrefix(part, "["):
+		return rewriteTextureModifier(part, f)
+	default:
+		return f(part)
+	}
+}
+
+func rewriteTextureModifier(mod string, f func(string) string) string {
+	switch {
+	case strings.HasPrefix(mod, "[combine:"):
+		fields := splitEscaped(mod, ':')
+
+		rewritten := make([]string, len(fields))
+		for i, field := range fields {
+			rewritten[i] = field.s
+
+			// The first two fields are the modifier name and the size.
+			if i < 2 {
+				continue
+			}
+
+			pos, file, ok := strings.Cut(field.s, "=")
+			if !ok {
+				continue
+			}
+
+			rewritten[i] = pos + "=" + rewriteEscapedTexture(file, f, "^:")
+		}
+
+		return strings.Join(rewritten, ":")
+	case strings.HasPrefix(mod, "[mask:"):
+		const prefix = "[mask:"
+		return prefix + rewriteEscapedTexture(mod[len(prefix):], f, "^:")
+	case strings.HasPrefix(mod, "[hardlight:"):
+		const prefix = "[hardlight:"
+		return prefix + rewriteEscapedTexture(mod[len(prefix):], f, "^:")
+	case strings.HasPrefix(mod, "[overlay:"):
+		const prefix = "[overlay:"
+		return prefix + rewriteEscapedTexture(mod[len(prefix):], f, "^:")
+	case strings.HasPrefix(mod, "[lowpart:"):
+		const prefix = "[lowpart:"
+
+		percent, file, ok := strings.Cut(mod[len(prefix):], ":")
+		if !ok {
+			return mod
+		}
+
+		return prefix + percent + ":" + rewriteEscapedTexture(file, f, "^:")
+	case strings.HasPrefix(mod, "[inventorycube{"):
+		const prefix = "[inventorycube{"
+
+		// Carets are replaced with ampersands in the sides.
+		sides := strings.Split(mod[len(prefix):], "{")
+		for i, side := range sides {
+			side = RewriteTexture(strings.ReplaceAll(side, "&", "^"), f)
+			sides[i] = strings.ReplaceAll(side, "^", "&")
+		}
+
+		return prefix + strings.Join(sides, "{")
+	}
+
+	return mod
+}
+
+// rewriteEscapedTexture rewrites a texture string that is embedded
+// in a texture modifier argument and therefore escaped.
+// The special characters are escaped again if the texture is modified.
+func rewriteEscapedTexture(s string, f func(string) string, special string) string {
+	unescaped := unescapeBackslashes(s)
+
+	rewritten := RewriteTexture(unescaped, f)
+	if rewritten == unescaped {
+		return s
+	}
+
+	return escapeTexture(rewritten, special)
+}
+
+// unescapeBackslashes removes one level of backslash escaping.
+func unescapeBackslashes(s string) string {
+	b := &strings.Builder{}
+
+	var escaped bool
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+
+		escaped = false
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+func escapeTexture(s, special string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' || strings.IndexByte(special, s[i]) != -1 {
+			b.WriteByte('\\')
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
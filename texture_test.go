@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func prefixTexture(s string) string {
+	return RewriteTexture(s, func(name string) string {
+		return "p_" + name
+	})
+}
+
+func TestRewriteTexture(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"a.png", "p_a.png"},
+		{"a.png^b.png", "p_a.png^p_b.png"},
+		{"a.png^[colorize:red:128", "p_a.png^[colorize:red:128"},
+		{"a.png^[opacity:128^b.png", "p_a.png^[opacity:128^p_b.png"},
+		{
+			"[combine:16x16:0,0=a.png:8,0=b.png",
+			"[combine:16x16:0,0=p_a.png:8,0=p_b.png",
+		},
+		{
+			`[combine:16x16:0,0=a.png\^[transformR90:8,0=b.png`,
+			`[combine:16x16:0,0=p_a.png\^[transformR90:8,0=p_b.png`,
+		},
+		{
+			`[combine:16x16:0,0=a.png\^[colorize\:red`,
+			`[combine:16x16:0,0=p_a.png\^[colorize\:red`,
+		},
+		{
+			`[combine:16x16:0,0=a.png\^[combine\:8x8\:0,0=b.png`,
+			`[combine:16x16:0,0=p_a.png\^[combine\:8x8\:0,0=p_b.png`,
+		},
+		{
+			"[inventorycube{a.png{b.png&[transformR90{c.png",
+			"[inventorycube{p_a.png{p_b.png&[transformR90{p_c.png",
+		},
+		{"a.png^[mask:b.png", "p_a.png^[mask:p_b.png"},
+		{`a.png^[mask:b.png\^c.png`, `p_a.png^[mask:p_b.png\^p_c.png`},
+		{"a.png^[hardlight:b.png", "p_a.png^[hardlight:p_b.png"},
+		{"a.png^[overlay:b.png", "p_a.png^[overlay:p_b.png"},
+		{"a.png^[lowpart:50:b.png", "p_a.png^[lowpart:50:p_b.png"},
+		{`a.png^[lowpart:50:b.png\^[invert\:rgb`, `p_a.png^[lowpart:50:p_b.png\^[invert\:rgb`},
+		{"a.png^(b.png^c.png)", "p_a.png^(p_b.png^p_c.png)"},
+		{"a.png^(b.png^(c.png^[mask:d.png))", "p_a.png^(p_b.png^(p_c.png^[mask:p_d.png))"},
+		{"(a.png^[resize:16x16)^[transformFX", "(p_a.png^[resize:16x16)^[transformFX"},
+		{"[fill:16x16:red^a.png", "[fill:16x16:red^p_a.png"},
+	}
+
+	for _, test := range tests {
+		if got := prefixTexture(test.in); got != test.want {
+			t.Errorf("RewriteTexture(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRewriteTextureNames(t *testing.T) {
+	var names []string
+	RewriteTexture(`a.png^[combine:8x8:0,0=b.png\^[mask\:c.png^(d.png^[lowpart:10:e.png)`, func(name string) string {
+		names = append(names, name)
+		return name
+	})
+
+	if got, want := strings.Join(names, ","), "a.png,b.png,c.png,d.png,e.png"; got != want {
+		t.Errorf("names = %s, want %s", got, want)
+	}
+}
+
+func FuzzRewriteTexture(f *testing.F) {
+	for _, seed := range []string{
+		"a.png",
+		"a.png^b.png^[colorize:red",
+		`[combine:16x16:0,0=a.png\^[colorize\:red:8,0=b.png`,
+		"[inventorycube{a.png{b.png&c.png{d.png",
+		"a.png^[mask:b.png^[hardlight:c.png^[lowpart:50:d.png",
+		"a.png^(b.png^(c.png))",
+		`\\^\(\)`,
+		"((((",
+		"))^^",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		identity := RewriteTexture(s, func(name string) string {
+			return name
+		})
+		if identity != s {
+			t.Errorf("identity rewrite of %q = %q", s, identity)
+		}
+
+		prefixed := prefixTexture(s)
+		if again := RewriteTexture(prefixed, func(name string) string {
+			return name
+		}); again != prefixed {
+			t.Errorf("identity rewrite of %q = %q", prefixed, again)
+		}
+	})
+}
@@ -0,0 +1,487 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HimbeerserverDE/mt"
+)
+
+// TOTP parameters. They are the defaults of common authenticator apps.
+const (
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1
+	totpSecretLen = 20
+)
+
+const totpFormname = "mt_multiserver_proxy:totp"
+
+var (
+	ErrTOTPNotSupported = errors.New("auth backend does not support two-factor authentication")
+	ErrTOTPCodeRequired = errors.New("current two-factor authentication code required")
+	ErrInvalidTOTPCode  = errors.New("invalid two-factor authentication code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpUsed holds the last time step that was accepted for each user
+// to prevent codes from being used twice. It is only kept in memory,
+// so a code can be used again after a restart
+// or on another proxy sharing the auth backend.
+var (
+	totpUsed   = make(map[string]uint64)
+	totpUsedMu sync.Mutex
+)
+
+// A TOTPBackend is an AuthBackend that stores TOTP secrets.
+// Two-factor authentication is only available
+// if the active AuthBackend implements this interface.
+// All bundled backends do.
+type TOTPBackend interface {
+	// TOTPSecret returns the TOTP secret of a user.
+	// It returns nil instead of an error
+	// if the user hasn't enrolled.
+	TOTPSecret(name string) ([]byte, error)
+	// SetTOTPSecret sets the TOTP secret of an existing user.
+	SetTOTPSecret(name string, secret []byte) error
+	// DeleteTOTPSecret deletes the TOTP secret of a user.
+	// Deleting a secret that doesn't exist is not an error.
+	DeleteTOTPSecret(name string) error
+}
+
+// TOTPEnrolled reports whether a user has enrolled
+// in two-factor authentication.
+func TOTPEnrolled(name string) (bool, error) {
+	tb, ok := DefaultAuth().(TOTPBackend)
+	if !ok {
+		return false, ErrTOTPNotSupported
+	}
+
+	secret, err := tb.TOTPSecret(name)
+	return secret != nil, err
+}
+
+// DisableTOTP removes the TOTP secret of a user,
+// e.g. if they lost their device.
+// If the TOTP permission applies to them they have to enroll again
+// on their next login.
+func DisableTOTP(name string) error {
+	tb, ok := DefaultAuth().(TOTPBackend)
+	if !ok {
+		return ErrTOTPNotSupported
+	}
+
+	return tb.DeleteTOTPSecret(name)
+}
+
+// EnrollTOTP shows a formspec with a new TOTP secret to the ClientConn.
+// The secret is stored once the client confirms it by entering
+// a valid code.
+func (cc *ClientConn) EnrollTOTP() error {
+	if _, ok := DefaultAuth().(TOTPBackend); !ok {
+		return ErrTOTPNotSupported
+	}
+
+	secret := make([]byte, totpSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	cc.totp.mu.Lock()
+	defer cc.totp.mu.Unlock()
+
+	cc.totp.pending = secret
+	cc.showTOTPForm("")
+
+	return nil
+}
+
+// requireTOTP asks the ClientConn for a TOTP code
+// or to enroll in two-factor authentication if necessary.
+// It reports whether this is the case.
+func (cc *ClientConn) requireTOTP() bool {
+	tb, ok := DefaultAuth().(TOTPBackend)
+	if !ok {
+		return false
+	}
+
+	cc.totp.mu.Lock()
+	defer cc.totp.mu.Unlock()
+
+	if cc.totp.verified {
+		return false
+	}
+
+	secret, err := tb.TOTPSecret(cc.Name())
+	if err != nil {
+		cc.Log("<-", "get totp secret:", err)
+		cc.Kick("Two-factor authentication failed. Please try again later.")
+		return true
+	}
+
+	perm := Conf().TOTP.Perm
+	if secret == nil && (perm == "" || !cc.HasPerms(perm)) {
+		return false
+	}
+
+	if until, err := totpLockedUntil(cc.Name()); err != nil {
+		cc.Log("<-", "totp lockout check fail:", err)
+	} else if !until.IsZero() {
+		cc.Log("<-", "totp locked out until", until)
+		cc.Kick(lockoutMsg(until))
+		return true
+	}
+
+	if secret == nil {
+		cc.Log("<-", "require totp enrollment")
+
+		cc.totp.pending = make([]byte, totpSecretLen)
+		if _, err := rand.Read(cc.totp.pending); err != nil {
+			cc.Log("<-", "generate totp secret:", err)
+			cc.Kick("Two-factor authentication failed. Please try again later.")
+			return true
+		}
+	} else {
+		cc.Log("<-", "require totp")
+	}
+
+	cc.totp.step = make(chan struct{})
+	go cc.limboTimeout(cc.totp.step, Conf().TOTP.Timeout, "Two-factor authentication timed out.")
+
+	cc.showTOTPForm("")
+	return true
+}
+
+// showTOTPForm shows the formspec asking for a TOTP code.
+// If the ClientConn is enrolling, it also contains the new secret.
+// The caller must hold cc.totp.mu.
+func (cc *ClientConn) showTOTPForm(errMsg string) {
+	b := &strings.Builder{}
+
+	y := 0.0
+	if cc.totp.pending != nil {
+		b.WriteString("formspec_version[4]size[10,6]")
+		b.WriteString("label[0.5,0.6;Add this URI or secret to your authenticator app:]")
+		fmt.Fprintf(b, "field[0.5,1.2;9,0.8;uri;;%s]", FormspecEscape(totpURI(cc.Name(), cc.totp.pending)))
+		fmt.Fprintf(b, "label[0.5,2.5;Secret: %s]", totpEncoding.EncodeToString(cc.totp.pending))
+
+		y = 2
+	} else {
+		b.WriteString("formspec_version[4]size[10,4]")
+		b.WriteString("label[0.5,0.6;Enter the code from your authenticator app.]")
+	}
+
+	if errMsg != "" {
+		fmt.Fprintf(b, "label[0.5,%.1f;%s]", y+1.3, FormspecEscape(Colorize(errMsg, "#F00")))
+	}
+
+	fmt.Fprintf(b, "field[0.5,%.1f;4,0.8;code;Code;]", y+2.4)
+	b.WriteString("field_close_on_enter[code;false]")
+	fmt.Fprintf(b, "button[5,%.1f;4.5,0.8;submit;Verify]", y+2.4)
+
+	cc.ShowFormspec(totpFormname, b.String())
+}
+
+func handleTOTPFields(cc *ClientConn, fields []mt.Field) {
+	var code string
+	var submitted bool
+	for _, field := range fields {
+		switch field.Name {
+		case "code":
+			code = field.Value
+		case "submit", "key_enter_field":
+			submitted = true
+		}
+	}
+
+	if cc.submitTOTP(code, submitted) {
+		cc.finishLogin()
+	}
+}
+
+// submitTOTP handles a submission of the TOTP formspec.
+// It reports whether the ClientConn has just passed
+// two-factor authentication during login.
+func (cc *ClientConn) submitTOTP(code string, submitted bool) bool {
+	cc.totp.mu.Lock()
+	defer cc.totp.mu.Unlock()
+
+	login := cc.totp.step != nil && !cc.totp.verified
+	if !login && cc.totp.pending == nil {
+		return false
+	}
+
+	if !submitted {
+		if login {
+			cc.showTOTPForm("")
+		} else {
+			cc.totp.pending = nil
+		}
+
+		return false
+	}
+
+	secret := cc.totp.pending
+	if secret == nil {
+		var err error
+		if secret, err = DefaultAuth().(TOTPBackend).TOTPSecret(cc.Name()); err != nil || secret == nil {
+			cc.Log("<-", "get totp secret:", err)
+			cc.Kick("Two-factor authentication failed. Please try again later.")
+			return false
+		}
+	}
+
+	step, ok := checkTOTP(secret, code, time.Now())
+	if !ok || !useTOTP(cc.Name(), step) {
+		cc.Log("->", "invalid totp code")
+
+		// Mistakes during enrollment aren't attacks.
+		if cc.totp.pending == nil {
+			if err := recordTOTPFail(cc.Name()); err != nil {
+				cc.Log("<-", "record totp fail:", err)
+			}
+
+			if until, err := totpLockedUntil(cc.Name()); err == nil && !until.IsZero() {
+				cc.Log("<-", "totp locked out until", until)
+				cc.Kick(lockoutMsg(until))
+				return false
+			}
+		}
+
+		cc.showTOTPForm("Invalid code.")
+		return false
+	}
+
+	if err := ClearAuthLock(LockTOTP, cc.Name()); err != nil && !errors.Is(err, ErrFailsNotSupported) {
+		cc.Log("<-", "clear totp fails:", err)
+	}
+
+	if cc.totp.pending != nil {
+		if err := DefaultAuth().(TOTPBackend).SetTOTPSecret(cc.Name(), cc.totp.pending); err != nil {
+			cc.Log("<-", "set totp secret:", err)
+			cc.showTOTPForm("Could not save the secret. Please try again later.")
+			return false
+		}
+
+		cc.totp.pending = nil
+
+		cc.Log("->", "enroll totp")
+		cc.SendChatMsg("Two-factor authentication enabled.")
+	}
+
+	cc.ShowFormspec(totpFormname, "")
+
+	if login {
+		cc.totp.verified = true
+		close(cc.totp.step)
+
+		cc.Log("->", "totp verified")
+	}
+
+	return login
+}
+
+// totpURI returns the provisioning URI of a TOTP secret.
+// Authenticator apps can import it from a QR code.
+func totpURI(name string, secret []byte) string {
+	issuer := Conf().TOTP.Issuer
+
+	v := url.Values{}
+	v.Set("secret", totpEncoding.EncodeToString(secret))
+	v.Set("issuer", issuer)
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+name) + "?" + v.Encode()
+}
+
+// totpCode returns the code of a TOTP secret for a time step
+// as specified in RFC 6238.
+func totpCode(secret []byte, step uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], step)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	off := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, n%mod)
+}
+
+// checkTOTP returns the time step a code is valid for,
+// allowing for a small clock skew.
+func checkTOTP(secret []byte, code string, t time.Time) (uint64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := uint64(t.Unix()) / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// useTOTP marks a time step as used by a user.
+// It reports whether it hasn't been used before.
+func useTOTP(name string, step uint64) bool {
+	totpUsedMu.Lock()
+	defer totpUsedMu.Unlock()
+
+	if step <= totpUsed[name] {
+		return false
+	}
+
+	totpUsed[name] = step
+	return true
+}
+
+// verifyTOTP checks a TOTP code of a user that has enrolled
+// in two-factor authentication, e.g. before changing the settings.
+// Users that haven't enrolled don't need a code.
+// Invalid codes are recorded as authentication failures.
+func verifyTOTP(name, code string) error {
+	tb, ok := DefaultAuth().(TOTPBackend)
+	if !ok {
+		return ErrTOTPNotSupported
+	}
+
+	if until, err := totpLockedUntil(name); err != nil {
+		return err
+	} else if !until.IsZero() {
+		return errors.New(lockoutMsg(until))
+	}
+
+	secret, err := tb.TOTPSecret(name)
+	if err != nil {
+		return err
+	}
+
+	if secret == nil {
+		return nil
+	}
+
+	if code == "" {
+		return ErrTOTPCodeRequired
+	}
+
+	step, ok := checkTOTP(secret, code, time.Now())
+	if !ok || !useTOTP(name, step) {
+		if err := recordTOTPFail(name); err != nil {
+			return err
+		}
+
+		return ErrInvalidTOTPCode
+	}
+
+	if err := ClearAuthLock(LockTOTP, name); err != nil && !errors.Is(err, ErrFailsNotSupported) {
+		return err
+	}
+
+	return nil
+}
+
+func recordTOTPFail(name string) error {
+	fr, ok := DefaultAuth().(FailRecorder)
+	if !ok {
+		return nil
+	}
+
+	lockoutMu.Lock()
+	defer lockoutMu.Unlock()
+
+	return bumpFail(fr, LockTOTP, name, Conf().Lockout.TOTPFails)
+}
+
+func totpLockedUntil(name string) (time.Time, error) {
+	return kindLockedUntil(LockTOTP, name)
+}
+
+func init() {
+	RegisterOnPlayerReceiveFields(totpFormname, handleTOTPFields)
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "totp",
+		Perm:  "cmd.totp",
+		Help:  "Enroll in or disable two-factor authentication.",
+		Usage: "totp <enroll | disable> [code]",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) < 1 || len(args) > 2 {
+				return "Usage: totp <enroll | disable> [code]"
+			}
+
+			var code string
+			if len(args) == 2 {
+				code = args[1]
+			}
+
+			switch args[0] {
+			case "enroll":
+				if err := verifyTOTP(cc.Name(), code); err != nil {
+					cc.Log("->", "totp enroll denied:", err)
+					return "Could not enroll: " + err.Error()
+				}
+
+				if err := cc.EnrollTOTP(); err != nil {
+					return "Could not enroll: " + err.Error()
+				}
+
+				return ""
+			case "disable":
+				if err := verifyTOTP(cc.Name(), code); err != nil {
+					cc.Log("->", "totp disable denied:", err)
+					return "Could not disable two-factor authentication: " + err.Error()
+				}
+
+				if err := DisableTOTP(cc.Name()); err != nil {
+					return "Could not disable two-factor authentication: " + err.Error()
+				}
+
+				cc.Log("->", "disable totp")
+				return "Two-factor authentication disabled."
+			default:
+				return "Usage: totp <enroll | disable> [code]"
+			}
+		},
+	})
+
+	registerCoreChatCmd(ChatCmd{
+		Name:  "totpreset",
+		Perm:  "cmd.totpreset",
+		Help:  "Disable two-factor authentication for an account, e.g. if its owner lost their device.",
+		Usage: "totpreset <name>",
+		Handler: func(cc *ClientConn, args ...string) string {
+			if len(args) != 1 {
+				return "Usage: totpreset <name>"
+			}
+
+			if err := DisableTOTP(args[0]); err != nil {
+				return "Could not reset two-factor authentication: " + err.Error()
+			}
+
+			cc.Log("<-", "reset totp", args[0])
+			return "Two-factor authentication reset."
+		},
+	})
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/HimbeerserverDE/mt"
+	"github.com/HimbeerserverDE/srp"
+)
+
+var ErrNoClientConn = errors.New("no client connection")
+
+// upstreamPasswd returns the password the proxy uses to authenticate
+// the specified player to an upstream server. It is derived
+// from the `Secret` of the server so that nobody who doesn't know it
+// can log into the server as any player, even if the server is reachable
+// without going through the proxy.
+// Servers without a secret use empty passwords.
+func upstreamPasswd(srv Server, name string) []byte {
+	if srv.Secret == "" {
+		return []byte{}
+	}
+
+	mac := hmac.New(sha256.New, []byte(srv.Secret))
+	mac.Write([]byte(strings.ToLower(name)))
+
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// canMigratePasswd reports whether an upstream login that failed
+// with the derived password should be retried with an empty password.
+func canMigratePasswd(srv Server, passwd []byte) bool {
+	return srv.Secret != "" && srv.MigrateEmptyPasswd && len(passwd) > 0
+}
+
+// retryEmptyPasswd replaces the ServerConn with a new connection
+// to the same server that logs in with an empty password
+// and migrates to the derived password afterwards.
+func (sc *ServerConn) retryEmptyPasswd() error {
+	clt := sc.client()
+	if clt == nil {
+		return ErrNoClientConn
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", Conf().Servers[sc.name].Addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	sc.clt = nil
+	sc.mu.Unlock()
+
+	sc.Close()
+
+	clt.mu.Lock()
+	clt.srv = nil
+	clt.mu.Unlock()
+
+	sc.Log("->", "retry with empty password")
+
+	// The client may have been connected to another server
+	// in the meantime, so the new ServerConn is used directly.
+	newSc := connectPasswd(conn, sc.name, clt, true)
+	if newSc == nil {
+		conn.Close()
+		return ErrNoServerConn
+	}
+
+	clt.modChsMu.RLock()
+	for ch := range clt.modChs {
+		newSc.SendCmd(&mt.ToSrvJoinModChan{Channel: ch})
+	}
+	clt.modChsMu.RUnlock()
+
+	if cltInfo := clt.ToSrvCltInfo(); cltInfo != nil {
+		newSc.SendCmd(cltInfo)
+	}
+
+	return nil
+}
+
+// enterSudo requests sudo mode using the current password.
+// The password is changed when the server accepts the request.
+func (sc *ServerConn) enterSudo() {
+	var err error
+	sc.auth.method = mt.SRP
+	sc.auth.srpA, sc.auth.a, err = srp.InitiateHandshake()
+	if err != nil {
+		sc.Log("->", err)
+		return
+	}
+
+	sc.SendCmd(&mt.ToSrvSRPBytesA{
+		A:      sc.auth.srpA,
+		NoSHA1: true,
+	})
+}
+
+// migratePasswd changes the password of the player
+// to the derived password. The ServerConn must be in sudo mode.
+func (sc *ServerConn) migratePasswd() {
+	clt := sc.client()
+	if clt == nil {
+		return
+	}
+
+	id := strings.ToLower(clt.Name())
+
+	salt, verifier, err := srp.NewClient([]byte(id), sc.newPasswd)
+	if err != nil {
+		sc.Log("->", err)
+		return
+	}
+
+	sc.SendCmd(&mt.ToSrvFirstSRP{
+		Salt:     salt,
+		Verifier: verifier,
+	})
+
+	sc.passwd, sc.newPasswd = sc.newPasswd, nil
+	sc.auth = struct {
+		method              mt.AuthMethods
+		salt, srpA, a, srpK []byte
+	}{}
+	sc.setState(csActive)
+
+	sc.Log("->", "migrate password")
+}